@@ -0,0 +1,15 @@
+package entities
+
+import "time"
+
+// APIKey is a key callers of the api authenticate with. Only a hash of the key itself
+// is kept - the key is shown once, when it is made.
+type APIKey struct {
+	ID        string    `json:"id"` // Public part of the key - safe to show and log
+	Name      string    `json:"name"`
+	Hash      string    `json:"-"`      // SHA-256 of the whole key
+	Scopes    []string  `json:"scopes"` // What the key may do EG users:read
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"` // Refused from then on - zero never expires
+}
@@ -1,5 +1,11 @@
 package entities
 
+import "time"
+
 type Role struct {
-	Name string `json:"name,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt,omitzero"`
+	Permissions []string  `json:"permissions,omitempty"`
+	Includes    []string  `json:"includes,omitempty"` // Roles implied by holding this one
 }
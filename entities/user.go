@@ -1,10 +1,35 @@
 package entities
 
+import "time"
+
 type User struct {
-	Username string   `json:"username,omitempty"`
-	Password string   `json:"password,omitempty"`
-	Enabled  bool     `json:"enabled,omitempty"`
-	Roles    []string `json:"roles,omitempty"`
-	Claim1   string   `json:"claim1,omitempty"`
-	Claim2   string   `json:"claim2,omitempty"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Enabled  bool              `json:"enabled"`
+	Roles    []string          `json:"roles,omitempty"`
+	Claims   map[string]string `json:"claims,omitempty"`  // EG email, tenant, display name
+	Version  int64             `json:"version,omitempty"` // Starts at 1 and goes up by one with every change
+
+	CreatedAt   time.Time `json:"createdAt,omitzero"`
+	UpdatedAt   time.Time `json:"updatedAt,omitzero"`
+	LastLoginAt time.Time `json:"lastLoginAt,omitzero"`
+	ExpiresAt   time.Time `json:"expiresAt,omitzero"` // Treated as disabled from then on - zero never expires
+
+	PasswordHistory []string `json:"-"` // Earlier password hashes, most recent first
+
+	// Lockout state - kept by Authenticate and never set through the api
+	FailedLogins  int       `json:"-"` // Bad passwords since FirstFailedAt
+	FirstFailedAt time.Time `json:"-"`
+	LockedUntil   time.Time `json:"-"`
+	Lockouts      int       `json:"-"` // Locks since the last good login - each doubles the next
+
+	// Outstanding admin password reset - only a hash of the token is kept
+	ResetTokenHash string    `json:"-"`
+	ResetExpiresAt time.Time `json:"-"`
+
+	// Second factor - the secret is encrypted and recovery codes hashed
+	TOTPSecret    string   `json:"-"`
+	TOTPEnabled   bool     `json:"-"` // Set once enrolment is confirmed with a code
+	TOTPLastStep  int64    `json:"-"` // Codes for this step or earlier cannot be used again
+	RecoveryCodes []string `json:"-"`
 }
@@ -0,0 +1,18 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// HandleReload - asks the store to re-read its backing files
+func (r *RestAPI) HandleReload(w http.ResponseWriter, req *http.Request) {
+
+	valid, err := r.verifyAPIKey(req)
+
+	if err.Code == usecases.NoError && valid {
+		err = r.Registry.Usecases.Reload()
+	}
+	r.respond(w, req, err, statusResponse{"reloaded"})
+}
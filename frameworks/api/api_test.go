@@ -2,14 +2,26 @@ package api
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
 	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/frameworks"
 	"github.com/riomhaire/lightauthuserapi/test"
 	"github.com/riomhaire/lightauthuserapi/usecases"
+	"github.com/urfave/negroni"
 )
 
 // These are the API level tests ... This builds basic configuration
@@ -28,7 +40,7 @@ func createTestRegistry() usecases.Registry {
 	// Starting state for the DB
 	userDb := make(map[string]entities.User)
 	roleDb := make([]entities.Role, 0)
-	roleDb = append(roleDb, entities.Role{"TEST"})
+	roleDb = append(roleDb, entities.Role{Name: "TEST"})
 
 	registry.StorageInteractor = test.NewInMemoryDBInteractor(logger, userDb, roleDb)
 	registry.Usecases = usecases.Usecases{&registry}
@@ -138,6 +150,7 @@ func TestAddUser(t *testing.T) {
 	// Create - Then Read
 	user := entities.User{}
 	user.Username = userName
+	user.Password = "Correct-Horse-1"
 
 	_, err = registry.Usecases.CreateUser(user)
 	if err.Code != usecases.NoError {
@@ -170,6 +183,7 @@ func TestUpdateUser(t *testing.T) {
 	// Create - Then Read
 	user := entities.User{}
 	user.Username = userName
+	user.Password = "Correct-Horse-1"
 	user.Enabled = false
 
 	_, err = registry.Usecases.CreateUser(user)
@@ -212,6 +226,7 @@ func TestDeleteUser(t *testing.T) {
 	// Create - Then Read
 	user := entities.User{}
 	user.Username = userName
+	user.Password = "Correct-Horse-1"
 	user.Enabled = false
 
 	_, err = registry.Usecases.CreateUser(user)
@@ -231,7 +246,7 @@ func TestDeleteUser(t *testing.T) {
 	}
 
 	// Delete
-	registry.Usecases.DeleteUser(userName)
+	registry.Usecases.DeleteUser(userName, 0)
 
 	// Should not read ok
 	_, err = registry.Usecases.ReadUser(userName)
@@ -251,6 +266,7 @@ func TestListUser(t *testing.T) {
 	// Create - Then Read
 	user := entities.User{}
 	user.Username = userName
+	user.Password = "Correct-Horse-1"
 	user.Enabled = false
 
 	_, err := registry.Usecases.CreateUser(user)
@@ -264,3 +280,1203 @@ func TestListUser(t *testing.T) {
 	}
 
 }
+
+func TestRoleLifecycle(t *testing.T) {
+	registry := createTestRegistry()
+
+	role, err := registry.Usecases.CreateRole(entities.Role{Name: "AUDITOR", Description: "Can read", Permissions: []string{"read"}})
+	if err.Code != usecases.NoError {
+		t.Fatalf("Unexpected role creation error - %v", err.Error)
+	}
+	if role.CreatedAt.IsZero() {
+		t.Errorf("Expected created time to be set")
+	}
+	if _, err = registry.Usecases.CreateRole(entities.Role{Name: "AUDITOR"}); err.Code != usecases.AlreadyExists {
+		t.Errorf("Expected duplicate role to be refused")
+	}
+	for _, name := range []string{" ", "A:B"} {
+		if _, err = registry.Usecases.CreateRole(entities.Role{Name: name}); err.Code != usecases.Invalid || len(err.Violations) != 1 || err.Violations[0].Field != "name" {
+			t.Errorf("Expected role name '%v' to be refused with a name violation - got %+v", name, err)
+		}
+	}
+
+	role.Description = "Can read everything"
+	role, err = registry.Usecases.UpdateRole(role)
+	if err.Code != usecases.NoError {
+		t.Errorf("Unexpected role update error - %v", err.Error)
+	}
+	role, _ = registry.Usecases.ReadRole("AUDITOR")
+	if role.Description != "Can read everything" {
+		t.Errorf("Expected updated description - got %v", role.Description)
+	}
+
+	// Held roles are only deleted when forced - and then go from the user too
+	registry.Usecases.CreateUser(entities.User{Username: "auditor", Password: "Correct-Horse-1", Roles: []string{"TEST", "AUDITOR"}})
+	if err = registry.Usecases.DeleteRole("AUDITOR", false); err.Code != usecases.InUse {
+		t.Errorf("Expected delete of held role to be refused - got %v", err.Code)
+	}
+	if err = registry.Usecases.DeleteRole("AUDITOR", true); err.Code != usecases.NoError {
+		t.Errorf("Unexpected forced delete error - %v", err.Error)
+	}
+	user, _ := registry.Usecases.ReadUser("auditor")
+	if len(user.Roles) != 1 || user.Roles[0] != "TEST" {
+		t.Errorf("Expected role to be removed from user - got %v", user.Roles)
+	}
+	if _, err = registry.Usecases.ReadRole("AUDITOR"); err.Code != usecases.Unknown {
+		t.Errorf("Expected role to be deleted")
+	}
+}
+
+// Changes a user's claims just before the first few updates of it, as another request might
+type racingUserChanges struct {
+	usecases.StorageInteractor
+	races int
+}
+
+func (store *racingUserChanges) UpdateUser(user entities.User) error {
+	if store.races > 0 {
+		store.races--
+		other, _ := store.LookupUserByName(user.Username)
+		other.Claims = map[string]string{"changed": "meanwhile"}
+		store.StorageInteractor.UpdateUser(other)
+	}
+	return store.StorageInteractor.UpdateUser(user)
+}
+
+func TestForcedRoleDeleteOutlastsOtherChanges(t *testing.T) {
+	registry := createTestRegistry()
+	now := time.Date(2026, 5, 1, 9, 0, 0, 0, time.UTC)
+	registry.Usecases.Registry.Clock = func() time.Time { return now }
+	registry.Usecases.CreateRole(entities.Role{Name: "AUDITOR"})
+	registry.Usecases.CreateUser(entities.User{Username: "auditor", Password: "Correct-Horse-1", Roles: []string{"TEST", "AUDITOR"}})
+	registry.Usecases.Registry.StorageInteractor = &racingUserChanges{StorageInteractor: registry.StorageInteractor, races: 2}
+
+	now = now.Add(time.Hour)
+	if err := registry.Usecases.DeleteRole("AUDITOR", true); err.Code != usecases.NoError {
+		t.Fatalf("Expected the forced delete to retry past other changes - got %v", err.Error)
+	}
+	user, _ := registry.Usecases.ReadUser("auditor")
+	if len(user.Roles) != 1 || user.Roles[0] != "TEST" || user.Claims["changed"] != "meanwhile" || !user.UpdatedAt.Equal(now) {
+		t.Errorf("Expected the role gone, the other change kept and the update time set - got %+v", user)
+	}
+	if _, err := registry.Usecases.ReadRole("AUDITOR"); err.Code != usecases.Unknown {
+		t.Errorf("Expected role to be deleted")
+	}
+}
+
+func TestCreateRoleViaAPI(t *testing.T) {
+	registry := createTestRegistry()
+	body := []byte("{\"description\":\"Operators\"}")
+	req, _ := http.NewRequest("POST", "/api/v1/user/roles/OPS", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "OPS"})
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+
+	rr := httptest.NewRecorder()
+	restAPI := NewRestAPI(&registry)
+	http.HandlerFunc(restAPI.HandleSpecificRole).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if _, err := registry.Usecases.ReadRole("OPS"); err.Code != usecases.NoError {
+		t.Errorf("Expected role to have been created")
+	}
+}
+
+func TestUnknownRolesRejected(t *testing.T) {
+	registry := createTestRegistry()
+
+	_, err := registry.Usecases.CreateUser(entities.User{Username: "typo", Password: "Correct-Horse-1", Roles: []string{"TEST", "ADMNI", "TSET"}})
+	if err.Code != usecases.Invalid {
+		t.Fatalf("Expected unknown roles to be rejected - got %v", err.Code)
+	}
+	if len(err.Violations) != 2 || !strings.Contains(err.Violations[0].Message, "ADMNI") {
+		t.Errorf("Expected each unknown role to be listed - got %v", err.Violations)
+	}
+
+	// Update is checked as well
+	registry.Usecases.CreateUser(entities.User{Username: "typo", Password: "Correct-Horse-1", Roles: []string{"TEST"}})
+	if _, err = registry.Usecases.UpdateUser(entities.User{Username: "typo", Roles: []string{"ADMNI"}}); err.Code != usecases.Invalid {
+		t.Errorf("Expected unknown roles to be rejected on update - got %v", err.Code)
+	}
+
+	// Unless we are migrating
+	registry.Usecases.Registry.Configuration.AutoCreateRoles = true
+	if _, err = registry.Usecases.UpdateUser(entities.User{Username: "typo", Roles: []string{"MIGRATED"}}); err.Code != usecases.NoError {
+		t.Errorf("Expected unknown role to be created - got %v", err.Error)
+	}
+	if _, err = registry.Usecases.ReadRole("MIGRATED"); err.Code != usecases.NoError {
+		t.Errorf("Expected role to exist after auto creation")
+	}
+}
+
+func TestEffectiveRolesAndCycles(t *testing.T) {
+	registry := createTestRegistry()
+	for _, name := range []string{"LIGHTAUTH_READ", "LIGHTAUTH_CREATE"} {
+		registry.Usecases.CreateRole(entities.Role{Name: name})
+	}
+	if _, err := registry.Usecases.CreateRole(entities.Role{Name: "LIGHTAUTH_ADMIN", Includes: []string{"LIGHTAUTH_CREATE", "LIGHTAUTH_READ"}}); err.Code != usecases.NoError {
+		t.Fatalf("Unexpected role creation error - %v", err.Error)
+	}
+	if _, err := registry.Usecases.CreateRole(entities.Role{Name: "SUPER", Includes: []string{"LIGHTAUTH_ADMIN"}}); err.Code != usecases.NoError {
+		t.Fatalf("Unexpected role creation error - %v", err.Error)
+	}
+	registry.Usecases.CreateUser(entities.User{Username: "boss", Password: "Correct-Horse-1", Roles: []string{"TEST", "SUPER"}})
+
+	roles, err := registry.Usecases.EffectiveRoles("boss")
+	if err.Code != usecases.NoError || strings.Join(roles, ",") != "TEST,SUPER,LIGHTAUTH_ADMIN,LIGHTAUTH_CREATE,LIGHTAUTH_READ" {
+		t.Errorf("Unexpected effective roles %v", roles)
+	}
+
+	// READ -> SUPER would close the loop
+	if _, err = registry.Usecases.UpdateRole(entities.Role{Name: "LIGHTAUTH_READ", Includes: []string{"SUPER"}}); err.Code != usecases.Invalid {
+		t.Errorf("Expected cycle to be rejected - got %v", err.Code)
+	}
+	if _, err = registry.Usecases.UpdateRole(entities.Role{Name: "LIGHTAUTH_READ", Includes: []string{"LIGHTAUTH_READ"}}); err.Code != usecases.Invalid {
+		t.Errorf("Expected self include to be rejected - got %v", err.Code)
+	}
+
+	// Via the api
+	req, _ := http.NewRequest("GET", "/api/v1/user/account/boss?expand=roles", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "boss"})
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr := httptest.NewRecorder()
+	restAPI := NewRestAPI(&registry)
+	http.HandlerFunc(restAPI.HandleSpecificUser).ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), "\"effectiveRoles\":[\"TEST\",\"SUPER\",\"LIGHTAUTH_ADMIN\"") {
+		t.Errorf("Expected expanded roles in user - got %v", rr.Body.String())
+	}
+}
+
+func TestListUsersByClaim(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.CreateUser(entities.User{Username: "alice", Password: "Correct-Horse-1", Roles: []string{"TEST"}, Claims: map[string]string{"tenant": "acme", "email": "alice@acme.com"}})
+	registry.Usecases.CreateUser(entities.User{Username: "bob", Password: "Correct-Horse-1", Roles: []string{"TEST"}, Claims: map[string]string{"tenant": "acme"}})
+	registry.Usecases.CreateUser(entities.User{Username: "carol", Password: "Correct-Horse-1", Roles: []string{"TEST"}, Claims: map[string]string{"tenant": "other"}})
+
+	req, _ := http.NewRequest("GET", "/api/v1/user/account?claim.tenant=acme", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr := httptest.NewRecorder()
+	restAPI := NewRestAPI(&registry)
+	http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+	if rr.Body.String() != `["alice","bob"]` {
+		t.Errorf("Expected users in tenant - got %v", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/api/v1/user/account?claim.tenant=acme&claim.email=alice@acme.com", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+	if rr.Body.String() != `["alice"]` {
+		t.Errorf("Expected only users holding every claim - got %v", rr.Body.String())
+	}
+}
+
+func TestPasswordsAreHashed(t *testing.T) {
+	registry := createTestRegistry()
+	// Cheap settings - the defaults are deliberately slow
+	registry.Usecases.Registry.Configuration.Argon2Memory = 64
+	registry.Usecases.Registry.Configuration.Argon2Time = 1
+
+	user, err := registry.Usecases.CreateUser(entities.User{Username: "hashed", Password: "plaintext", Roles: []string{"TEST"}})
+	if err.Code != usecases.NoError || !strings.HasPrefix(user.Password, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Expected argon2id hash - got %v", user.Password)
+	}
+	if ok, _ := registry.Usecases.VerifyPassword("hashed", "plaintext"); !ok {
+		t.Errorf("Expected password to verify")
+	}
+	if ok, _ := registry.Usecases.VerifyPassword("hashed", "wrong"); ok {
+		t.Errorf("Expected wrong password to fail")
+	}
+
+	// Writing back what was read (or no password) keeps the hash
+	stored := user.Password
+	if user, _ = registry.Usecases.UpdateUser(user); user.Password != stored {
+		t.Errorf("Expected unchanged hash to be kept")
+	}
+	user.Password = ""
+	if user, _ = registry.Usecases.UpdateUser(user); user.Password != stored {
+		t.Errorf("Expected empty password to keep the hash")
+	}
+
+	// Changing scheme means the old hash is replaced on next successful verify
+	registry.Usecases.Registry.Configuration.PasswordHash = usecases.Bcrypt
+	registry.Usecases.Registry.Configuration.BcryptCost = 4
+	registry.Usecases.VerifyPassword("hashed", "plaintext")
+	if user, _ = registry.Usecases.ReadUser("hashed"); !strings.HasPrefix(user.Password, "$2a$04$") {
+		t.Errorf("Expected hash to be upgraded to bcrypt - got %v", user.Password)
+	}
+}
+
+func TestLegacyPasswordHashUpgraded(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.Registry.Configuration.Argon2Memory = 64
+	registry.Usecases.Registry.Configuration.Argon2Time = 1
+	// sha256("password") as held in old users.csv files
+	registry.StorageInteractor.CreateUser(entities.User{Username: "legacy", Password: "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"})
+
+	if ok, _ := registry.Usecases.VerifyPassword("legacy", "wrong"); ok {
+		t.Errorf("Expected wrong password to fail")
+	}
+	if user, _ := registry.Usecases.ReadUser("legacy"); strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("Expected hash to be kept after a failed verify")
+	}
+	if ok, _ := registry.Usecases.VerifyPassword("legacy", "password"); !ok {
+		t.Errorf("Expected legacy hash to verify")
+	}
+	if user, _ := registry.Usecases.ReadUser("legacy"); !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("Expected legacy hash to be upgraded - got %v", user.Password)
+	}
+	if ok, _ := registry.Usecases.VerifyPassword("legacy", "password"); !ok {
+		t.Errorf("Expected upgraded hash to verify")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.Registry.Configuration.Argon2Memory = 64
+	registry.Usecases.Registry.Configuration.Argon2Time = 1
+	registry.Usecases.CreateUser(entities.User{Username: "login", Password: "right", Enabled: true, Roles: []string{"TEST"}, Claims: map[string]string{"email": "login@example.com"}})
+	registry.Usecases.CreateUser(entities.User{Username: "disabled", Password: "right", Roles: []string{"TEST"}})
+	restAPI := NewRestAPI(&registry)
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"username":"login","password":"right"}`, http.StatusOK},
+		{`{"username":"login","password":"wrong"}`, http.StatusUnauthorized},
+		{`{"username":"nobody","password":"right"}`, http.StatusUnauthorized},
+		{`{"username":"disabled","password":"right"}`, http.StatusUnauthorized},
+		{`not json`, http.StatusNotAcceptable},
+	} {
+		req, _ := http.NewRequest("POST", "/api/v1/user/authenticate", strings.NewReader(tc.body))
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleAuthenticate).ServeHTTP(rr, req)
+		if rr.Code != tc.code {
+			t.Errorf("%v : expected %v got %v", tc.body, tc.code, rr.Code)
+		}
+		if tc.code == http.StatusOK {
+			if strings.Contains(rr.Body.String(), "password") || !strings.Contains(rr.Body.String(), "login@example.com") {
+				t.Errorf("Expected roles and claims without the password - got %v", rr.Body.String())
+			}
+		}
+	}
+
+	// Reads can be stopped from returning hashes
+	registry.Usecases.Registry.Configuration.HidePasswords = true
+	if user, _ := registry.Usecases.ReadUser("login"); len(user.Password) > 0 {
+		t.Errorf("Expected password to be hidden")
+	}
+	// ... and writing back what was read keeps the password
+	user, _ := registry.Usecases.ReadUser("login")
+	registry.Usecases.UpdateUser(user)
+	if _, err := registry.Usecases.Authenticate("login", "right"); err.Code != usecases.NoError {
+		t.Errorf("Expected password to survive an update without one")
+	}
+}
+
+func TestLockoutAfterFailedLogins(t *testing.T) {
+	registry := createTestRegistry()
+	config := &registry.Usecases.Registry.Configuration
+	config.Argon2Memory = 64
+	config.Argon2Time = 1
+	config.MaxFailedLogins = 3
+	config.LockoutDuration = time.Minute
+	registry.Usecases.CreateUser(entities.User{Username: "locky", Password: "right", Enabled: true, Roles: []string{"TEST"}})
+
+	for i := 0; i < 3; i++ {
+		registry.Usecases.Authenticate("locky", "wrong")
+	}
+	if _, err := registry.Usecases.Authenticate("locky", "right"); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected locked account to refuse the right password")
+	}
+	status, _ := registry.Usecases.ReadLock("locky")
+	if !status.Locked || status.Lockouts != 1 || time.Until(status.LockedUntil) > time.Minute {
+		t.Errorf("Unexpected lock status %+v", status)
+	}
+
+	// Admin clears the lock
+	restAPI := NewRestAPI(&registry)
+	req, _ := http.NewRequest("DELETE", "/api/v1/user/account/locky/lock", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "locky"})
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(restAPI.HandleLock).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"locked":false`) {
+		t.Errorf("Expected lock to be cleared - got %v %v", rr.Code, rr.Body.String())
+	}
+	if _, err := registry.Usecases.Authenticate("locky", "right"); err.Code != usecases.NoError {
+		t.Errorf("Expected login after unlock")
+	}
+
+	// Each further lock lasts twice as long
+	user, _ := registry.Usecases.ReadUser("locky")
+	user.Lockouts = 2
+	registry.StorageInteractor.UpdateUser(user)
+	for i := 0; i < 3; i++ {
+		registry.Usecases.Authenticate("locky", "wrong")
+	}
+	status, _ = registry.Usecases.ReadLock("locky")
+	if status.Lockouts != 3 || time.Until(status.LockedUntil) < 3*time.Minute {
+		t.Errorf("Expected backed off lock - got %+v", status)
+	}
+}
+
+// A store where another bad password for the same user lands between each read and write
+type racingFailedLogins struct {
+	usecases.StorageInteractor
+	races int
+}
+
+func (store *racingFailedLogins) UpdateUser(user entities.User) error {
+	if store.races > 0 {
+		store.races--
+		other, _ := store.LookupUserByName(user.Username)
+		if other.FailedLogins == 0 {
+			other.FirstFailedAt = time.Now()
+		}
+		other.FailedLogins++
+		store.StorageInteractor.UpdateUser(other)
+	}
+	return store.StorageInteractor.UpdateUser(user)
+}
+
+func TestParallelFailedLoginsAllCount(t *testing.T) {
+	registry := createTestRegistry()
+	config := &registry.Usecases.Registry.Configuration
+	config.Argon2Memory = 64
+	config.Argon2Time = 1
+	config.MaxFailedLogins = 3
+	registry.Usecases.CreateUser(entities.User{Username: "racer", Password: "right", Enabled: true, Roles: []string{"TEST"}})
+	registry.Usecases.Registry.StorageInteractor = &racingFailedLogins{StorageInteractor: registry.StorageInteractor, races: 1}
+
+	// The first is overtaken by another bad password - three failures in all
+	registry.Usecases.Authenticate("racer", "wrong")
+	if status, _ := registry.Usecases.ReadLock("racer"); status.FailedLogins != 2 {
+		t.Errorf("Expected both failed logins to count - got %+v", status)
+	}
+	registry.Usecases.Authenticate("racer", "wrong")
+	if status, _ := registry.Usecases.ReadLock("racer"); !status.Locked || status.Lockouts != 1 {
+		t.Errorf("Expected the third failure to lock - got %+v", status)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	registry := createTestRegistry()
+	config := &registry.Usecases.Registry.Configuration
+	config.Argon2Memory = 64
+	config.Argon2Time = 1
+	config.MinPasswordLength = 10
+	config.PasswordClasses = 3
+	config.PasswordHistory = 2
+	registry.Usecases.Registry.DeniedPasswords = map[string]bool{"password1": true}
+
+	// Every broken rule is listed
+	req, _ := http.NewRequest("POST", "/api/v1/user/account", strings.NewReader(`{"username":"policy","password":"Password1","roles":["TEST"]}`))
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr := httptest.NewRecorder()
+	restAPI := NewRestAPI(&registry)
+	http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotAcceptable || !strings.Contains(rr.Body.String(), "at least 10 characters") || !strings.Contains(rr.Body.String(), "too common") {
+		t.Errorf("Expected all violations - got %v %v", rr.Code, rr.Body.String())
+	}
+	if _, err := registry.Usecases.CreateUser(entities.User{Username: "policy", Password: "xxpolicyxx-X1", Roles: []string{"TEST"}}); err.Code != usecases.Invalid {
+		t.Errorf("Expected password containing the username to be refused")
+	}
+	if _, err := registry.Usecases.CreateUser(entities.User{Username: "policy", Password: "lowercaseonly", Roles: []string{"TEST"}}); err.Code != usecases.Invalid {
+		t.Errorf("Expected password with too few character classes to be refused")
+	}
+	if _, err := registry.Usecases.CreateUser(entities.User{Username: "policy", Roles: []string{"TEST"}}); err.Code != usecases.Invalid ||
+		len(err.Violations) != 1 || err.Violations[0].Field != "password" {
+		t.Errorf("Expected a user without a password to be refused - got %+v", err)
+	}
+	if _, err := registry.Usecases.CreateUser(entities.User{Username: "policy", Password: "Correct-Horse-1", Enabled: true, Roles: []string{"TEST"}}); err.Code != usecases.NoError {
+		t.Fatalf("Unexpected create error - %v", err.Error)
+	}
+
+	// Change password needs the current one and cannot go back to recent ones
+	if err := registry.Usecases.ChangePassword("policy", "wrong", "Battery-Staple-2"); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected wrong current password to be refused")
+	}
+	if err := registry.Usecases.ChangePassword("policy", "Correct-Horse-1", "Battery-Staple-2"); err.Code != usecases.NoError {
+		t.Fatalf("Unexpected change error - %v", err.Error)
+	}
+	if err := registry.Usecases.ChangePassword("policy", "Battery-Staple-2", "Correct-Horse-1"); err.Code != usecases.Invalid {
+		t.Errorf("Expected reuse of a recent password to be refused")
+	}
+	registry.Usecases.ChangePassword("policy", "Battery-Staple-2", "Third-Password-3")
+	registry.Usecases.ChangePassword("policy", "Third-Password-3", "Fourth-Password-4")
+	if err := registry.Usecases.ChangePassword("policy", "Fourth-Password-4", "Correct-Horse-1"); err.Code != usecases.NoError {
+		t.Errorf("Expected password older than the history to be allowed - got %v", err.Error)
+	}
+}
+
+func TestChangeAndResetPassword(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.Registry.Configuration.Argon2Memory = 64
+	registry.Usecases.Registry.Configuration.Argon2Time = 1
+	registry.Usecases.CreateUser(entities.User{Username: "forgetful", Password: "first", Enabled: true, Roles: []string{"TEST"}})
+	restAPI := NewRestAPI(&registry)
+	post := func(handler http.HandlerFunc, vars map[string]string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		req = mux.SetURLVars(req, vars)
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post(restAPI.HandleChangePassword, map[string]string{"name": "forgetful"}, `{"currentPassword":"wrong","newPassword":"second"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected change with the wrong password to be refused - got %v", rr.Code)
+	}
+	if rr := post(restAPI.HandleChangePassword, map[string]string{"name": "forgetful"}, `{"currentPassword":"first","newPassword":"second"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected change to succeed - got %v %v", rr.Code, rr.Body.String())
+	}
+
+	// Admin reset - token shown once, only the hash stored
+	rr := post(restAPI.HandleCreatePasswordReset, map[string]string{"name": "forgetful"}, "")
+	var reset usecases.PasswordReset
+	json.Unmarshal(rr.Body.Bytes(), &reset)
+	if rr.Code != http.StatusOK || len(reset.Token) == 0 {
+		t.Fatalf("Expected reset token - got %v %v", rr.Code, rr.Body.String())
+	}
+	if user, _ := registry.StorageInteractor.LookupUserByName("forgetful"); len(user.ResetTokenHash) == 0 || strings.Contains(user.ResetTokenHash, reset.Token) {
+		t.Errorf("Expected only a hash of the token to be stored")
+	}
+	if rr = post(restAPI.HandlePasswordReset, nil, fmt.Sprintf(`{"token":"%vx","password":"third"}`, reset.Token)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong token to be refused - got %v", rr.Code)
+	}
+	if rr = post(restAPI.HandlePasswordReset, nil, fmt.Sprintf(`{"token":"%v","password":"third"}`, reset.Token)); rr.Code != http.StatusOK {
+		t.Errorf("Expected reset to succeed - got %v %v", rr.Code, rr.Body.String())
+	}
+	if _, err := registry.Usecases.Authenticate("forgetful", "third"); err.Code != usecases.NoError {
+		t.Errorf("Expected new password to work after reset")
+	}
+	if rr = post(restAPI.HandlePasswordReset, nil, fmt.Sprintf(`{"token":"%v","password":"fourth"}`, reset.Token)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected token to be single use - got %v", rr.Code)
+	}
+
+	// Expired tokens are refused
+	reset, _ = registry.Usecases.CreatePasswordReset("forgetful")
+	user, _ := registry.StorageInteractor.LookupUserByName("forgetful")
+	user.ResetExpiresAt = time.Now().Add(-time.Minute)
+	registry.StorageInteractor.UpdateUser(user)
+	if err := registry.Usecases.ResetPassword(reset.Token, "fifth"); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected expired token to be refused")
+	}
+}
+
+// Keeps everything logged so a test can look through it
+type bufferLogger struct {
+	buffer *bytes.Buffer
+}
+
+func (logger bufferLogger) Log(level, message string) {
+	fmt.Fprintf(logger.buffer, "[%s] %s\n", level, message)
+}
+
+func TestResetTokenIsNotLogged(t *testing.T) {
+	logged := &bytes.Buffer{}
+	registry := createTestRegistry()
+	registry.Usecases.Registry.Logger = bufferLogger{logged}
+	config := &registry.Usecases.Registry.Configuration
+	config.Argon2Memory = 64
+	config.Argon2Time = 1
+	config.MinPasswordLength = 12
+	registry.Usecases.CreateUser(entities.User{Username: "forgetful", Password: "Correct-Horse-1", Enabled: true, Roles: []string{"TEST"}})
+	reset, _ := registry.Usecases.CreatePasswordReset("forgetful")
+
+	// Through the whole stack, request logging included
+	restAPI := NewRestAPI(&registry)
+	for _, handler := range restAPI.Negroni.Handlers() {
+		if requests, ok := handler.(*negroni.Logger); ok {
+			requests.ALogger = log.New(logged, "", 0)
+		}
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/user/password-reset", strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		restAPI.Negroni.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Refused by the policy - so the token is still good and must not be in the logs
+	if rr := post(fmt.Sprintf(`{"token":"%v","password":"short"}`, reset.Token)); rr.Code != http.StatusNotAcceptable {
+		t.Fatalf("Expected the password to be refused by the policy - got %v %v", rr.Code, rr.Body.String())
+	}
+	_, secret, _ := strings.Cut(reset.Token, ".")
+	if !strings.Contains(logged.String(), "password-reset") || strings.Contains(logged.String(), secret) {
+		t.Errorf("Expected the request to be logged without its token - got %v", logged.String())
+	}
+	if rr := post(fmt.Sprintf(`{"token":"%v","password":"Battery-Staple-2"}`, reset.Token)); rr.Code != http.StatusOK {
+		t.Errorf("Expected the token to work with an acceptable password - got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+// RFC 6238 code for a base32 secret at a time - as an authenticator app would show
+func totpCodeAt(secret string, at time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestTOTPEnrolmentAndLogin(t *testing.T) {
+	registry := createTestRegistry()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	registry.Usecases.Registry.Clock = func() time.Time { return now }
+	config := &registry.Usecases.Registry.Configuration
+	config.Argon2Memory = 64
+	config.Argon2Time = 1
+	config.MFAKey = "test-key"
+	registry.Usecases.CreateUser(entities.User{Username: "mfa", Password: "pwd", Enabled: true, Roles: []string{"TEST"}})
+
+	enrolment, err := registry.Usecases.EnrolTOTP("mfa")
+	if err.Code != usecases.NoError || !strings.HasPrefix(enrolment.ProvisioningURI, "otpauth://totp/") || len(enrolment.RecoveryCodes) != 10 {
+		t.Fatalf("Unexpected enrolment %+v %v", enrolment, err.Error)
+	}
+	stored, _ := registry.StorageInteractor.LookupUserByName("mfa")
+	if strings.Contains(stored.TOTPSecret, enrolment.Secret) || stored.RecoveryCodes[0] == enrolment.RecoveryCodes[0] {
+		t.Errorf("Expected secret encrypted and recovery codes hashed at rest")
+	}
+	// Not needed until confirmed
+	if _, err = registry.Usecases.Authenticate("mfa", "pwd"); err.Code != usecases.NoError {
+		t.Errorf("Expected login without code before confirmation")
+	}
+	if err = registry.Usecases.ConfirmTOTP("mfa", "000000"); err.Code != usecases.Invalid {
+		t.Errorf("Expected bad code to be refused")
+	}
+	if err = registry.Usecases.ConfirmTOTP("mfa", totpCodeAt(enrolment.Secret, now)); err.Code != usecases.NoError {
+		t.Fatalf("Unexpected confirmation error %v", err.Error)
+	}
+	// A confirmed second factor cannot be replaced (and so turned off) by enrolling again
+	if _, err = registry.Usecases.EnrolTOTP("mfa"); err.Code != usecases.AlreadyExists {
+		t.Errorf("Expected enrolment to be refused while TOTP is enabled - got %+v", err)
+	}
+
+	// Now the code is needed
+	if _, err = registry.Usecases.Authenticate("mfa", "pwd"); err.Code != usecases.NotAuthorized || len(err.Violations) == 0 {
+		t.Errorf("Expected code to be required - got %+v", err)
+	}
+	// The code used to confirm cannot be replayed
+	if _, err = registry.Usecases.AuthenticateWithCode("mfa", "pwd", totpCodeAt(enrolment.Secret, now)); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected replayed code to be refused")
+	}
+	now = now.Add(30 * time.Second)
+	if _, err = registry.Usecases.AuthenticateWithCode("mfa", "pwd", totpCodeAt(enrolment.Secret, now)); err.Code != usecases.NoError {
+		t.Errorf("Expected next code to work - got %v", err.Error)
+	}
+	// Too far out of step
+	now = now.Add(5 * time.Minute)
+	if _, err = registry.Usecases.AuthenticateWithCode("mfa", "pwd", totpCodeAt(enrolment.Secret, now.Add(-2*time.Minute))); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected stale code to be refused")
+	}
+
+	// Recovery codes work once
+	if _, err = registry.Usecases.AuthenticateWithCode("mfa", "pwd", enrolment.RecoveryCodes[3]); err.Code != usecases.NoError {
+		t.Errorf("Expected recovery code to work - got %v", err.Error)
+	}
+	if _, err = registry.Usecases.AuthenticateWithCode("mfa", "pwd", enrolment.RecoveryCodes[3]); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected recovery code to be single use")
+	}
+
+	// Via the api
+	restAPI := NewRestAPI(&registry)
+	req, _ := http.NewRequest("POST", "/api/v1/user/authenticate", strings.NewReader(`{"username":"mfa","password":"pwd"}`))
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(restAPI.HandleAuthenticate).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "one time code") {
+		t.Errorf("Expected api to say a code is needed - got %v %v", rr.Code, rr.Body.String())
+	}
+	now = now.Add(30 * time.Second)
+	req, _ = http.NewRequest("POST", "/api/v1/user/authenticate", strings.NewReader(fmt.Sprintf(`{"username":"mfa","password":"pwd","code":"%v"}`, totpCodeAt(enrolment.Secret, now))))
+	req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(restAPI.HandleAuthenticate).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected api login with code - got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestUserTimesAndExpiry(t *testing.T) {
+	registry := createTestRegistry()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	registry.Usecases.Registry.Clock = func() time.Time { return now }
+	config := &registry.Usecases.Registry.Configuration
+	config.Argon2Memory = 64
+	config.Argon2Time = 1
+	registry.Usecases.CreateUser(entities.User{Username: "timed", Password: "pwd", Enabled: true, Roles: []string{"TEST"}, ExpiresAt: now.Add(48 * time.Hour)})
+	registry.Usecases.CreateUser(entities.User{Username: "idle", Password: "pwd", Enabled: true, Roles: []string{"TEST"}})
+
+	user, _ := registry.Usecases.ReadUser("timed")
+	if !user.CreatedAt.Equal(now) || !user.UpdatedAt.Equal(now) || !user.LastLoginAt.IsZero() {
+		t.Errorf("Unexpected times after create %+v", user)
+	}
+
+	now = now.Add(time.Hour)
+	registry.Usecases.Authenticate("timed", "pwd")
+	// Clients cannot set the times kept by the server
+	user, _ = registry.Usecases.ReadUser("timed")
+	user.CreatedAt, user.LastLoginAt = time.Time{}, time.Time{}
+	now = now.Add(time.Hour)
+	registry.Usecases.UpdateUser(user)
+	user, _ = registry.Usecases.ReadUser("timed")
+	if !user.CreatedAt.Equal(now.Add(-2*time.Hour)) || !user.LastLoginAt.Equal(now.Add(-time.Hour)) || !user.UpdatedAt.Equal(now) {
+		t.Errorf("Unexpected times after login and update %+v", user)
+	}
+
+	// Only users not logged in since are listed
+	restAPI := NewRestAPI(&registry)
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"inactiveSince=2024-01-01T12:30:00Z", http.StatusOK, `["idle"]`},
+		{"inactiveSince=30m", http.StatusOK, `["idle","timed"]`},
+		{"inactiveSince=yesterday", http.StatusNotAcceptable, "inactiveSince"},
+	} {
+		req, _ := http.NewRequest("GET", "/api/v1/user/account?"+tc.query, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+		if rr.Code != tc.code || !strings.Contains(rr.Body.String(), tc.expected) {
+			t.Errorf("%v : expected %v %v got %v %v", tc.query, tc.code, tc.expected, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Past expiry the user cannot log in, and the sweep disables it
+	now = now.Add(48 * time.Hour)
+	if _, err := registry.Usecases.Authenticate("timed", "pwd"); err.Code != usecases.NotAuthorized {
+		t.Errorf("Expected expired user to be refused")
+	}
+	if disabled, _ := registry.Usecases.DisableExpiredUsers(); disabled != 1 {
+		t.Errorf("Expected one user disabled - got %v", disabled)
+	}
+	if user, _ = registry.Usecases.ReadUser("timed"); user.Enabled {
+		t.Errorf("Expected expired user to be disabled")
+	}
+	if user, _ = registry.Usecases.ReadUser("idle"); !user.Enabled {
+		t.Errorf("Expected user without expiry to stay enabled")
+	}
+}
+
+func TestUpdateAndDeleteHonourIfMatch(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.CreateUser(entities.User{Username: "shared", Password: "Correct-Horse-1", Roles: []string{"TEST"}})
+	restAPI := NewRestAPI(&registry)
+
+	send := func(method, body, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/api/v1/user/account/shared", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"name": "shared"})
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleSpecificUser).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("GET", "", "")
+	etag := rr.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("Expected ETag of the first version - got %v", etag)
+	}
+	// The first admin's change moves the version on
+	if rr = send("PUT", `{"username":"shared","enabled":true,"roles":["TEST"]}`, etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"2"` {
+		t.Errorf("Expected update to succeed with the next ETag - got %v %v", rr.Code, rr.Header().Get("ETag"))
+	}
+	// ... so the second admin's, made from the same read, is refused
+	if rr = send("PUT", `{"username":"shared","enabled":false,"roles":["TEST"]}`, etag); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale update to be refused - got %v", rr.Code)
+	}
+	if user, _ := registry.Usecases.ReadUser("shared"); !user.Enabled {
+		t.Errorf("Expected first update to be kept")
+	}
+	if rr = send("DELETE", "", etag); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale delete to be refused - got %v", rr.Code)
+	}
+	if rr = send("DELETE", "", "not-an-etag"); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected unknown ETag to be refused - got %v", rr.Code)
+	}
+	// Without If-Match changes are made to whatever is current
+	if rr = send("PUT", `{"username":"shared","enabled":true,"roles":["TEST"],"version":1}`, ""); rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"3"` {
+		t.Errorf("Expected unconditional update - got %v %v", rr.Code, rr.Header().Get("ETag"))
+	}
+	if rr = send("DELETE", "", `"3"`); rr.Code != http.StatusOK {
+		t.Errorf("Expected delete at the current version - got %v", rr.Code)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.CreateRole(entities.Role{Name: "EXTRA"})
+	registry.Usecases.CreateUser(entities.User{Username: "patchy", Password: "Correct-Horse-1", Enabled: true, Roles: []string{"TEST"}, Claims: map[string]string{"email": "old@example.com"}})
+	restAPI := NewRestAPI(&registry)
+
+	send := func(contentType, patch, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", "/api/v1/user/account/patchy", strings.NewReader(patch))
+		req = mux.SetURLVars(req, map[string]string{"name": "patchy"})
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		req.Header.Set("Content-Type", contentType)
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleSpecificUser).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Merge patch can turn enabled off and drop a claim, leaving everything else alone
+	rr := send(usecases.MergePatch, `{"enabled":false,"claims":{"email":null,"tenant":"acme"}}`, "")
+	user, _ := registry.Usecases.ReadUser("patchy")
+	if rr.Code != http.StatusOK || user.Enabled || len(user.Roles) != 1 || user.Claims["tenant"] != "acme" || len(user.Claims["email"]) > 0 {
+		t.Errorf("Unexpected merge patch result %v %+v", rr.Code, user)
+	}
+
+	// JSON patch adds a role - guarded by a test
+	rr = send(usecases.JSONPatch+"; charset=utf-8", `[{"op":"test","path":"/enabled","value":false},{"op":"add","path":"/roles/-","value":"EXTRA"}]`, rr.Header().Get("ETag"))
+	user, _ = registry.Usecases.ReadUser("patchy")
+	if rr.Code != http.StatusOK || len(user.Roles) != 2 || user.Roles[1] != "EXTRA" || rr.Header().Get("ETag") != `"3"` {
+		t.Errorf("Unexpected json patch result %v %+v", rr.Code, user)
+	}
+
+	// Nothing is applied when a test fails or any operation is bad
+	for _, tc := range []struct {
+		contentType string
+		patch       string
+		ifMatch     string
+		code        int
+	}{
+		{usecases.JSONPatch, `[{"op":"remove","path":"/roles/1"},{"op":"test","path":"/enabled","value":true}]`, "", http.StatusNotAcceptable},
+		{usecases.JSONPatch, `[{"op":"remove","path":"/roles/1"},{"op":"remove","path":"/nothing"}]`, "", http.StatusNotAcceptable},
+		{usecases.JSONPatch, `[{"op":"add","path":"/roles/-","value":"UNKNOWN"}]`, "", http.StatusNotAcceptable},
+		{usecases.MergePatch, `{"username":"someoneelse"}`, "", http.StatusNotAcceptable},
+		{"application/json", `{"enabled":true}`, "", http.StatusNotAcceptable},
+		{usecases.MergePatch, `{"enabled":true}`, `"1"`, http.StatusPreconditionFailed},
+	} {
+		if rr = send(tc.contentType, tc.patch, tc.ifMatch); rr.Code != tc.code {
+			t.Errorf("%v : expected %v got %v %v", tc.patch, tc.code, rr.Code, rr.Body.String())
+		}
+	}
+	if user, _ = registry.Usecases.ReadUser("patchy"); len(user.Roles) != 2 || user.Enabled || user.Version != 3 {
+		t.Errorf("Expected refused patches to change nothing - got %+v", user)
+	}
+
+	// The stored hash cannot be tested for, but a patch can still set a new password
+	stored, _ := registry.Usecases.Registry.StorageInteractor.LookupUserByName("patchy")
+	if rr = send(usecases.JSONPatch, fmt.Sprintf(`[{"op":"test","path":"/password","value":%q}]`, stored.Password), ""); rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected a test against the password hash to fail - got %v", rr.Code)
+	}
+	if rr = send(usecases.MergePatch, `{"enabled":true}`, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected a patch without a password to be applied - got %v %v", rr.Code, rr.Body.String())
+	}
+	if ok, _ := registry.Usecases.VerifyPassword("patchy", "Correct-Horse-1"); !ok {
+		t.Errorf("Expected the password to survive a patch which does not set one")
+	}
+	if rr = send(usecases.JSONPatch, `[{"op":"add","path":"/password","value":"Battery-Staple-2"}]`, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected a patch to set a new password - got %v %v", rr.Code, rr.Body.String())
+	}
+	if ok, _ := registry.Usecases.VerifyPassword("patchy", "Battery-Staple-2"); !ok {
+		t.Errorf("Expected the patched password to be the user's password")
+	}
+}
+
+func TestPutMustMatchPathAndRename(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.CreateUser(entities.User{Username: "alice", Password: "Correct-Horse-1", Roles: []string{"TEST"}, Claims: map[string]string{"email": "alice@example.com"}})
+	registry.Usecases.CreateUser(entities.User{Username: "bob", Password: "Correct-Horse-1", Roles: []string{"TEST"}})
+	restAPI := NewRestAPI(&registry)
+
+	send := func(handler http.HandlerFunc, method, name, body, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/api/v1/user/account/"+name, strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"name": name})
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		if len(ifMatch) > 0 {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A PUT to alice cannot change bob
+	if rr := send(restAPI.HandleSpecificUser, "PUT", "alice", `{"username":"bob","enabled":true,"roles":["TEST"]}`, ""); rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected mismatched username to be refused - got %v", rr.Code)
+	}
+	if user, _ := registry.Usecases.ReadUser("bob"); user.Enabled {
+		t.Errorf("Expected bob to be untouched")
+	}
+	// ... and the body need not repeat the name
+	if rr := send(restAPI.HandleSpecificUser, "PUT", "alice", `{"enabled":true,"roles":["TEST"],"claims":{"email":"alice@example.com"}}`, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected update by path to work - got %v %v", rr.Code, rr.Body.String())
+	}
+
+	rename := http.HandlerFunc(restAPI.HandleRenameUser)
+	for _, tc := range []struct {
+		body    string
+		ifMatch string
+		code    int
+	}{
+		{`{"username":"bob"}`, "", http.StatusConflict},
+		{`{"username":""}`, "", http.StatusNotAcceptable},
+		{`{"username":"alicia"}`, `"1"`, http.StatusPreconditionFailed},
+		{`{"username":"alicia"}`, `"2"`, http.StatusOK},
+	} {
+		if rr := send(rename, "POST", "alice", tc.body, tc.ifMatch); rr.Code != tc.code {
+			t.Errorf("%v : expected %v got %v %v", tc.body, tc.code, rr.Code, rr.Body.String())
+		}
+	}
+	if _, err := registry.Usecases.ReadUser("alice"); err.Code != usecases.Unknown {
+		t.Errorf("Expected old name to be gone")
+	}
+	if user, _ := registry.Usecases.ReadUser("alicia"); user.Claims["email"] != "alice@example.com" || !user.Enabled || user.Version != 3 {
+		t.Errorf("Expected everything to move with the rename - got %+v", user)
+	}
+}
+
+func TestListUsersPaging(t *testing.T) {
+	registry := createTestRegistry()
+	for _, name := range []string{"u1", "u2", "u3", "u4", "u5", "other"} {
+		registry.Usecases.CreateUser(entities.User{Username: name, Password: "Correct-Horse-1", Roles: []string{"TEST"}})
+	}
+	restAPI := NewRestAPI(&registry)
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/v1/user/account?"+query, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Offset paging
+	rr := list("search=u&page=2&pageSize=2")
+	if rr.Body.String() != `["u3","u4"]` || rr.Header().Get("X-Total-Count") != "5" {
+		t.Errorf("Unexpected offset page %v total %v", rr.Body.String(), rr.Header().Get("X-Total-Count"))
+	}
+	links := rr.Header().Get("Link")
+	for _, expected := range []string{`page=1&pageSize=2&search=u>; rel="first"`, `page=1&pageSize=2&search=u>; rel="prev"`, `page=3&pageSize=2&search=u>; rel="next"`, `page=3&pageSize=2&search=u>; rel="last"`} {
+		if !strings.Contains(links, expected) {
+			t.Errorf("Expected %v within Link %v", expected, links)
+		}
+	}
+
+	// Cursor paging follows the next links to the end
+	pages := make([]string, 0)
+	query := "pageSize=4"
+	for i := 0; i < 5 && len(query) > 0; i++ {
+		rr = list(query)
+		pages = append(pages, rr.Body.String())
+		query = ""
+		for _, link := range strings.Split(rr.Header().Get("Link"), ", ") {
+			if strings.HasSuffix(link, `rel="next"`) {
+				query = link[strings.Index(link, "?")+1 : strings.Index(link, ">")]
+			}
+		}
+	}
+	if strings.Join(pages, "") != `["other","u1","u2","u3"]["u4","u5"]` {
+		t.Errorf("Unexpected cursor pages %v", pages)
+	}
+
+	if rr = list("pageSize=2&after=!!!"); rr.Code != http.StatusNotAcceptable {
+		t.Errorf("Expected bad cursor to be refused - got %v", rr.Code)
+	}
+}
+
+func TestListUsersByQuery(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.CreateRole(entities.Role{Name: "LIGHTAUTH_DELETE"})
+	registry.Usecases.CreateRole(entities.Role{Name: "LIGHTAUTH_ADMIN", Includes: []string{"LIGHTAUTH_DELETE"}})
+	registry.Usecases.CreateUser(entities.User{Username: "svc-build", Password: "Correct-Horse-1", Enabled: true, Roles: []string{"LIGHTAUTH_ADMIN"}, Claims: map[string]string{"tenant": "acme"}})
+	registry.Usecases.CreateUser(entities.User{Username: "svc-deploy", Password: "Correct-Horse-1", Enabled: false, Roles: []string{"LIGHTAUTH_DELETE"}, Claims: map[string]string{"tenant": "acme"}})
+	registry.Usecases.CreateUser(entities.User{Username: "svc-old", Password: "Correct-Horse-1", Enabled: false, Roles: []string{"TEST"}, Claims: map[string]string{"tenant": "acme"}})
+	registry.Usecases.CreateUser(entities.User{Username: "alice", Password: "Correct-Horse-1", Enabled: true, Roles: []string{"LIGHTAUTH_DELETE"}})
+	restAPI := NewRestAPI(&registry)
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/v1/user/account?"+query, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+		return rr
+	}
+
+	for query, expected := range map[string]string{
+		"role=LIGHTAUTH_DELETE":                                 `["alice","svc-build","svc-deploy"]`,
+		"role=LIGHTAUTH_DELETE&enabled=false&claim.tenant=acme": `["svc-deploy"]`,
+		"prefix=svc-&sort=-username":                            `["svc-old","svc-deploy","svc-build"]`,
+		"role=LIGHTAUTH_ADMIN&role=LIGHTAUTH_DELETE":            `["svc-build"]`,
+		"role=NOBODY": `[]`,
+	} {
+		if rr := list(query); rr.Body.String() != expected {
+			t.Errorf("Expected %v for %v - got %v", expected, query, rr.Body.String())
+		}
+	}
+
+	// Cursors keep to the sort order
+	rr := list("prefix=svc-&sort=-username&pageSize=2")
+	if rr.Body.String() != `["svc-old","svc-deploy"]` || rr.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("Unexpected first page %v total %v", rr.Body.String(), rr.Header().Get("X-Total-Count"))
+	}
+	next := ""
+	for _, link := range strings.Split(rr.Header().Get("Link"), ", ") {
+		if strings.HasSuffix(link, `rel="next"`) {
+			next = link[strings.Index(link, "?")+1 : strings.Index(link, ">")]
+		}
+	}
+	if rr = list(next); rr.Body.String() != `["svc-build"]` {
+		t.Errorf("Unexpected next page %v from %v", rr.Body.String(), next)
+	}
+
+	for _, query := range []string{"enabled=maybe", "sort=password"} {
+		if rr = list(query); rr.Code != http.StatusNotAcceptable {
+			t.Errorf("Expected %v to be refused - got %v", query, rr.Code)
+		}
+	}
+}
+
+func TestListUserViews(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.CreateUser(entities.User{Username: "ann", Password: "Correct-Horse-1", Enabled: true, Roles: []string{"TEST"}, Claims: map[string]string{"tenant": "acme"}})
+	registry.Usecases.CreateUser(entities.User{Username: "bob", Password: "Battery-Staple-2", Enabled: false})
+	restAPI := NewRestAPI(&registry)
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/v1/user/account?"+query, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(restAPI.HandleGenericUser).ServeHTTP(rr, req)
+		return rr
+	}
+	views := func(query string) []map[string]interface{} {
+		rr := list(query)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %v for %v", rr.Code, query)
+		}
+		result := make([]map[string]interface{}, 0)
+		json.Unmarshal(rr.Body.Bytes(), &result)
+		return result
+	}
+
+	if rr := list("view=names"); rr.Body.String() != `["ann","bob"]` {
+		t.Errorf("Expected names - got %v", rr.Body.String())
+	}
+
+	summary := views("view=summary&enabled=true")
+	if len(summary) != 1 || summary[0]["username"] != "ann" || summary[0]["enabled"] != true || summary[0]["roles"] == nil || summary[0]["claims"] != nil {
+		t.Errorf("Unexpected summary %v", summary)
+	}
+
+	full := views("view=full&sort=-username")
+	if len(full) != 2 || full[0]["username"] != "bob" || full[1]["claims"] == nil || full[1]["version"] == nil {
+		t.Errorf("Unexpected full view %v", full)
+	}
+	for _, user := range full {
+		if _, ok := user["password"]; ok {
+			t.Errorf("Password should never be listed - %v", user)
+		}
+	}
+
+	projected := views("fields=username,roles&pageSize=1")
+	if len(projected) != 1 || len(projected[0]) != 2 || projected[0]["username"] != "ann" {
+		t.Errorf("Unexpected projection %v", projected)
+	}
+
+	for _, query := range []string{"view=everything", "fields=password", "fields=username,nonsense", "view=names&fields=roles"} {
+		if rr := list(query); rr.Code != http.StatusNotAcceptable {
+			t.Errorf("Expected %v to be refused - got %v", query, rr.Code)
+		}
+	}
+}
+
+func TestErrorsAreProblemDetails(t *testing.T) {
+	registry := createTestRegistry()
+	restAPI := NewRestAPI(&registry)
+
+	send := func(method, path, body, requestID string) (*httptest.ResponseRecorder, Problem) {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", "secret"))
+		if len(requestID) > 0 {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		rr := httptest.NewRecorder()
+		restAPI.Negroni.ServeHTTP(rr, req)
+		problem := Problem{}
+		json.Unmarshal(rr.Body.Bytes(), &problem)
+		return rr, problem
+	}
+
+	rr, problem := send("GET", "/api/v1/user/account/nobody", "", "trace-123")
+	if rr.Code != http.StatusNotFound || rr.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("Expected a not found problem - got %v %v", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if problem.Type != "urn:lightauth:problem:not-found" || problem.Status != http.StatusNotFound || problem.Title != "Not Found" ||
+		len(problem.Detail) == 0 || problem.Instance != "/api/v1/user/account/nobody" || problem.RequestID != "trace-123" {
+		t.Errorf("Unexpected problem %+v", problem)
+	}
+	if rr.Header().Get("X-Request-ID") != "trace-123" {
+		t.Errorf("Expected the caller's request id back - got %v", rr.Header().Get("X-Request-ID"))
+	}
+
+	// Violations are listed by field and ids are made when not given
+	rr, problem = send("PUT", "/api/v1/user/account/someone", `{"username":"other"}`, "")
+	if problem.Type != "urn:lightauth:problem:invalid-request" || len(problem.Violations) != 1 || problem.Violations[0].Field != "username" {
+		t.Errorf("Unexpected problem %+v", problem)
+	}
+	if len(problem.RequestID) == 0 || problem.RequestID != rr.Header().Get("X-Request-ID") {
+		t.Errorf("Expected a request id to be made - got %v and %v", problem.RequestID, rr.Header().Get("X-Request-ID"))
+	}
+
+	// Every route reports the same way
+	for path, expected := range map[string]string{
+		"/api/v1/user/roles":            "urn:lightauth:problem:not-authorized",
+		"/api/v1/user/roles/NOPE":       "urn:lightauth:problem:not-authorized",
+		"/api/v1/user/no-such-resource": "urn:lightauth:problem:not-found",
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		restAPI.Negroni.ServeHTTP(rr, req)
+		json.Unmarshal(rr.Body.Bytes(), &problem)
+		if problem.Type != expected {
+			t.Errorf("Expected %v from %v - got %v", expected, path, rr.Body.String())
+		}
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	registry := createTestRegistry()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	registry.Usecases.Registry.Clock = func() time.Time { return now }
+	registry.Usecases.Registry.APIKeyStore = test.NewInMemoryAPIKeyStore()
+	restAPI := NewRestAPI(&registry)
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", key))
+		rr := httptest.NewRecorder()
+		restAPI.Negroni.ServeHTTP(rr, req)
+		return rr
+	}
+	mint := func(key, body string) (*httptest.ResponseRecorder, usecases.MintedAPIKey) {
+		rr := send(key, "POST", "/api/v1/user/keys", body)
+		minted := usecases.MintedAPIKey{}
+		json.Unmarshal(rr.Body.Bytes(), &minted)
+		return rr, minted
+	}
+
+	rr, reader := mint("secret", `{"name":"reader","scopes":["users:read"],"expiresIn":"1h"}`)
+	if rr.Code != http.StatusOK || !strings.HasPrefix(reader.Key, "la_"+reader.ID+".") || reader.CreatedBy != "shared key" {
+		t.Fatalf("Expected a key to be minted - got %v %v", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "hash") {
+		t.Errorf("The hash should never be shown - got %v", rr.Body.String())
+	}
+
+	// A key can do what its scopes allow and nothing more
+	if rr = send(reader.Key, "GET", "/api/v1/user/account", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected a reader to list users - got %v %v", rr.Code, rr.Body.String())
+	}
+	rr = send(reader.Key, "POST", "/api/v1/user/account", `{"username":"someone","password":"Correct-Horse-1"}`)
+	problem := Problem{}
+	json.Unmarshal(rr.Body.Bytes(), &problem)
+	if rr.Code != http.StatusForbidden || problem.Type != "urn:lightauth:problem:forbidden" {
+		t.Errorf("Expected a reader to be forbidden to write - got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr = send(reader.Key, "GET", "/api/v1/user/keys", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a reader to be forbidden keys - got %v", rr.Code)
+	}
+
+	// Keys cannot hand out more than they hold
+	_, admin := mint("secret", `{"name":"admin","scopes":["keys:admin","users:read"]}`)
+	if rr, _ = mint(admin.Key, `{"name":"writer","scopes":["users:write"]}`); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected escalation to be forbidden - got %v %v", rr.Code, rr.Body.String())
+	}
+	rr, _ = mint(admin.Key, `{"name":"bad","scopes":["everything"]}`)
+	json.Unmarshal(rr.Body.Bytes(), &problem)
+	if problem.Type != "urn:lightauth:problem:invalid-request" || len(problem.Violations) != 1 {
+		t.Errorf("Expected an unknown scope to be refused - got %v %v", rr.Code, rr.Body.String())
+	}
+	rr = send(admin.Key, "GET", "/api/v1/user/keys", "")
+	keys := make([]entities.APIKey, 0)
+	json.Unmarshal(rr.Body.Bytes(), &keys)
+	if len(keys) != 2 || strings.Contains(rr.Body.String(), "la_") {
+		t.Errorf("Expected two keys without secrets - got %v", rr.Body.String())
+	}
+
+	// Expired and revoked keys stop working
+	now = now.Add(2 * time.Hour)
+	if rr = send(reader.Key, "GET", "/api/v1/user/account", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired key to be refused - got %v", rr.Code)
+	}
+	if rr = send(admin.Key, "DELETE", "/api/v1/user/keys/"+admin.ID, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the key to be revoked - got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr = send(admin.Key, "GET", "/api/v1/user/account", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to be refused - got %v", rr.Code)
+	}
+}
+
+func TestJWTCallersGetScopesFromRoles(t *testing.T) {
+	registry := createTestRegistry()
+	registry.Usecases.Registry.Configuration.JWTSecrets = []string{"an-hs256-secret-of-some-length!!"}
+	authenticator, err := frameworks.NewJWTAuthenticator(registry.Usecases.Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.Usecases.Registry.Authenticators = []usecases.TokenAuthenticator{authenticator}
+	storage := registry.Usecases.Registry.StorageInteractor
+	storage.CreateRole(entities.Role{Name: "AUDIT", Permissions: []string{"users:read", "reports"}})
+	storage.CreateRole(entities.Role{Name: "ADMIN", Permissions: []string{"users:write"}, Includes: []string{"AUDIT"}})
+	restAPI := NewRestAPI(&registry)
+
+	token := func(roles ...string) string {
+		claims := jwt.MapClaims{"sub": "fred", "exp": time.Now().Add(time.Hour).Unix(), "roles": roles}
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("an-hs256-secret-of-some-length!!"))
+		return signed
+	}
+	send := func(bearer, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", fmt.Sprintf("bearer %v", bearer))
+		rr := httptest.NewRecorder()
+		restAPI.Negroni.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Permissions of included roles count too
+	admin := token("ADMIN")
+	if rr := send(admin, "POST", "/api/v1/user/account", `{"username":"someone","password":"Correct-Horse-1"}`); rr.Code != http.StatusOK {
+		t.Errorf("Expected an admin token to create users - got %v %v", rr.Code, rr.Body.String())
+	}
+	if rr := send(admin, "GET", "/api/v1/user/account/someone", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected an admin token to read users - got %v %v", rr.Code, rr.Body.String())
+	}
+
+	auditor := token("AUDIT", "UNKNOWN")
+	if rr := send(auditor, "GET", "/api/v1/user/account", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected an audit token to list users - got %v", rr.Code)
+	}
+	if rr := send(auditor, "DELETE", "/api/v1/user/account/someone", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected an audit token to be forbidden to delete - got %v", rr.Code)
+	}
+	if rr := send(auditor, "GET", "/api/v1/user/roles", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected an audit token to be forbidden roles - got %v", rr.Code)
+	}
+
+	// Tampered tokens are not authorized at all, and api keys still work alongside
+	if rr := send(admin[:len(admin)-2]+"xx", "GET", "/api/v1/user/account", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a tampered token to be refused - got %v", rr.Code)
+	}
+	if rr := send("secret", "GET", "/api/v1/user/roles", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the shared key to still work - got %v", rr.Code)
+	}
+}
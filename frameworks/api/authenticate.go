@@ -0,0 +1,35 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// What is posted to check a password
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Code     string `json:"code,omitempty"` // TOTP or recovery code for users with a second factor
+}
+
+// HandleAuthenticate - checks a username and password, returning the user's roles and
+// claims (never the password) if they are good
+func (r *RestAPI) HandleAuthenticate(response http.ResponseWriter, request *http.Request) {
+	var user entities.User
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		var c credentials
+		if derr := json.NewDecoder(request.Body).Decode(&c); derr == nil {
+			user, err = r.Registry.Usecases.AuthenticateWithCode(c.Username, c.Password, c.Code)
+		} else {
+			err = usecases.NewError(usecases.Invalid, derr)
+		}
+		defer request.Body.Close()
+	}
+	r.respond(response, request, err, user)
+}
@@ -1,6 +1,9 @@
 package api
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
 	"os"
 )
@@ -35,11 +38,51 @@ func (r *RestAPI) AddCoorsHeader(rw http.ResponseWriter, request *http.Request,
 	//rw.Header().Add("Access-Control-Allow-Origin", request.Header.Get("Origin"))
 	rw.Header().Add("Access-Control-Allow-Credentials", "true")
 	rw.Header().Add("Access-Control-Allow-Origin", "*")
-	rw.Header().Add("Access-Control-Allow-Methods", "POST, PUT, GET, OPTIONS, DELETE")
+	rw.Header().Add("Access-Control-Allow-Methods", "POST, PUT, PATCH, GET, OPTIONS, DELETE")
 	rw.Header().Add("Access-Control-Max-Age", "3600")
-	rw.Header().Add("Access-Control-Allow-Headers", "Content-Type, Accept, X-Requested-With, remember-me, authorization, Authorization")
+	rw.Header().Add("Access-Control-Allow-Headers", "Content-Type, Accept, X-Requested-With, remember-me, authorization, Authorization, If-Match, X-Request-ID")
+	rw.Header().Add("Access-Control-Expose-Headers", "ETag, Link, X-Total-Count, X-Request-ID")
 
 	if next != nil {
 		next(rw, request)
 	}
 }
+
+// Longest X-Request-ID taken from a caller
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// AddRequestID - gives every request an id, returned in the X-Request-ID header and within
+// any problem reported, so a failure can be found in the log. An id sent by the caller (or a
+// proxy in front) is kept if it is printable and not too long.
+func (r *RestAPI) AddRequestID(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	id := req.Header.Get("X-Request-ID")
+	if !validRequestID(id) {
+		random := make([]byte, 16)
+		rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	rw.Header().Set("X-Request-ID", id)
+	if next != nil {
+		next(rw, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	}
+}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// The id AddRequestID gave the request - empty if it has not been through it
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// What is posted to mint a key - expiresIn (EG 720h) is an alternative to expiresAt
+type keyRequest struct {
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	ExpiresIn string    `json:"expiresIn"`
+}
+
+// HandleKeys - lists api keys (GET) or mints one (POST), returning the key this once
+func (r *RestAPI) HandleKeys(response http.ResponseWriter, request *http.Request) {
+	var result interface{}
+
+	creator, err := r.caller(request)
+
+	if err.Code == usecases.NoError {
+		switch request.Method {
+		case http.MethodGet:
+			result, err = r.Registry.Usecases.ListAPIKeys()
+		case http.MethodPost:
+			var mint keyRequest
+			var lifetime time.Duration
+			if derr := json.NewDecoder(request.Body).Decode(&mint); derr != nil {
+				err = usecases.NewError(usecases.Invalid, derr)
+			} else if len(mint.ExpiresIn) > 0 {
+				var perr error
+				if lifetime, perr = time.ParseDuration(mint.ExpiresIn); perr != nil || lifetime <= 0 {
+					err = usecases.NewValidationError([]usecases.Violation{{Field: "expiresIn", Message: "expiresIn should be a duration such as 720h"}})
+				}
+			}
+			if err.Code == usecases.NoError {
+				result, err = r.Registry.Usecases.CreateAPIKey(mint.Name, mint.Scopes, mint.ExpiresAt, lifetime, creator)
+			}
+			defer request.Body.Close()
+		default:
+			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
+		}
+	}
+	r.respond(response, request, err, result)
+}
+
+// HandleSpecificKey - reads (GET) or revokes (DELETE) an api key
+func (r *RestAPI) HandleSpecificKey(response http.ResponseWriter, request *http.Request) {
+	id := mux.Vars(request)["id"]
+	var result interface{}
+
+	revoker, err := r.caller(request)
+
+	if err.Code == usecases.NoError {
+		switch request.Method {
+		case http.MethodGet:
+			result, err = r.Registry.Usecases.ReadAPIKey(id)
+		case http.MethodDelete:
+			err = r.Registry.Usecases.RevokeAPIKey(id, revoker)
+			result = statusResponse{"revoked"}
+		default:
+			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
+		}
+	}
+	r.respond(response, request, err, result)
+}
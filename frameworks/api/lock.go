@@ -0,0 +1,31 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// HandleLock - shows (GET) or clears (DELETE) a user's failed login lockout
+func (r *RestAPI) HandleLock(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+	var status usecases.LockStatus
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		switch request.Method {
+		case http.MethodGet:
+			status, err = r.Registry.Usecases.ReadLock(username)
+		case http.MethodDelete:
+			if err = r.Registry.Usecases.Unlock(username); err.Code == usecases.NoError {
+				status, err = r.Registry.Usecases.ReadLock(username)
+			}
+		default:
+			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
+		}
+	}
+	r.respond(response, request, err, status)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// What is posted to confirm a totp enrolment
+type totpConfirmation struct {
+	Code string `json:"code"`
+}
+
+// HandleMFA - starts TOTP enrolment (POST) returning the secret, provisioning uri and
+// recovery codes this once, or removes the second factor (DELETE)
+func (r *RestAPI) HandleMFA(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+	var result interface{}
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		switch request.Method {
+		case http.MethodPost:
+			var enrolment usecases.TOTPEnrolment
+			enrolment, err = r.Registry.Usecases.EnrolTOTP(username)
+			result = enrolment
+		case http.MethodDelete:
+			err = r.Registry.Usecases.DisableTOTP(username)
+			result = statusResponse{"disabled"}
+		default:
+			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
+		}
+	}
+	r.respond(response, request, err, result)
+}
+
+// HandleConfirmMFA - completes TOTP enrolment with a code from the authenticator
+func (r *RestAPI) HandleConfirmMFA(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		var confirmation totpConfirmation
+		if derr := json.NewDecoder(request.Body).Decode(&confirmation); derr == nil {
+			err = r.Registry.Usecases.ConfirmTOTP(username, confirmation.Code)
+		} else {
+			err = usecases.NewError(usecases.Invalid, derr)
+		}
+		defer request.Body.Close()
+	}
+	r.respond(response, request, err, statusResponse{"enabled"})
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// What is posted to change a password
+type passwordChange struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// What is posted to complete a reset - the token is in the body, never the url, so it is
+// not written to the request logs
+type passwordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// HandleChangePassword - sets a user's password given their current one
+func (r *RestAPI) HandleChangePassword(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		var change passwordChange
+		if derr := json.NewDecoder(request.Body).Decode(&change); derr == nil {
+			err = r.Registry.Usecases.ChangePassword(username, change.CurrentPassword, change.NewPassword)
+		} else {
+			err = usecases.NewError(usecases.Invalid, derr)
+		}
+		defer request.Body.Close()
+	}
+	r.respond(response, request, err, statusResponse{"changed"})
+}
+
+// HandleCreatePasswordReset - admin creates a reset token for a user. The token is
+// returned this once (for mailing to the user) and only its hash is kept.
+func (r *RestAPI) HandleCreatePasswordReset(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+	var reset usecases.PasswordReset
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		reset, err = r.Registry.Usecases.CreatePasswordReset(username)
+	}
+	r.respond(response, request, err, reset)
+}
+
+// HandlePasswordReset - sets a new password using a reset token
+func (r *RestAPI) HandlePasswordReset(response http.ResponseWriter, request *http.Request) {
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		var reset passwordResetRequest
+		if derr := json.NewDecoder(request.Body).Decode(&reset); derr == nil {
+			err = r.Registry.Usecases.ResetPassword(reset.Token, reset.Password)
+		} else {
+			err = usecases.NewError(usecases.Invalid, derr)
+		}
+		defer request.Body.Close()
+	}
+	r.respond(response, request, err, statusResponse{"reset"})
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// Problem is an RFC 7807 problem details body - every error the api gives is one
+type Problem struct {
+	Type       string               `json:"type"`
+	Title      string               `json:"title"`
+	Status     int                  `json:"status"`
+	Detail     string               `json:"detail,omitempty"`
+	Instance   string               `json:"instance,omitempty"`   // Path of the request which failed
+	RequestID  string               `json:"requestId,omitempty"`  // As given in the X-Request-ID header
+	Violations []usecases.Violation `json:"violations,omitempty"` // Each field which was not valid and why
+}
+
+// The kind of problem each usecases error code is. The types are stable - clients may
+// rely on them - so never change one, only add.
+type problemType struct {
+	Type   string
+	Title  string
+	Status int
+}
+
+const problemTypePrefix = "urn:lightauth:problem:"
+
+var problemTypes = map[int]problemType{
+	usecases.AlreadyExists:  {problemTypePrefix + "already-exists", "Already Exists", http.StatusConflict},
+	usecases.NotImplemented: {problemTypePrefix + "not-implemented", "Not Implemented", http.StatusNotImplemented},
+	usecases.Unknown:        {problemTypePrefix + "not-found", "Not Found", http.StatusNotFound},
+	usecases.Invalid:        {problemTypePrefix + "invalid-request", "Invalid Request", http.StatusNotAcceptable},
+	usecases.NotAuthorized:  {problemTypePrefix + "not-authorized", "Not Authorized", http.StatusUnauthorized},
+	usecases.InternalError:  {problemTypePrefix + "internal-error", "Internal Error", http.StatusInternalServerError},
+	usecases.InUse:          {problemTypePrefix + "in-use", "In Use", http.StatusConflict},
+	usecases.VersionChanged: {problemTypePrefix + "version-changed", "Precondition Failed", http.StatusPreconditionFailed},
+	usecases.Forbidden:      {problemTypePrefix + "forbidden", "Forbidden", http.StatusForbidden},
+}
+
+// Codes without a type of their own
+var badRequestProblem = problemType{problemTypePrefix + "bad-request", "Bad Request", http.StatusBadRequest}
+
+// newProblem describes an error. Internal errors may carry details of the server's
+// workings so their detail only points at the log.
+func newProblem(err usecases.LightAuthError, request *http.Request) Problem {
+	kind, ok := problemTypes[err.Code]
+	if !ok {
+		kind = badRequestProblem
+	}
+	problem := Problem{Type: kind.Type, Title: kind.Title, Status: kind.Status, Instance: request.URL.Path,
+		RequestID: requestID(request), Violations: err.Violations}
+	if err.Code == usecases.InternalError {
+		problem.Detail = "The server could not complete the request - see its log"
+	} else if err.Error != nil {
+		problem.Detail = err.Error.Error()
+	}
+	return problem
+}
+
+// HandleNotFound - reports paths which are not part of the api
+func (r *RestAPI) HandleNotFound(response http.ResponseWriter, request *http.Request) {
+	r.respond(response, request, usecases.NewError(usecases.Unknown, errors.New("No such resource")), nil)
+}
+
+// respond finishes every request - writing value as json if err is NoError and the
+// problem otherwise. Values already encoded can be given as json.RawMessage.
+func (r *RestAPI) respond(response http.ResponseWriter, request *http.Request, err usecases.LightAuthError, value interface{}) {
+	if err.Code == usecases.NoError {
+		data, merr := json.Marshal(value)
+		if merr == nil {
+			response.Header().Set("Content-Type", "application/json")
+			response.WriteHeader(http.StatusOK)
+			response.Write(data)
+			return
+		}
+		err = usecases.NewError(usecases.InternalError, merr)
+	}
+
+	problem := newProblem(err, request)
+	level := "WARN"
+	if problem.Status >= http.StatusInternalServerError {
+		level = "ERROR"
+	}
+	r.Registry.Logger.Log(level, fmt.Sprintf("App Error %v %v %v : %v [request %v]", problem.Status, request.Method, request.URL.Path, err.Error, problem.RequestID))
+
+	data, _ := json.Marshal(problem)
+	response.Header().Set("Content-Type", "application/problem+json")
+	response.WriteHeader(problem.Status)
+	response.Write(data)
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/Shopify/sarama"
 	"github.com/gorilla/mux"
 	"github.com/riomhaire/lightauthuserapi/usecases"
@@ -35,10 +37,31 @@ func NewRestAPI(registry *usecases.Registry) RestAPI {
 	router.HandleFunc("/api/v1/user/health", api.HandleHealth).Methods("GET")
 	router.HandleFunc("/health", api.HandleHealth).Methods("GET")
 
-	router.HandleFunc("/api/v1/user/account/{name}", api.HandleSpecificUser).Methods("GET", "PUT", "DELETE")
-	router.HandleFunc("/api/v1/user/account", api.HandleGenericUser).Methods("POST", "GET")
+	// Each route names the scope a caller's key needs
+	router.HandleFunc("/api/v1/user/account/{name}", api.requireScope(usecases.ScopeUsersRead, api.HandleSpecificUser)).Methods("GET")
+	router.HandleFunc("/api/v1/user/account/{name}", api.requireScope(usecases.ScopeUsersWrite, api.HandleSpecificUser)).Methods("PUT", "PATCH", "DELETE")
+	router.HandleFunc("/api/v1/user/account/{name}/effective-roles", api.requireScope(usecases.ScopeUsersRead, api.HandleEffectiveRoles)).Methods("GET")
+	router.HandleFunc("/api/v1/user/account/{name}/rename", api.requireScope(usecases.ScopeUsersWrite, api.HandleRenameUser)).Methods("POST")
+	router.HandleFunc("/api/v1/user/account/{name}/lock", api.requireScope(usecases.ScopeUsersRead, api.HandleLock)).Methods("GET")
+	router.HandleFunc("/api/v1/user/account/{name}/lock", api.requireScope(usecases.ScopeUsersWrite, api.HandleLock)).Methods("DELETE")
+	router.HandleFunc("/api/v1/user/account/{name}/password", api.requireScope(usecases.ScopeAuthenticate, api.HandleChangePassword)).Methods("POST")
+	router.HandleFunc("/api/v1/user/account/{name}/password-reset", api.requireScope(usecases.ScopeUsersWrite, api.HandleCreatePasswordReset)).Methods("POST")
+	router.HandleFunc("/api/v1/user/account/{name}/mfa", api.requireScope(usecases.ScopeUsersWrite, api.HandleMFA)).Methods("POST", "DELETE")
+	router.HandleFunc("/api/v1/user/account/{name}/mfa/confirm", api.requireScope(usecases.ScopeUsersWrite, api.HandleConfirmMFA)).Methods("POST")
+	router.HandleFunc("/api/v1/user/password-reset", api.requireScope(usecases.ScopeAuthenticate, api.HandlePasswordReset)).Methods("POST")
+	router.HandleFunc("/api/v1/user/account", api.requireScope(usecases.ScopeUsersRead, api.HandleGenericUser)).Methods("GET")
+	router.HandleFunc("/api/v1/user/account", api.requireScope(usecases.ScopeUsersWrite, api.HandleGenericUser)).Methods("POST")
+
+	router.HandleFunc("/api/v1/user/authenticate", api.requireScope(usecases.ScopeAuthenticate, api.HandleAuthenticate)).Methods("POST")
+
+	router.HandleFunc("/api/v1/user/roles", api.requireScope(usecases.ScopeRolesRead, api.HandleReadRoles)).Methods("GET")
+	router.HandleFunc("/api/v1/user/roles/{name}", api.requireScope(usecases.ScopeRolesRead, api.HandleSpecificRole)).Methods("GET")
+	router.HandleFunc("/api/v1/user/roles/{name}", api.requireScope(usecases.ScopeRolesAdmin, api.HandleSpecificRole)).Methods("POST", "PUT", "DELETE")
+
+	router.HandleFunc("/api/v1/user/keys", api.requireScope(usecases.ScopeKeysAdmin, api.HandleKeys)).Methods("GET", "POST")
+	router.HandleFunc("/api/v1/user/keys/{id}", api.requireScope(usecases.ScopeKeysAdmin, api.HandleSpecificKey)).Methods("GET", "DELETE")
 
-	router.HandleFunc("/api/v1/user/roles", api.HandleReadRoles).Methods("GET")
+	router.HandleFunc("/api/v1/user/admin/reload", api.requireScope(usecases.ScopeStoreAdmin, api.HandleReload)).Methods("POST")
 
 	// This is for options call
 	router.HandleFunc("/api/v1/user/metrics", api.HandleOptions).Methods("OPTIONS")
@@ -47,11 +70,31 @@ func NewRestAPI(registry *usecases.Registry) RestAPI {
 	router.HandleFunc("/health", api.HandleOptions).Methods("OPTIONS")
 
 	router.HandleFunc("/api/v1/user/account/{name}", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/effective-roles", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/rename", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/lock", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/password", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/password-reset", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/mfa", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/account/{name}/mfa/confirm", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/password-reset", api.HandleOptions).Methods("OPTIONS")
 	router.HandleFunc("/api/v1/user/account", api.HandleOptions).Methods("OPTIONS")
 
+	router.HandleFunc("/api/v1/user/authenticate", api.HandleOptions).Methods("OPTIONS")
+
 	router.HandleFunc("/api/v1/user/roles", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/roles/{name}", api.HandleOptions).Methods("OPTIONS")
+
+	router.HandleFunc("/api/v1/user/keys", api.HandleOptions).Methods("OPTIONS")
+	router.HandleFunc("/api/v1/user/keys/{id}", api.HandleOptions).Methods("OPTIONS")
+
+	router.HandleFunc("/api/v1/user/admin/reload", api.HandleOptions).Methods("OPTIONS")
+
+	// Unknown paths get a problem too
+	router.NotFoundHandler = http.HandlerFunc(api.HandleNotFound)
 
 	// Add Middleware
+	negroni.UseFunc(api.AddRequestID) // First so everything after can log it
 	negroni.Use(api.Statistics)
 	negroni.UseFunc(api.RecordCall)       // Calculates per second/minute rates
 	negroni.UseFunc(api.AddWorkerHeader)  // Add which instance
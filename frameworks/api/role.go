@@ -2,21 +2,66 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
+	"github.com/gorilla/mux"
+	"github.com/riomhaire/lightauthuserapi/entities"
 	"github.com/riomhaire/lightauthuserapi/usecases"
 )
 
 func (r *RestAPI) HandleReadRoles(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 
-	valid, err := verifyAPIKey(req.Header.Get("Authorization"), r.Registry.Configuration.APIKey)
+	valid, err := r.verifyAPIKey(req)
 
-	if err.Code != usecases.NoError || !valid {
-		http.Error(w, "Not Authorized", http.StatusUnauthorized)
-		return
+	var roles []string
+	if err.Code == usecases.NoError && valid {
+		roles = r.Registry.Usecases.ReadRoles()
 	}
-	b, _ := json.Marshal(r.Registry.Usecases.ReadRoles())
-	w.Write(b)
+	r.respond(w, req, err, roles)
+}
+
+func (r *RestAPI) HandleSpecificRole(response http.ResponseWriter, request *http.Request) {
+	name := mux.Vars(request)["name"]
+	var role entities.Role
+	var err usecases.LightAuthError
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		switch request.Method {
+		case http.MethodGet:
+			role, err = r.Registry.Usecases.ReadRole(name)
+		case http.MethodPost, http.MethodPut:
+			role, err = decodeRole(request, name)
+			if err.Code == usecases.NoError {
+				if request.Method == http.MethodPost {
+					role, err = r.Registry.Usecases.CreateRole(role)
+				} else {
+					role, err = r.Registry.Usecases.UpdateRole(role)
+				}
+			}
+		case http.MethodDelete:
+			force, _ := strconv.ParseBool(request.URL.Query().Get("force"))
+			err = r.Registry.Usecases.DeleteRole(name, force)
+		default:
+			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
+		}
+	}
+	r.respond(response, request, err, role)
+}
 
+// Reads a role from the body - the name comes from the path and the body may only repeat it
+func decodeRole(request *http.Request, name string) (entities.Role, usecases.LightAuthError) {
+	var role entities.Role
+	defer request.Body.Close()
+	if derr := json.NewDecoder(request.Body).Decode(&role); derr != nil {
+		return role, usecases.NewError(usecases.Invalid, derr)
+	}
+	if len(role.Name) > 0 && role.Name != name {
+		return role, usecases.NewError(usecases.Invalid, errors.New("Role name does not match path"))
+	}
+	role.Name = name
+	return role, usecases.NewError(usecases.NoError, nil)
 }
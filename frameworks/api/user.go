@@ -3,9 +3,12 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/riomhaire/lightauthuserapi/entities"
@@ -13,12 +16,10 @@ import (
 )
 
 func (r *RestAPI) HandleGenericUser(response http.ResponseWriter, request *http.Request) {
-	response.Header().Set("Content-Type", "application/json")
-	code := http.StatusNotImplemented
-	data := []byte("Not Implemented")
+	var result interface{}
 	var err usecases.LightAuthError
 
-	valid, err := verifyAPIKey(request.Header.Get("Authorization"), r.Registry.Configuration.APIKey)
+	valid, err := r.verifyAPIKey(request)
 
 	if err.Code == usecases.NoError && valid {
 		// Read
@@ -28,20 +29,43 @@ func (r *RestAPI) HandleGenericUser(response http.ResponseWriter, request *http.
 			queryValues := request.URL.Query()
 			page := -1     // All pages
 			pageSize := -1 // One page
-			search := queryValues.Get("search")
 			val := queryValues.Get("page")
-			i, err := strconv.Atoi(val)
-			if err == nil {
+			i, cerr := strconv.Atoi(val)
+			if cerr == nil {
 				page = i
 			}
 			val = queryValues.Get("pageSize")
-			i, err = strconv.Atoi(val)
-			if err == nil {
+			i, cerr = strconv.Atoi(val)
+			if cerr == nil {
 				pageSize = i
 			}
 
-			users := r.Registry.Usecases.ListUsers(search, page, pageSize)
-			data, _ = json.Marshal(users)
+			query, qerr := r.userQuery(queryValues)
+			if qerr.Code != usecases.NoError {
+				err = qerr
+				break
+			}
+			// Names alone unless a view or fields ask for more
+			view := queryValues.Get("view")
+			fields := make([]string, 0)
+			for _, field := range strings.Split(queryValues.Get("fields"), ",") {
+				if field = strings.TrimSpace(field); len(field) > 0 {
+					fields = append(fields, field)
+				}
+			}
+			var users usecases.UserPage
+			if (len(view) == 0 || view == usecases.ViewNames) && len(fields) == 0 {
+				users, err = r.Registry.Usecases.FindUsers(query, page, pageSize, queryValues.Get("after"))
+				result = users.Names
+			} else {
+				result, users, err = r.Registry.Usecases.ListUserViews(query, page, pageSize, queryValues.Get("after"), view, fields)
+			}
+			if err.Code == usecases.NoError {
+				response.Header().Set("X-Total-Count", strconv.Itoa(users.Total))
+				if links := pageLinks(request.URL, users, page, pageSize); len(links) > 0 {
+					response.Header().Set("Link", links)
+				}
+			}
 		case http.MethodPost:
 			decoder := json.NewDecoder(request.Body)
 			var u entities.User
@@ -49,7 +73,10 @@ func (r *RestAPI) HandleGenericUser(response http.ResponseWriter, request *http.
 			if derr == nil {
 				var user entities.User
 				user, err = r.Registry.Usecases.CreateUser(u)
-				data, _ = json.Marshal(user)
+				result = user
+				if err.Code == usecases.NoError {
+					response.Header().Set("ETag", versionETag(user.Version))
+				}
 			} else {
 				err = usecases.NewError(usecases.Invalid, derr)
 			}
@@ -58,62 +85,151 @@ func (r *RestAPI) HandleGenericUser(response http.ResponseWriter, request *http.
 			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
 		}
 	}
-	// Final encode
-	code, returnData := applicationErrorToHttpStatus(err.Code)
-	if err.Code == usecases.NoError {
-		returnData = data
-	}
+	r.respond(response, request, err, result)
+}
 
-	response.WriteHeader(code)
-	response.Write(returnData)
-	if code != http.StatusOK {
-		msg := fmt.Sprintf("App Error %v : %v", code, string(data))
-		r.Registry.Logger.Log("ERROR", msg)
+// Reads the filters and order of a user listing from its query parameters
+func (r *RestAPI) userQuery(queryValues url.Values) (usecases.UserQuery, usecases.LightAuthError) {
+	query := usecases.UserQuery{
+		Search: queryValues.Get("search"),
+		Prefix: queryValues.Get("prefix"),
+		Roles:  queryValues["role"],
+		Sort:   queryValues.Get("sort"),
+		Claims: make(map[string]string),
 	}
+	violations := make([]usecases.Violation, 0)
+	// claim.<key>=<value> restricts to users holding that claim
+	for key := range queryValues {
+		if strings.HasPrefix(key, "claim.") && len(key) > len("claim.") {
+			query.Claims[strings.TrimPrefix(key, "claim.")] = queryValues.Get(key)
+		}
+	}
+	if val := queryValues.Get("enabled"); len(val) > 0 {
+		if enabled, cerr := strconv.ParseBool(val); cerr == nil {
+			query.Enabled = &enabled
+		} else {
+			violations = append(violations, usecases.Violation{Field: "enabled", Message: "enabled should be true or false"})
+		}
+	}
+	if since := queryValues.Get("inactiveSince"); len(since) > 0 {
+		var cerr error
+		if query.InactiveSince, cerr = r.Registry.Usecases.ParseSince(since); cerr != nil {
+			violations = append(violations, usecases.Violation{Field: "inactiveSince", Message: "inactiveSince should be an RFC3339 time or a duration such as 720h"})
+		}
+	}
+	if len(violations) > 0 {
+		return query, usecases.NewValidationError(violations)
+	}
+	return query, usecases.NewError(usecases.NoError, nil)
 }
 
 func (r *RestAPI) HandleSpecificUser(response http.ResponseWriter, request *http.Request) {
-	response.Header().Set("Content-Type", "application/json")
 	username := mux.Vars(request)["name"]
-	code := http.StatusNotImplemented
-	data := []byte("Not Implemented")
 	var user entities.User
+	var effectiveRoles []string
 	var err usecases.LightAuthError
 
-	valid, err := verifyAPIKey(request.Header.Get("Authorization"), r.Registry.Configuration.APIKey)
+	valid, err := r.verifyAPIKey(request)
 
 	if err.Code == usecases.NoError && valid {
 		// Read
 		switch request.Method {
 		case http.MethodGet:
 			user, err = r.Registry.Usecases.ReadUser(username)
+			if err.Code == usecases.NoError && request.URL.Query().Get("expand") == "roles" {
+				effectiveRoles, err = r.Registry.Usecases.EffectiveRoles(username)
+			}
 		case http.MethodPut:
 			decoder := json.NewDecoder(request.Body)
 			var u entities.User
 			derr := decoder.Decode(&u)
-			if derr == nil {
-				user, err = r.Registry.Usecases.UpdateUser(u)
+			if derr == nil && len(u.Username) > 0 && u.Username != username {
+				err = usecases.NewValidationError([]usecases.Violation{{Field: "username", Message: "Username does not match the path - use rename to change it"}})
+			} else if derr == nil {
+				u.Username = username
+				// Only If-Match makes the update conditional - a version in the body is ignored
+				if u.Version, err = ifMatchVersion(request.Header.Get("If-Match")); err.Code == usecases.NoError {
+					user, err = r.Registry.Usecases.UpdateUser(u)
+				}
 			} else {
 				err = usecases.NewError(usecases.Invalid, derr)
 			}
 			defer request.Body.Close()
+		case http.MethodPatch:
+			var version int64
+			if version, err = ifMatchVersion(request.Header.Get("If-Match")); err.Code == usecases.NoError {
+				patch, rerr := io.ReadAll(request.Body)
+				if rerr == nil {
+					format, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+					user, err = r.Registry.Usecases.PatchUser(username, format, patch, version)
+				} else {
+					err = usecases.NewError(usecases.Invalid, rerr)
+				}
+			}
+			defer request.Body.Close()
 		case http.MethodDelete:
-			err = r.Registry.Usecases.DeleteUser(username)
+			var version int64
+			if version, err = ifMatchVersion(request.Header.Get("If-Match")); err.Code == usecases.NoError {
+				err = r.Registry.Usecases.DeleteUser(username, version)
+			}
 
 		default:
 			err = usecases.NewError(usecases.NotImplemented, errors.New("Not Implemented"))
 		}
 	}
-	// Final encode
-	code, data = applicationErrorToHttpStatus(err.Code)
-	if err.Code == usecases.NoError {
-		data, _ = json.Marshal(user)
+	if err.Code == usecases.NoError && user.Version > 0 {
+		response.Header().Set("ETag", versionETag(user.Version))
 	}
+	if effectiveRoles != nil {
+		r.respond(response, request, err, userWithEffectiveRoles{user, effectiveRoles})
+	} else {
+		r.respond(response, request, err, user)
+	}
+}
+
+// HandleEffectiveRoles - returns every role a user holds directly or through role includes
+func (r *RestAPI) HandleEffectiveRoles(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+	var roles []string
+
+	valid, err := r.verifyAPIKey(request)
 
-	response.WriteHeader(code)
-	response.Write(data)
-	if code != http.StatusOK {
-		msg := fmt.Sprintf("App Error %v : %v", code, string(data))
-		r.Registry.Logger.Log("ERROR", msg)
+	if err.Code == usecases.NoError && valid {
+		roles, err = r.Registry.Usecases.EffectiveRoles(username)
 	}
+	r.respond(response, request, err, roles)
+}
+
+// What is posted to rename a user
+type userRename struct {
+	Username string `json:"username"`
+}
+
+// HandleRenameUser - moves a user to a new username
+func (r *RestAPI) HandleRenameUser(response http.ResponseWriter, request *http.Request) {
+	username := mux.Vars(request)["name"]
+	var user entities.User
+
+	valid, err := r.verifyAPIKey(request)
+
+	if err.Code == usecases.NoError && valid {
+		var rename userRename
+		var version int64
+		if derr := json.NewDecoder(request.Body).Decode(&rename); derr != nil {
+			err = usecases.NewError(usecases.Invalid, derr)
+		} else if version, err = ifMatchVersion(request.Header.Get("If-Match")); err.Code == usecases.NoError {
+			user, err = r.Registry.Usecases.RenameUser(username, rename.Username, version)
+		}
+		defer request.Body.Close()
+	}
+	if err.Code == usecases.NoError {
+		response.Header().Set("ETag", versionETag(user.Version))
+	}
+	r.respond(response, request, err, user)
+}
+
+// A user along with all the roles it effectively holds (?expand=roles)
+type userWithEffectiveRoles struct {
+	entities.User
+	EffectiveRoles []string `json:"effectiveRoles"`
 }
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
+	"github.com/riomhaire/lightauthuserapi/entities"
 	"github.com/riomhaire/lightauthuserapi/usecases"
 )
 
@@ -22,36 +27,102 @@ func extractAuthorization(header string) (string, error) {
 	return token, nil
 }
 
-func verifyAPIKey(header, key string) (bool, usecases.LightAuthError) {
-	token, err := extractAuthorization(header)
+// verifyAPIKey checks the caller presented a good key or token - with any scope. Which
+// scope a route needs is checked by requireScope before the handler is reached.
+func (r *RestAPI) verifyAPIKey(request *http.Request) (bool, usecases.LightAuthError) {
+	_, err := r.caller(request)
+	return err.Code == usecases.NoError, err
+}
 
+func (r *RestAPI) authenticateCaller(request *http.Request) (entities.APIKey, usecases.LightAuthError) {
+	token, err := extractAuthorization(request.Header.Get("Authorization"))
 	if err != nil {
-		return false, usecases.NewError(usecases.NotAuthorized, errors.New("Not Authorized"))
+		return entities.APIKey{}, usecases.NewError(usecases.NotAuthorized, err)
+	}
+	return r.Registry.Usecases.AuthenticateCaller(token)
+}
+
+type callerKey struct{}
+
+// requireScope lets only callers whose key or token holds scope through to next
+func (r *RestAPI) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		// A missing or malformed header leaves an empty token, which is never a key
+		token, _ := extractAuthorization(request.Header.Get("Authorization"))
+		key, err := r.Registry.Usecases.AuthorizeCaller(token, scope)
+		if err.Code != usecases.NoError {
+			r.respond(response, request, err, nil)
+			return
+		}
+		next(response, request.WithContext(context.WithValue(request.Context(), callerKey{}, key)))
+	}
+}
+
+// The key the caller authenticated with - token callers are given one without an id
+func (r *RestAPI) caller(request *http.Request) (entities.APIKey, usecases.LightAuthError) {
+	if key, ok := request.Context().Value(callerKey{}).(entities.APIKey); ok {
+		return key, usecases.NewError(usecases.NoError, nil)
 	}
+	return r.authenticateCaller(request)
+}
+
+// A body for requests which have nothing else to say
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+// A user's version as a strong ETag
+func versionETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
 
-	if strings.Compare(key, token) != 0 {
-		return false, usecases.NewError(usecases.NotAuthorized, errors.New("Not Authorized"))
+// The version an If-Match header asks for - 0 when there is none or it is "*".
+// A value which is not one of our ETags can never match.
+func ifMatchVersion(header string) (int64, usecases.LightAuthError) {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 || header == "*" {
+		return 0, usecases.NewError(usecases.NoError, nil)
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil || version < 1 {
+		return 0, usecases.NewError(usecases.VersionChanged, fmt.Errorf("If-Match %v does not match", header))
 	}
-	return true, usecases.NewError(usecases.NoError, nil)
+	return version, usecases.NewError(usecases.NoError, nil)
 }
 
-func applicationErrorToHttpStatus(appCode int) (int, []byte) {
-	switch appCode {
-	case usecases.NoError:
-		return http.StatusOK, []byte("")
-	case usecases.AlreadyExists:
-		return http.StatusConflict, []byte("Already Exists")
-	case usecases.NotImplemented:
-		return http.StatusNotImplemented, []byte("Not Implemented")
-	case usecases.Unknown:
-		return http.StatusNotFound, []byte("Not Found")
-	case usecases.Invalid:
-		return http.StatusNotAcceptable, []byte("Invalid Request")
-	case usecases.NotAuthorized:
-		return http.StatusUnauthorized, []byte("Not Authorized")
-	case usecases.InternalError:
-		return http.StatusInternalServerError, []byte("Internal Error")
+// RFC 8288 Link header for a page of a listing. Offset pages link to the first, previous,
+// next and last pages; cursor pages to the first and next.
+func pageLinks(base *url.URL, result usecases.UserPage, page int, pageSize int) string {
+	if pageSize < 1 {
+		return ""
+	}
+	link := func(rel string, set map[string]string) string {
+		query := base.Query()
+		query.Del("page")
+		query.Del("after")
+		for key, value := range set {
+			query.Set(key, value)
+		}
+		target := url.URL{Path: base.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf(`<%v>; rel="%v"`, target.String(), rel)
 	}
 
-	return http.StatusBadRequest, []byte("Bad Request")
+	links := make([]string, 0)
+	if page >= 1 {
+		last := max(1, (result.Total+pageSize-1)/pageSize)
+		links = append(links, link("first", map[string]string{"page": "1"}))
+		if page > 1 {
+			links = append(links, link("prev", map[string]string{"page": strconv.Itoa(min(page-1, last))}))
+		}
+		if page < last {
+			links = append(links, link("next", map[string]string{"page": strconv.Itoa(page + 1)}))
+		}
+		links = append(links, link("last", map[string]string{"page": strconv.Itoa(last)}))
+	} else {
+		links = append(links, link("first", nil))
+		if len(result.Next) > 0 {
+			links = append(links, link("next", map[string]string{"after": result.Next}))
+		}
+	}
+	return strings.Join(links, ", ")
 }
@@ -0,0 +1,159 @@
+package frameworks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// JSONAPIKeyStore keeps api keys in a json file, rewritten whole on every change. The
+// file is re-read before each change so keys minted from the command line while the
+// server runs are picked up.
+type JSONAPIKeyStore struct {
+	filename string
+	registry *usecases.Registry
+	mux      sync.RWMutex
+	keys     []entities.APIKey
+	modified int64 // Modification time of the file when last read
+}
+
+// A key as held in the file - with its hash
+type jsonAPIKey struct {
+	entities.APIKey
+	Hash string `json:"hash"`
+}
+
+// NewJSONAPIKeyStore opens the key file - a missing file is an empty store which is
+// created when the first key is made.
+func NewJSONAPIKeyStore(registry *usecases.Registry, filename string) (*JSONAPIKeyStore, error) {
+	store := JSONAPIKeyStore{filename: filename, registry: registry}
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+func (store *JSONAPIKeyStore) LookupAPIKey(id string) (entities.APIKey, error) {
+	if err := store.refresh(); err != nil {
+		return entities.APIKey{}, err
+	}
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	for _, key := range store.keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return entities.APIKey{}, errors.New("Unknown key")
+}
+
+func (store *JSONAPIKeyStore) LookupAPIKeys() ([]entities.APIKey, error) {
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+	return append([]entities.APIKey{}, store.keys...), nil
+}
+
+func (store *JSONAPIKeyStore) CreateAPIKey(key entities.APIKey) error {
+	// Re-read under the lock so nothing written since can be dropped by our write
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if err := store.reread(); err != nil {
+		return err
+	}
+	for _, existing := range store.keys {
+		if existing.ID == key.ID {
+			return errors.New("Key exists")
+		}
+	}
+	return store.write(append(append([]entities.APIKey{}, store.keys...), key))
+}
+
+func (store *JSONAPIKeyStore) DeleteAPIKey(id string) error {
+	// Re-read under the lock so nothing written since can be dropped by our write
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	if err := store.reread(); err != nil {
+		return err
+	}
+	keys := make([]entities.APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		if key.ID != id {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == len(store.keys) {
+		return errors.New("Unknown key")
+	}
+	return store.write(keys)
+}
+
+// Re-reads the file if it has changed since it was last read
+func (store *JSONAPIKeyStore) refresh() error {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+	return store.reread()
+}
+
+// refresh with the lock already held
+func (store *JSONAPIKeyStore) reread() error {
+	info, err := os.Stat(store.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.ModTime().UnixNano() == store.modified {
+		return nil
+	}
+
+	data, err := os.ReadFile(store.filename)
+	if err != nil {
+		return err
+	}
+	held := make([]jsonAPIKey, 0)
+	if err = json.Unmarshal(data, &held); err != nil {
+		return err
+	}
+	store.keys = make([]entities.APIKey, len(held))
+	for i, key := range held {
+		store.keys[i] = key.APIKey
+		store.keys[i].Hash = key.Hash
+	}
+	store.modified = info.ModTime().UnixNano()
+	return nil
+}
+
+// Replaces the file with keys - only readable by the owner as it holds key hashes.
+// Called with the lock held.
+func (store *JSONAPIKeyStore) write(keys []entities.APIKey) error {
+	held := make([]jsonAPIKey, len(keys))
+	for i, key := range keys {
+		held[i] = jsonAPIKey{key, key.Hash}
+	}
+	if _, err := os.Stat(store.filename); os.IsNotExist(err) {
+		if err = os.WriteFile(store.filename, []byte("[]"), 0600); err != nil {
+			return err
+		}
+	}
+	err := writeFileAtomic(store.filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(held)
+	})
+	if err != nil {
+		return err
+	}
+	store.keys = keys
+	if info, err := os.Stat(store.filename); err == nil {
+		store.modified = info.ModTime().UnixNano()
+	}
+	return nil
+}
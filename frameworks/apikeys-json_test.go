@@ -0,0 +1,59 @@
+package frameworks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/test"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+func TestJSONAPIKeysFromEitherWriterAreKept(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keys.json")
+	registry := usecases.Registry{Logger: test.NewStringLogger()}
+	// The server and the command line share the file
+	server, err := NewJSONAPIKeyStore(&registry, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, _ := NewJSONAPIKeyStore(&registry, filename)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server.CreateAPIKey(entities.APIKey{ID: fmt.Sprintf("server%02d", i), Hash: "h"})
+		}(i)
+	}
+	wg.Wait()
+
+	later := time.Now().Add(time.Minute)
+	if err = cli.CreateAPIKey(entities.APIKey{ID: "cli", Hash: "h"}); err != nil {
+		t.Fatalf("Unexpected create error - %v", err)
+	}
+	os.Chtimes(filename, later, later)
+	if err = server.DeleteAPIKey("server00"); err != nil {
+		t.Fatalf("Unexpected delete error - %v", err)
+	}
+	if err = server.CreateAPIKey(entities.APIKey{ID: "cli", Hash: "h"}); err == nil {
+		t.Errorf("Expected a key made by the other writer to be seen as existing")
+	}
+
+	reread, _ := NewJSONAPIKeyStore(&registry, filename)
+	keys, _ := reread.LookupAPIKeys()
+	if len(keys) != 20 {
+		t.Errorf("Expected 19 server keys and the cli key - got %v", keys)
+	}
+	if key, err := reread.LookupAPIKey("cli"); err != nil || key.Hash != "h" {
+		t.Errorf("Expected the cli key to survive the server's writes - got %+v %v", key, err)
+	}
+	if _, err := reread.LookupAPIKey("server00"); err == nil {
+		t.Errorf("Expected the deleted key to be gone")
+	}
+}
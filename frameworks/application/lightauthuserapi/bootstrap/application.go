@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/riomhaire/lightauthuserapi/frameworks"
 	"github.com/riomhaire/lightauthuserapi/frameworks/api"
@@ -15,6 +17,9 @@ import (
 
 const VERSION = "LightAuthUserAPI Version 1.3.2"
 
+// The shared key --key used to default to - published, so never accepted
+const publishedAPIKey = "secret"
+
 type Application struct {
 	registry *usecases.Registry
 	restAPI  *api.RestAPI
@@ -33,21 +38,89 @@ func (a *Application) Initialize(cmd *cobra.Command, args []string) {
 	configuration.Port, _ = strconv.Atoi(cmd.Flag("port").Value.String())
 	configuration.UserStore = cmd.Flag("usersFile").Value.String()
 	configuration.RoleStore = cmd.Flag("rolesFile").Value.String()
+	configuration.Store = cmd.Flag("store").Value.String()
+	configuration.AutoCreateRoles, _ = strconv.ParseBool(cmd.Flag("autoCreateRoles").Value.String())
+	configuration.PasswordHash = cmd.Flag("passwordHash").Value.String()
+	argon2Time, _ := strconv.ParseUint(cmd.Flag("argon2Time").Value.String(), 10, 32)
+	configuration.Argon2Time = uint32(argon2Time)
+	argon2Memory, _ := strconv.ParseUint(cmd.Flag("argon2Memory").Value.String(), 10, 32)
+	configuration.Argon2Memory = uint32(argon2Memory)
+	argon2Threads, _ := strconv.ParseUint(cmd.Flag("argon2Threads").Value.String(), 10, 8)
+	configuration.Argon2Threads = uint8(argon2Threads)
+	configuration.BcryptCost, _ = strconv.Atoi(cmd.Flag("bcryptCost").Value.String())
+	configuration.HidePasswords, _ = strconv.ParseBool(cmd.Flag("hidePasswords").Value.String())
+	configuration.MinPasswordLength, _ = strconv.Atoi(cmd.Flag("minPasswordLength").Value.String())
+	configuration.PasswordClasses, _ = strconv.Atoi(cmd.Flag("passwordClasses").Value.String())
+	configuration.PasswordHistory, _ = strconv.Atoi(cmd.Flag("passwordHistory").Value.String())
+	configuration.PasswordDenyListFile = cmd.Flag("passwordDenyList").Value.String()
+	configuration.ResetTokenLifetime, _ = time.ParseDuration(cmd.Flag("resetTokenLifetime").Value.String())
+	configuration.MFAKey = cmd.Flag("mfaKey").Value.String()
+	configuration.MFAIssuer = cmd.Flag("mfaIssuer").Value.String()
+	configuration.MaxFailedLogins, _ = strconv.Atoi(cmd.Flag("maxFailedLogins").Value.String())
+	configuration.FailedLoginWindow, _ = time.ParseDuration(cmd.Flag("failedLoginWindow").Value.String())
+	configuration.LockoutDuration, _ = time.ParseDuration(cmd.Flag("lockoutDuration").Value.String())
+	configuration.MaxLockoutDuration, _ = time.ParseDuration(cmd.Flag("maxLockoutDuration").Value.String())
+	configuration.ExpirySweepInterval, _ = time.ParseDuration(cmd.Flag("expirySweepInterval").Value.String())
 	configuration.APIKey = cmd.Flag("key").Value.String()
+	configuration.APIKeysFile = cmd.Flag("keysFile").Value.String()
+	configuration.JWTSecrets, _ = cmd.Flags().GetStringSlice("jwtSecret")
+	configuration.JWKSFile = cmd.Flag("jwks").Value.String()
+	configuration.JWTIssuer = cmd.Flag("jwtIssuer").Value.String()
+	configuration.JWTAudience = cmd.Flag("jwtAudience").Value.String()
+	configuration.JWTRolesClaim = cmd.Flag("jwtRolesClaim").Value.String()
 	hostname, _ := os.Hostname()
 	configuration.Host = hostname
 	configuration.Consul, _ = strconv.ParseBool(cmd.Flag("consul").Value.String())
 	configuration.ConsulHost = cmd.Flag("consulHost").Value.String()
 
+	if scheme := strings.ToLower(configuration.PasswordHash); scheme != usecases.Argon2id && scheme != usecases.Bcrypt {
+		logger.Log("ERROR", fmt.Sprintf("Unknown password hash '%v' - should be %v or %v", configuration.PasswordHash, usecases.Argon2id, usecases.Bcrypt))
+		os.Exit(1)
+	}
+
 	registry := usecases.Registry{}
 	a.registry = &registry
 	registry.Configuration = configuration
 	registry.Logger = logger
-	database := frameworks.NewCSVReaderDatabaseInteractor(&registry)
+	if len(configuration.PasswordDenyListFile) > 0 {
+		denied, err := frameworks.LoadPasswordDenyList(configuration.PasswordDenyListFile)
+		if err != nil {
+			logger.Log("ERROR", fmt.Sprintf("Cannot read password deny list '%v' : %v", configuration.PasswordDenyListFile, err))
+			os.Exit(1)
+		}
+		logger.Log("INFO", fmt.Sprintf("Loaded %v denied passwords", len(denied)))
+		registry.DeniedPasswords = denied
+	}
+	database, err := createStorageInteractor(&registry)
+	if err != nil {
+		logger.Log("ERROR", fmt.Sprintf("Cannot open store '%v' : %v", configuration.Store, err))
+		os.Exit(1)
+	}
 
 	registry.StorageInteractor = database
 	registry.Usecases = usecases.Usecases{&registry}
 
+	if len(configuration.APIKeysFile) > 0 {
+		keys, err := frameworks.NewJSONAPIKeyStore(&registry, configuration.APIKeysFile)
+		if err != nil {
+			logger.Log("ERROR", fmt.Sprintf("Cannot read api keys '%v' : %v", configuration.APIKeysFile, err))
+			os.Exit(1)
+		}
+		registry.APIKeyStore = keys
+	}
+	if len(configuration.JWTSecrets) > 0 || len(configuration.JWKSFile) > 0 {
+		authenticator, err := frameworks.NewJWTAuthenticator(&registry)
+		if err != nil {
+			logger.Log("ERROR", fmt.Sprintf("Cannot set up JWT authentication : %v", err))
+			os.Exit(1)
+		}
+		registry.Authenticators = append(registry.Authenticators, authenticator)
+	}
+	if configuration.APIKey == publishedAPIKey {
+		logger.Log("ERROR", "The shared api key is the published example - set --key to something else, or leave it out to use only minted keys")
+		os.Exit(1)
+	}
+
 	// Do we need external registry
 	if configuration.Consul {
 		registry.ExternalServiceRegistry = consulagent.NewConsulServiceRegistry(&registry, "/api/v1/user", "/api/v1/user/health")
@@ -62,6 +135,33 @@ func (a *Application) Initialize(cmd *cobra.Command, args []string) {
 
 }
 
+// Works out which backend to use from the store url - EG 'sqlite:///var/lib/lightauth/users.db'
+// or 'bolt:///var/lib/lightauth/users.bolt'.
+// If no store is given the users and roles csv files are used.
+func createStorageInteractor(registry *usecases.Registry) (usecases.StorageInteractor, error) {
+	store := registry.Configuration.Store
+	if len(store) == 0 || strings.ToLower(store) == "csv" {
+		database := frameworks.NewCSVReaderDatabaseInteractor(registry)
+		// Pick up hand edits of the files without a restart
+		if err := database.Watch(); err != nil {
+			registry.Logger.Log("WARN", fmt.Sprintf("Cannot watch csv files for changes : %v", err))
+		}
+		return database, nil
+	}
+
+	parts := strings.SplitN(store, "://", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("store should be of the form scheme://path")
+	}
+	switch strings.ToLower(parts[0]) {
+	case "sqlite":
+		return frameworks.NewSQLiteDatabaseInteractor(registry, parts[1])
+	case "bolt", "bbolt":
+		return frameworks.NewBoltDatabaseInteractor(registry, parts[1])
+	}
+	return nil, fmt.Errorf("unsupported store type '%v'", parts[0])
+}
+
 func (a *Application) Run() {
 	a.registry.Logger.Log("INFO", fmt.Sprintf("Running %s", a.registry.Configuration.Version))
 	a.registry.Logger.Log("INFO", a.registry.Configuration.String())
@@ -69,10 +169,47 @@ func (a *Application) Run() {
 	// Register with external service if required ... default does nothing
 	a.registry.ExternalServiceRegistry.Register()
 
+	if interval := a.registry.Configuration.ExpirySweepInterval; interval > 0 {
+		go a.sweepExpiredUsers(interval)
+	}
+
 	a.restAPI.Negroni.Run(fmt.Sprintf(":%d", a.registry.Configuration.Port))
 }
 
+// Disables users past their expiry every interval - for the life of the process
+func (a *Application) sweepExpiredUsers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if disabled, lerr := a.registry.Usecases.DisableExpiredUsers(); lerr.Code != usecases.NoError {
+			a.registry.Logger.Log("ERROR", fmt.Sprintf("Expiry sweep failed : %v", lerr.Error))
+		} else if disabled > 0 {
+			a.registry.Logger.Log("INFO", fmt.Sprintf("Expiry sweep disabled %v users", disabled))
+		}
+	}
+}
+
+// Reload re-reads the store's backing files if it has any (EG on SIGHUP)
+func (a *Application) Reload() {
+	a.registry.Logger.Log("INFO", "Reloading store")
+	a.registry.Usecases.Reload()
+}
+
 func (a *Application) Stop() {
 	a.registry.Logger.Log("INFO", "Shutting Down REST API")
 	a.registry.ExternalServiceRegistry.Deregister()
 }
+
+// KeyAdministration gives the usecases for managing the api keys in keysFile from the
+// command line - while the server may be running.
+func KeyAdministration(keysFile string) (*usecases.Usecases, error) {
+	registry := usecases.Registry{}
+	registry.Logger = frameworks.ConsoleLogger{}
+	keys, err := frameworks.NewJSONAPIKeyStore(&registry, keysFile)
+	if err != nil {
+		return nil, err
+	}
+	registry.APIKeyStore = keys
+	registry.Usecases = usecases.Usecases{Registry: &registry}
+	return &registry.Usecases, nil
+}
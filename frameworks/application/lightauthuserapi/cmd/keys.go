@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/frameworks/application/lightauthuserapi/bootstrap"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd groups the api key commands - they work on the keys file directly so
+// need no running server (and a running one picks up their changes)
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Mint, list and revoke api keys",
+	Long:  "Api keys are kept hashed in the keys file. Scopes are " + strings.Join(usecases.Scopes, ", ") + ".",
+}
+
+var createKeyCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Mint a key - it is shown this once",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		administration := keyAdministration(cmd)
+		scopes, _ := cmd.Flags().GetStringSlice("scope")
+		lifetime, _ := cmd.Flags().GetDuration("expiresIn")
+
+		// The command line can grant anything - whoever runs it can edit the file anyway
+		operator := "command line"
+		if current, err := user.Current(); err == nil {
+			operator = fmt.Sprintf("command line (%v)", current.Username)
+		}
+		minted, lerr := administration.CreateAPIKey(args[0], scopes, time.Time{}, lifetime, entities.APIKey{Name: operator, Scopes: usecases.Scopes})
+		exitOnError(lerr)
+		data, _ := json.MarshalIndent(minted, "", "  ")
+		fmt.Println(string(data))
+	},
+}
+
+var listKeysCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		keys, lerr := keyAdministration(cmd).ListAPIKeys()
+		exitOnError(lerr)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED BY\tCREATED\tEXPIRES")
+		for _, key := range keys {
+			expires := "never"
+			if !key.ExpiresAt.IsZero() {
+				expires = key.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedBy, key.CreatedAt.Format(time.RFC3339), expires)
+		}
+		w.Flush()
+	},
+}
+
+var revokeKeyCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke a key - it stops working straight away",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		exitOnError(keyAdministration(cmd).RevokeAPIKey(args[0], entities.APIKey{Name: "command line"}))
+		fmt.Printf("Revoked %v\n", args[0])
+	},
+}
+
+func keyAdministration(cmd *cobra.Command) *usecases.Usecases {
+	keysFile, _ := cmd.Flags().GetString("keysFile")
+	administration, err := bootstrap.KeyAdministration(keysFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read api keys '%v' : %v\n", keysFile, err)
+		os.Exit(1)
+	}
+	return administration
+}
+
+func exitOnError(lerr usecases.LightAuthError) {
+	if lerr.Code == usecases.NoError {
+		return
+	}
+	fmt.Fprintln(os.Stderr, lerr.Error)
+	for _, violation := range lerr.Violations {
+		fmt.Fprintf(os.Stderr, "  %v : %v\n", violation.Field, violation.Message)
+	}
+	os.Exit(1)
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.PersistentFlags().String("keysFile", "apikeys.json", "Where minted api keys are kept.")
+	keysCmd.AddCommand(createKeyCmd, listKeysCmd, revokeKeyCmd)
+	createKeyCmd.Flags().StringSlice("scope", nil, "Scope to grant - repeat or comma separate for several.")
+	createKeyCmd.Flags().Duration("expiresIn", 0, "How long the key lasts - 0 never expires.")
+}
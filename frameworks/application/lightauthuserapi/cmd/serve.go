@@ -20,6 +20,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/riomhaire/lightauthuserapi/frameworks/application/lightauthuserapi/bootstrap"
 	"github.com/spf13/cobra"
@@ -41,6 +42,15 @@ var serveCmd = &cobra.Command{
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+		// SIGHUP re-reads the user and role files
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				application.Reload()
+			}
+		}()
+
 		go func() {
 			<-c
 			log.Println("Shutting Down")
@@ -58,9 +68,35 @@ var serveCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(serveCmd)
 	serveCmd.Flags().IntP("port", "p", 3060, "Default Port to Listen to.")
-	serveCmd.Flags().StringP("key", "k", "secret", "Secret needed to access api.")
+	serveCmd.Flags().StringP("key", "k", "", "Shared key holding every scope - none by default, leaving only keys minted with the keys command.")
+	serveCmd.Flags().String("keysFile", "apikeys.json", "Where minted api keys are kept.")
+	serveCmd.Flags().StringSlice("jwtSecret", nil, "HS256 secret bearer JWTs may be signed with - repeat for several.")
+	serveCmd.Flags().String("jwks", "", "Local JWKS file of RS256/ES256 public keys bearer JWTs may be signed with.")
+	serveCmd.Flags().String("jwtIssuer", "", "iss bearer JWTs must have - '' for any.")
+	serveCmd.Flags().String("jwtAudience", "", "aud bearer JWTs must include - '' for any.")
+	serveCmd.Flags().String("jwtRolesClaim", "roles", "Claim holding a JWT's roles - their permissions give its scopes.")
 	serveCmd.Flags().StringP("usersFile", "u", "users.csv", "If User File used this is the one to use - must be r/w.")
 	serveCmd.Flags().StringP("rolesFile", "r", "roles.csv", "If Role File used this is the one to use - must be r/w.")
+	serveCmd.Flags().Bool("autoCreateRoles", false, "Create unknown roles given to users instead of rejecting them (for migrations).")
+	serveCmd.Flags().String("passwordHash", "argon2id", "How passwords are hashed - argon2id or bcrypt.")
+	serveCmd.Flags().Uint32("argon2Time", 2, "argon2id iterations.")
+	serveCmd.Flags().Uint32("argon2Memory", 19*1024, "argon2id memory in KiB.")
+	serveCmd.Flags().Uint8("argon2Threads", 1, "argon2id parallelism.")
+	serveCmd.Flags().Int("bcryptCost", 10, "bcrypt cost.")
+	serveCmd.Flags().Bool("hidePasswords", false, "Never include password hashes when users are read - use /api/v1/user/authenticate to check passwords.")
+	serveCmd.Flags().Int("minPasswordLength", 8, "Shortest password allowed.")
+	serveCmd.Flags().Int("passwordClasses", 0, "How many of lower case, upper case, digits and symbols a password must contain.")
+	serveCmd.Flags().Int("passwordHistory", 0, "How many previous passwords cannot be reused.")
+	serveCmd.Flags().String("passwordDenyList", "", "File of common passwords (one per line) which cannot be used.")
+	serveCmd.Flags().Duration("resetTokenLifetime", time.Hour, "How long an admin password reset token can be used for.")
+	serveCmd.Flags().String("mfaKey", "", "Secret used to encrypt TOTP secrets at rest - needed for TOTP enrolment. Changing it invalidates existing enrolments.")
+	serveCmd.Flags().String("mfaIssuer", "LightAuth", "Issuer shown in authenticator apps.")
+	serveCmd.Flags().Int("maxFailedLogins", 5, "Failed logins within the window before an account locks - 0 never locks.")
+	serveCmd.Flags().Duration("failedLoginWindow", 15*time.Minute, "Window in which failed logins are counted.")
+	serveCmd.Flags().Duration("lockoutDuration", 15*time.Minute, "How long the first lock lasts - each further lock without a good login doubles it.")
+	serveCmd.Flags().Duration("maxLockoutDuration", 24*time.Hour, "Longest a lock can last.")
+	serveCmd.Flags().Duration("expirySweepInterval", time.Hour, "How often users past their expiry are disabled - 0 never.")
+	serveCmd.Flags().StringP("store", "s", "", "Alternative user/role store EG sqlite:///var/lib/lightauth/users.db or bolt:///var/lib/lightauth/users.bolt - default is the csv files.")
 
 	serveCmd.Flags().StringP("consulHost", "t", "", "Host where consul resides usually something like http://consul:8500 ")
 	serveCmd.Flags().BoolP("consul", "c", false, "Enable consul support")
@@ -0,0 +1,67 @@
+package frameworks
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces filename with whatever write produces. The content goes to a
+// temporary file in the same directory which is fsynced and then renamed over the
+// original, so readers (and a restart after a crash) see either the old or the new
+// file - never a partial one.
+func writeFileAtomic(filename string, write func(w io.Writer) error) (err error) {
+	dir, base := filepath.Split(filename)
+	if len(dir) == 0 {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+base+".tmp-")
+	if err != nil {
+		return err
+	}
+	// Tidy up if we fail part way through
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// Keep the permissions of the file we are replacing
+	if info, serr := os.Stat(filename); serr == nil {
+		if err = tmp.Chmod(info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	buffered := bufio.NewWriter(tmp)
+	if err = write(buffered); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Makes sure a rename within the directory has reached the disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync() // Not supported everywhere - best effort
+	return nil
+}
@@ -0,0 +1,444 @@
+package frameworks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket     = []byte("users")     // id -> user
+	boltRolesBucket     = []byte("roles")     // role name -> role
+	boltUsernamesBucket = []byte("usernames") // username -> id, kept in username order by bolt
+	boltMetaBucket      = []byte("meta")      // schema version
+	boltVersionKey      = []byte("version")
+)
+
+// Each entry upgrades stored records by one version - indexed by the version being
+// upgraded from. Stores from before the version was recorded are version 1.
+var boltMigrations = map[int]func(tx *bolt.Tx) error{
+	1: boltMigrateClaims,
+	2: boltMigrateVersions,
+}
+
+const boltSchemaVersion = 3
+
+// BoltDatabaseInteractor stores users and roles in a bbolt key/value file. Every
+// change happens within a single bolt transaction so a crash can never leave
+// a partially written store behind.
+type BoltDatabaseInteractor struct {
+	registry *usecases.Registry
+	db       *bolt.DB
+}
+
+// NewBoltDatabaseInteractor opens (creating if required) the bolt file at the given path
+func NewBoltDatabaseInteractor(registry *usecases.Registry, filename string) (*BoltDatabaseInteractor, error) {
+	d := BoltDatabaseInteractor{}
+	d.registry = registry
+
+	registry.Logger.Log("INFO", fmt.Sprintf("Opening Bolt Database %s", filename))
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	d.db = db
+
+	// Make sure buckets exist
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltUsersBucket, boltRolesBucket, boltUsernamesBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return d.migrate(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Close releases the underlying database
+func (db *BoltDatabaseInteractor) Close() error {
+	return db.db.Close()
+}
+
+func (db *BoltDatabaseInteractor) LookupUserByName(username string) (entities.User, error) {
+	user := entities.User{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltUsernamesBucket).Get([]byte(username))
+		if id == nil {
+			return errors.New("Unknown user")
+		}
+		return boltDecode(tx.Bucket(boltUsersBucket).Get(id), &user)
+	})
+	return user, err
+}
+
+func (db *BoltDatabaseInteractor) LookupUsersByName(usernames []string) ([]entities.User, error) {
+	users := make([]entities.User, 0, len(usernames))
+	err := db.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(boltUsernamesBucket)
+		bucket := tx.Bucket(boltUsersBucket)
+		for _, name := range usernames {
+			id := ids.Get([]byte(name))
+			if id == nil {
+				continue
+			}
+			user := entities.User{}
+			if err := boltDecode(bucket.Get(id), &user); err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return nil
+	})
+	return users, err
+}
+
+func (db *BoltDatabaseInteractor) CreateUser(user entities.User) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		usernames := tx.Bucket(boltUsernamesBucket)
+		if usernames.Get([]byte(user.Username)) != nil {
+			return errors.New("User exists")
+		}
+		users := tx.Bucket(boltUsersBucket)
+		seq, err := users.NextSequence()
+		if err != nil {
+			return err
+		}
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, seq)
+
+		if err = boltPut(users, id, user); err != nil {
+			return err
+		}
+		return usernames.Put([]byte(user.Username), id)
+	})
+}
+
+// LookupUserNames returns the usernames containing search (all if empty) in username order.
+// Pages start at 1, and a page or pageSize of -1 returns everything.
+func (db *BoltDatabaseInteractor) LookupUserNames(search string, page int, pageSize int) ([]string, error) {
+	before := time.Now()
+	skip := 0
+	if pageSize > 0 && page > 1 {
+		skip = (page - 1) * pageSize
+	}
+
+	names := make([]string, 0)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUsernamesBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if pageSize > 0 && len(names) >= pageSize {
+				break
+			}
+			name := string(k)
+			if !strings.Contains(name, search) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			names = append(names, name)
+		}
+		return nil
+	})
+	if len(search) > 0 {
+		db.registry.Logger.Log("DEBUG", fmt.Sprintf("Search for '%v' and %v hits took %v", search, len(names), time.Now().Sub(before)))
+	}
+	return names, err
+}
+
+func (db *BoltDatabaseInteractor) LookupUserNamesAfter(search string, after string, limit int) ([]string, error) {
+	names := make([]string, 0)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltUsernamesBucket).Cursor()
+		for k, _ := c.Seek([]byte(after)); k != nil; k, _ = c.Next() {
+			if limit >= 0 && len(names) >= limit {
+				break
+			}
+			if name := string(k); name > after && strings.Contains(name, search) {
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (db *BoltDatabaseInteractor) CountUserNames(search string) (int, error) {
+	count := 0
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsernamesBucket).ForEach(func(k, v []byte) error {
+			if strings.Contains(string(k), search) {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+func (db *BoltDatabaseInteractor) UpdateUser(user entities.User) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltUsernamesBucket).Get([]byte(user.Username))
+		if id == nil {
+			return errors.New("User Does Not Exists")
+		}
+		users := tx.Bucket(boltUsersBucket)
+		existing := entities.User{}
+		if err := boltDecode(users.Get(id), &existing); err != nil {
+			return err
+		}
+		if existing.Version != user.Version {
+			return usecases.ErrVersionConflict
+		}
+		user.Version++
+		return boltPut(users, id, user)
+	})
+}
+
+// LookupUserNamesByClaim returns, in username order, the users holding the claim key with the given value
+func (db *BoltDatabaseInteractor) LookupUserNamesByClaim(key string, value string) ([]string, error) {
+	names := make([]string, 0)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsersBucket)
+		c := tx.Bucket(boltUsernamesBucket).Cursor()
+		for k, id := c.First(); k != nil; k, id = c.Next() {
+			user := entities.User{}
+			if err := boltDecode(users.Get(id), &user); err != nil {
+				return err
+			}
+			if claim, ok := user.Claims[key]; ok && claim == value {
+				names = append(names, user.Username)
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (db *BoltDatabaseInteractor) DeleteUser(user string, version int64) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		usernames := tx.Bucket(boltUsernamesBucket)
+		id := usernames.Get([]byte(user))
+		if id == nil {
+			return errors.New("User Does Not Exists")
+		}
+		users := tx.Bucket(boltUsersBucket)
+		if version != 0 {
+			existing := entities.User{}
+			if err := boltDecode(users.Get(id), &existing); err != nil {
+				return err
+			}
+			if existing.Version != version {
+				return usecases.ErrVersionConflict
+			}
+		}
+		if err := users.Delete(id); err != nil {
+			return err
+		}
+		return usernames.Delete([]byte(user))
+	})
+}
+
+// RenameUser keeps the user's id - only the name index entry moves
+func (db *BoltDatabaseInteractor) RenameUser(from string, user entities.User) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		usernames := tx.Bucket(boltUsernamesBucket)
+		id := usernames.Get([]byte(from))
+		if id == nil {
+			return errors.New("User Does Not Exists")
+		}
+		users := tx.Bucket(boltUsersBucket)
+		existing := entities.User{}
+		if err := boltDecode(users.Get(id), &existing); err != nil {
+			return err
+		}
+		if existing.Version != user.Version {
+			return usecases.ErrVersionConflict
+		}
+		if usernames.Get([]byte(user.Username)) != nil {
+			return usecases.ErrUserExists
+		}
+		// The id belongs to the bucket's page so copy it before changing the bucket
+		id = append([]byte{}, id...)
+		if err := usernames.Delete([]byte(from)); err != nil {
+			return err
+		}
+		if err := usernames.Put([]byte(user.Username), id); err != nil {
+			return err
+		}
+		user.Version++
+		return boltPut(users, id, user)
+	})
+}
+
+func (db *BoltDatabaseInteractor) LookupRoleNames() ([]string, error) {
+	var roles []string
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRolesBucket).ForEach(func(k, v []byte) error {
+			roles = append(roles, string(k))
+			return nil
+		})
+	})
+	return roles, err
+}
+
+func (db *BoltDatabaseInteractor) LookupRoleByName(name string) (entities.Role, error) {
+	role := entities.Role{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltRolesBucket).Get([]byte(name))
+		if data == nil {
+			return errors.New("Unknown role")
+		}
+		return boltDecode(data, &role)
+	})
+	return role, err
+}
+
+func (db *BoltDatabaseInteractor) CreateRole(role entities.Role) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		roles := tx.Bucket(boltRolesBucket)
+		if roles.Get([]byte(role.Name)) != nil {
+			return errors.New("Role exists")
+		}
+		return boltPut(roles, []byte(role.Name), role)
+	})
+}
+
+func (db *BoltDatabaseInteractor) UpdateRole(role entities.Role) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		roles := tx.Bucket(boltRolesBucket)
+		if roles.Get([]byte(role.Name)) == nil {
+			return errors.New("Role Does Not Exists")
+		}
+		return boltPut(roles, []byte(role.Name), role)
+	})
+}
+
+func (db *BoltDatabaseInteractor) DeleteRole(name string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		roles := tx.Bucket(boltRolesBucket)
+		if roles.Get([]byte(name)) == nil {
+			return errors.New("Role Does Not Exists")
+		}
+		return roles.Delete([]byte(name))
+	})
+}
+
+// Applies any migrations the store has not yet seen
+func (db *BoltDatabaseInteractor) migrate(tx *bolt.Tx) error {
+	meta := tx.Bucket(boltMetaBucket)
+	version := 1
+	if v := meta.Get(boltVersionKey); v != nil {
+		version = int(binary.BigEndian.Uint64(v))
+	}
+	if version > boltSchemaVersion {
+		return fmt.Errorf("schema version %v is newer than this server understands (%v)", version, boltSchemaVersion)
+	}
+	for ; version < boltSchemaVersion; version++ {
+		db.registry.Logger.Log("INFO", fmt.Sprintf("Upgrading Bolt schema to version %v", version+1))
+		if err := boltMigrations[version](tx); err != nil {
+			return fmt.Errorf("schema version %v: %v", version+1, err)
+		}
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(boltSchemaVersion))
+	return meta.Put(boltVersionKey, v)
+}
+
+// Version 1 users had two fixed claims. Gob silently drops fields the target does
+// not have, so they are read through a struct which still has them.
+func boltMigrateClaims(tx *bolt.Tx) error {
+	type legacyUser struct {
+		Username string
+		Password string
+		Enabled  bool
+		Roles    []string
+		Claim1   string
+		Claim2   string
+	}
+	users := tx.Bucket(boltUsersBucket)
+	updates := make(map[string]entities.User)
+	err := users.ForEach(func(id, data []byte) error {
+		legacy := legacyUser{}
+		if err := boltDecode(data, &legacy); err != nil {
+			return err
+		}
+		user := entities.User{Username: legacy.Username, Password: legacy.Password, Enabled: legacy.Enabled, Roles: legacy.Roles}
+		for key, value := range map[string]string{"claim1": legacy.Claim1, "claim2": legacy.Claim2} {
+			if len(value) > 0 {
+				if user.Claims == nil {
+					user.Claims = make(map[string]string)
+				}
+				user.Claims[key] = value
+			}
+		}
+		updates[string(id)] = user
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Buckets must not be changed while iterating over them
+	for id, user := range updates {
+		if err = boltPut(users, []byte(id), user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Users from before versions start at 1 as new ones do
+func boltMigrateVersions(tx *bolt.Tx) error {
+	users := tx.Bucket(boltUsersBucket)
+	updates := make(map[string]entities.User)
+	err := users.ForEach(func(id, data []byte) error {
+		user := entities.User{}
+		if err := boltDecode(data, &user); err != nil {
+			return err
+		}
+		if user.Version == 0 {
+			user.Version = 1
+			updates[string(id)] = user
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id, user := range updates {
+		if err = boltPut(users, []byte(id), user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Values are stored gob encoded
+func boltPut(bucket *bolt.Bucket, key []byte, value interface{}) error {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return err
+	}
+	return bucket.Put(key, buffer.Bytes())
+}
+
+func boltDecode(data []byte, value interface{}) error {
+	if data == nil {
+		return errors.New("Missing record")
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
@@ -0,0 +1,214 @@
+package frameworks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/test"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Opens the bolt file, closing it when the test ends
+func openBoltTestDatabase(t *testing.T, filename string) *BoltDatabaseInteractor {
+	registry := usecases.Registry{Logger: test.NewStringLogger()}
+	db, err := NewBoltDatabaseInteractor(&registry, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestBoltWriteIsReadBack(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.bolt")
+	db := openBoltTestDatabase(t, filename)
+	db.CreateRole(entities.Role{Name: "AUDIT", Permissions: []string{"users:read"}})
+	db.CreateRole(entities.Role{Name: "ADMIN", Includes: []string{"AUDIT"}})
+
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := entities.User{Username: "fred", Password: "hash", Enabled: true, Roles: []string{"ADMIN"},
+		Claims: map[string]string{"tenant": "acme"}, CreatedAt: created, RecoveryCodes: []string{"r1", "r2"}, Version: 1}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("Unexpected create error - %v", err)
+	}
+	if err := db.CreateUser(user); err == nil {
+		t.Errorf("Expected a duplicate user to be refused")
+	}
+	db.Close()
+
+	// Everything survives being reopened
+	db = openBoltTestDatabase(t, filename)
+	read, err := db.LookupUserByName("fred")
+	if err != nil || read.Password != "hash" || !read.Enabled || strings.Join(read.Roles, ",") != "ADMIN" ||
+		read.Claims["tenant"] != "acme" || !read.CreatedAt.Equal(created) || len(read.RecoveryCodes) != 2 || read.Version != 1 {
+		t.Errorf("Expected the user back as written - got %+v %v", read, err)
+	}
+	role, err := db.LookupRoleByName("ADMIN")
+	if err != nil || strings.Join(role.Includes, ",") != "AUDIT" {
+		t.Errorf("Expected the role back as written - got %+v %v", role, err)
+	}
+
+	read.Claims["team"] = "blue"
+	if err = db.UpdateUser(read); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	if names, _ := db.LookupUserNamesByClaim("team", "blue"); len(names) != 1 || names[0] != "fred" {
+		t.Errorf("Expected to find fred by claim - got %v", names)
+	}
+	if err = db.DeleteRole("ADMIN"); err != nil {
+		t.Errorf("Unexpected role delete error - %v", err)
+	}
+	if err = db.DeleteUser("fred", 2); err != nil {
+		t.Fatalf("Unexpected delete error - %v", err)
+	}
+	if _, err = db.LookupUserByName("fred"); err == nil {
+		t.Errorf("Expected fred to be gone")
+	}
+	if names, _ := db.LookupUserNames("", -1, -1); len(names) != 0 {
+		t.Errorf("Expected the name index to be empty - got %v", names)
+	}
+}
+
+func TestBoltMigratesUnversionedStore(t *testing.T) {
+	// Users as they were stored before the schema was versioned
+	type legacyUser struct {
+		Username string
+		Password string
+		Enabled  bool
+		Roles    []string
+		Claim1   string
+		Claim2   string
+	}
+	filename := filepath.Join(t.TempDir(), "users.bolt")
+	raw, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = raw.Update(func(tx *bolt.Tx) error {
+		users, _ := tx.CreateBucket(boltUsersBucket)
+		usernames, _ := tx.CreateBucket(boltUsernamesBucket)
+		tx.CreateBucket(boltRolesBucket)
+		for i, legacy := range []legacyUser{
+			{Username: "old", Password: "pwd", Enabled: true, Roles: []string{"TEST"}, Claim1: "c1"},
+			{Username: "older", Password: "pwd2", Claim1: "a", Claim2: "b"},
+		} {
+			id := make([]byte, 8)
+			binary.BigEndian.PutUint64(id, uint64(i+1))
+			if err := boltPut(users, id, legacy); err != nil {
+				return err
+			}
+			usernames.Put([]byte(legacy.Username), id)
+		}
+		return nil
+	})
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openBoltTestDatabase(t, filename)
+	old, err := db.LookupUserByName("old")
+	if err != nil || old.Password != "pwd" || !old.Enabled || len(old.Roles) != 1 || old.Version != 1 {
+		t.Errorf("Expected the user to survive the upgrade - got %+v %v", old, err)
+	}
+	if len(old.Claims) != 1 || old.Claims["claim1"] != "c1" {
+		t.Errorf("Expected the fixed claims to become named claims - got %v", old.Claims)
+	}
+	if older, _ := db.LookupUserByName("older"); older.Claims["claim1"] != "a" || older.Claims["claim2"] != "b" || older.Version != 1 {
+		t.Errorf("Expected both claims and a version - got %+v", older)
+	}
+	db.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMetaBucket).Get(boltVersionKey); v == nil || binary.BigEndian.Uint64(v) != boltSchemaVersion {
+			t.Errorf("Expected the schema version to be recorded - got %v", v)
+		}
+		return nil
+	})
+}
+
+func TestBoltStaleVersionIsRefused(t *testing.T) {
+	db := openBoltTestDatabase(t, filepath.Join(t.TempDir(), "users.bolt"))
+	db.CreateUser(entities.User{Username: "fred", Version: 1})
+
+	first, _ := db.LookupUserByName("fred")
+	second := first
+	first.Enabled = true
+	if err := db.UpdateUser(first); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	if err := db.UpdateUser(second); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale update to be refused - got %v", err)
+	}
+	if err := db.DeleteUser("fred", 1); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale delete to be refused - got %v", err)
+	}
+	if err := db.RenameUser("fred", entities.User{Username: "frederick", Version: 1}); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale rename to be refused - got %v", err)
+	}
+	if user, _ := db.LookupUserByName("fred"); user.Version != 2 || !user.Enabled {
+		t.Errorf("Expected the first update at version 2 - got %+v", user)
+	}
+}
+
+func TestBoltRenameMovesIndexEntry(t *testing.T) {
+	db := openBoltTestDatabase(t, filepath.Join(t.TempDir(), "users.bolt"))
+	// Enough users that the name index spans several pages
+	for i := 0; i < 500; i++ {
+		db.CreateUser(entities.User{Username: fmt.Sprintf("user%03d", i), Claims: map[string]string{"n": fmt.Sprint(i)}, Version: 1})
+	}
+
+	user, _ := db.LookupUserByName("user250")
+	user.Username = "user499"
+	if err := db.RenameUser("user250", user); err != usecases.ErrUserExists {
+		t.Errorf("Expected rename onto an existing user to be refused - got %v", err)
+	}
+	user.Username = "renamed"
+	if err := db.RenameUser("user250", user); err != nil {
+		t.Fatalf("Unexpected rename error - %v", err)
+	}
+
+	if _, err := db.LookupUserByName("user250"); err == nil {
+		t.Errorf("Expected old name to be gone")
+	}
+	if renamed, err := db.LookupUserByName("renamed"); err != nil || renamed.Claims["n"] != "250" || renamed.Version != 2 {
+		t.Errorf("Expected the renamed user at the next version - got %+v %v", renamed, err)
+	}
+	// Every other entry still points at its own user
+	for _, i := range []int{0, 249, 251, 499} {
+		name := fmt.Sprintf("user%03d", i)
+		if user, err := db.LookupUserByName(name); err != nil || user.Username != name || user.Claims["n"] != fmt.Sprint(i) {
+			t.Errorf("Expected %v to be intact - got %+v %v", name, user, err)
+		}
+	}
+	if count, _ := db.CountUserNames(""); count != 500 {
+		t.Errorf("Expected 500 users - got %v", count)
+	}
+}
+
+func TestBoltPagingByOffsetAndCursor(t *testing.T) {
+	db := openBoltTestDatabase(t, filepath.Join(t.TempDir(), "users.bolt"))
+	for _, name := range []string{"b1", "a2", "a1", "a3"} {
+		db.CreateUser(entities.User{Username: name, Version: 1})
+	}
+
+	if names, _ := db.LookupUserNames("a", 2, 2); len(names) != 1 || names[0] != "a3" {
+		t.Errorf("Expected second page of a's - got %v", names)
+	}
+	if names, _ := db.LookupUserNamesAfter("", "a2", 2); len(names) != 2 || names[0] != "a3" || names[1] != "b1" {
+		t.Errorf("Expected names after a2 - got %v", names)
+	}
+	if names, _ := db.LookupUserNamesAfter("a", "", 10); strings.Join(names, ",") != "a1,a2,a3" {
+		t.Errorf("Expected every a from the start - got %v", names)
+	}
+	if names, _ := db.LookupUserNamesAfter("", "b1", 10); len(names) != 0 {
+		t.Errorf("Expected nothing after the last name - got %v", names)
+	}
+	if count, _ := db.CountUserNames("a"); count != 3 {
+		t.Errorf("Expected 3 a's - got %v", count)
+	}
+}
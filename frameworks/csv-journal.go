@@ -0,0 +1,93 @@
+package frameworks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	journalCreate = "create"
+	journalUpdate = "update"
+	journalDelete = "delete"
+	journalRename = "rename" // Name is the old username
+)
+
+// A single mutation as recorded in the journal. Users are held as column name -> value
+// so an entry carries exactly what the csv snapshot would.
+type journalEntry struct {
+	Op   string            `json:"op"`
+	Name string            `json:"name"`
+	User map[string]string `json:"user,omitempty"`
+}
+
+// csvJournal is an append-only log of mutations to the csv user store. Each change is
+// appended (and fsynced) before the snapshot is rewritten; once a snapshot has safely
+// been renamed into place the journal is emptied. Anything left in the journal at start
+// up therefore belongs to a snapshot which never completed and is replayed.
+type csvJournal struct {
+	filename string
+}
+
+func newCSVJournal(filename string) *csvJournal {
+	return &csvJournal{filename}
+}
+
+// Append durably records the entry
+func (j *csvJournal) Append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Entries returns everything in the journal. A torn final line (a crash during Append)
+// was never acknowledged to the caller and is ignored.
+func (j *csvJournal) Entries() ([]journalEntry, error) {
+	entries := make([]journalEntry, 0)
+	data, err := os.ReadFile(j.filename)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return entries, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for lineNumber := 1; ; lineNumber++ {
+		line, rerr := reader.ReadBytes('\n')
+		if rerr == io.EOF {
+			// No newline means the append never finished
+			break
+		} else if rerr != nil {
+			return entries, rerr
+		}
+		entry := journalEntry{}
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return entries, fmt.Errorf("journal %v line %v : %v", j.filename, lineNumber, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Reset empties the journal once its entries are safely within a snapshot
+func (j *csvJournal) Reset() error {
+	err := os.Remove(j.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
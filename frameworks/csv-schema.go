@@ -0,0 +1,373 @@
+package frameworks
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// The csv files are self describing: the header row names the columns, so they may
+// appear in any order and columns we do not know about are carried through untouched.
+// Each user row also records the schema version it was written with - files from
+// before the column existed are version 1.
+//
+//	1 - username,password,enabled,roles,claim1,claim2
+//	2 - adds schema_version
+//	3 - claim1 and claim2 move into claims, a json object of any claims
+//	4 - adds the lockout columns
+//	5 - adds password_history
+//	6 - adds the password reset columns
+//	7 - adds the totp columns
+//	8 - adds the created, updated, last login and expiry times
+//	9 - adds version
+const csvSchemaVersion = 9
+
+// Column names - also used for the journal
+const (
+	usernameColumn = "username"
+	passwordColumn = "password"
+	enabledColumn  = "enabled"
+	rolesColumn    = "roles"
+	claimsColumn   = "claims"
+	schemaColumn   = "schema_version"
+
+	failedLoginsColumn  = "failed_logins"
+	firstFailedAtColumn = "first_failed_at"
+	lockedUntilColumn   = "locked_until"
+	lockoutsColumn      = "lockouts"
+	historyColumn       = "password_history"
+	resetTokenColumn    = "reset_token_hash"
+	resetExpiresColumn  = "reset_expires_at"
+	totpSecretColumn    = "totp_secret"
+	totpEnabledColumn   = "totp_enabled"
+	totpLastStepColumn  = "totp_last_step"
+	recoveryColumn      = "recovery_codes"
+	createdAtColumn     = "created_at"
+	updatedAtColumn     = "updated_at"
+	lastLoginAtColumn   = "last_login_at"
+	expiresAtColumn     = "expires_at"
+	versionColumn       = "version"
+
+	// No longer written - see upgrades
+	claim1Column = "claim1"
+	claim2Column = "claim2"
+
+	roleNameColumn        = "role"
+	roleDescriptionColumn = "description"
+	roleCreatedColumn     = "created"
+	rolePermissionsColumn = "permissions"
+	roleIncludesColumn    = "includes"
+)
+
+// The columns we write (and understand) in the order we write them
+var userColumns = []string{usernameColumn, passwordColumn, enabledColumn, rolesColumn, claimsColumn,
+	failedLoginsColumn, firstFailedAtColumn, lockedUntilColumn, lockoutsColumn, historyColumn,
+	resetTokenColumn, resetExpiresColumn, totpSecretColumn, totpEnabledColumn, totpLastStepColumn, recoveryColumn,
+	createdAtColumn, updatedAtColumn, lastLoginAtColumn, expiresAtColumn, versionColumn, schemaColumn}
+
+// Columns which upgrades fold into others - these are dropped rather than kept as extras
+var retiredUserColumns = []string{claim1Column, claim2Column}
+var roleColumns = []string{roleNameColumn, roleDescriptionColumn, roleCreatedColumn, rolePermissionsColumn, roleIncludesColumn}
+
+// Upgrades a row from one schema version to the next - indexed by the version being upgraded from
+var userSchemaUpgrades = map[int]func(fields map[string]string){
+	// 1 -> 2 only introduced the schema version column itself
+	1: func(fields map[string]string) {},
+	// 2 -> 3 moves the fixed claims into the claims map under their old names
+	2: func(fields map[string]string) {
+		claims, _ := decodeClaims(fields[claimsColumn]) // Checked by upgradeUserFields
+		for _, column := range retiredUserColumns {
+			if len(fields[column]) > 0 {
+				claims[column] = fields[column]
+			}
+			delete(fields, column)
+		}
+		fields[claimsColumn] = encodeClaims(claims)
+	},
+	// 3 -> 4 added lockout state - missing means not locked
+	3: func(fields map[string]string) {},
+	// 4 -> 5 added password history - missing means none
+	4: func(fields map[string]string) {},
+	// 5 -> 6 added password resets - missing means none outstanding
+	5: func(fields map[string]string) {},
+	// 6 -> 7 added totp - missing means not enrolled
+	6: func(fields map[string]string) {},
+	// 7 -> 8 added the user times - missing means not known (or never expires)
+	7: func(fields map[string]string) {},
+	// 8 -> 9 added version - existing users start at 1 as new ones do
+	8: func(fields map[string]string) { fields[versionColumn] = "1" },
+}
+
+// A row from a csv file keyed by column name
+type csvRow struct {
+	Line   int
+	Fields map[string]string
+}
+
+// csvTable is the parsed content of a csv file together with any problems found reading it
+type csvTable struct {
+	Columns  []string
+	Rows     []csvRow
+	Problems []string
+}
+
+// readCSVTable reads a csv file with a header row. Rows which cannot be parsed, or which
+// do not have a value for every column, are reported (with their line number) in Problems
+// and skipped rather than failing the whole file.
+func readCSVTable(filename string, required string) (csvTable, error) {
+	table := csvTable{}
+	csvfile, err := os.Open(filename)
+	if err != nil {
+		return table, err
+	}
+	defer csvfile.Close()
+
+	r := csv.NewReader(csvfile)
+	r.FieldsPerRecord = -1 // We check ourselves so we can skip rather than stop
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return table, nil
+	} else if err != nil {
+		return table, fmt.Errorf("%v header : %v", filename, err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	table.Columns = header
+	if indexOf(header, required) < 0 {
+		return table, fmt.Errorf("%v header has no '%v' column", filename, required)
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The reader has no field positions for a row it could not parse
+			var parseError *csv.ParseError
+			if !errors.As(err, &parseError) {
+				return table, fmt.Errorf("%v : %v", filename, err)
+			}
+			table.Problems = append(table.Problems, fmt.Sprintf("%v line %v : %v", filename, parseError.Line, err))
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		// Blank lines are skipped by the csv reader - a lone empty field is the same thing
+		if len(record) == 1 && len(record[0]) == 0 {
+			continue
+		}
+		if len(record) != len(header) {
+			table.Problems = append(table.Problems, fmt.Sprintf("%v line %v : expected %v fields but found %v", filename, line, len(header), len(record)))
+			continue
+		}
+		row := csvRow{Line: line, Fields: make(map[string]string, len(header))}
+		for i, column := range header {
+			row.Fields[column] = record[i]
+		}
+		if len(row.Fields[required]) == 0 {
+			table.Problems = append(table.Problems, fmt.Sprintf("%v line %v : no %v", filename, line, required))
+			continue
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, nil
+}
+
+// Writes a header followed by the rows. Known columns come first followed by any
+// extra columns we were given and do not understand.
+func writeCSVTable(w io.Writer, columns []string, rows []map[string]string) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, column := range columns {
+			record[i] = row[column]
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Brings a row up to the current schema. Rows without a version predate the column.
+func upgradeUserFields(fields map[string]string) error {
+	version := 1
+	if v, ok := fields[schemaColumn]; ok && len(v) > 0 {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("bad schema version '%v'", v)
+		}
+	}
+	if version > csvSchemaVersion {
+		return fmt.Errorf("schema version %v is newer than this server understands (%v)", version, csvSchemaVersion)
+	}
+	if version < 1 {
+		return fmt.Errorf("bad schema version %v", version)
+	}
+	// Before anything reads them, so claims which cannot be read are never taken as none
+	if _, err := decodeClaims(fields[claimsColumn]); err != nil {
+		return fmt.Errorf("bad claims '%v' : %v", fields[claimsColumn], err)
+	}
+	for ; version < csvSchemaVersion; version++ {
+		userSchemaUpgrades[version](fields)
+	}
+	fields[schemaColumn] = strconv.Itoa(csvSchemaVersion)
+	return nil
+}
+
+// User to/from column name -> value
+func userToFields(user entities.User) map[string]string {
+	return map[string]string{
+		usernameColumn: user.Username,
+		passwordColumn: user.Password,
+		enabledColumn:  strconv.FormatBool(user.Enabled),
+		rolesColumn:    strings.Join(user.Roles, ":"),
+		claimsColumn:   encodeClaims(user.Claims),
+		schemaColumn:   strconv.Itoa(csvSchemaVersion),
+
+		failedLoginsColumn:  strconv.Itoa(user.FailedLogins),
+		firstFailedAtColumn: formatCSVTime(user.FirstFailedAt),
+		lockedUntilColumn:   formatCSVTime(user.LockedUntil),
+		lockoutsColumn:      strconv.Itoa(user.Lockouts),
+		historyColumn:       strings.Join(user.PasswordHistory, ":"),
+		resetTokenColumn:    user.ResetTokenHash,
+		resetExpiresColumn:  formatCSVTime(user.ResetExpiresAt),
+		totpSecretColumn:    user.TOTPSecret,
+		totpEnabledColumn:   strconv.FormatBool(user.TOTPEnabled),
+		totpLastStepColumn:  strconv.FormatInt(user.TOTPLastStep, 10),
+		recoveryColumn:      strings.Join(user.RecoveryCodes, ":"),
+		createdAtColumn:     formatCSVTime(user.CreatedAt),
+		updatedAtColumn:     formatCSVTime(user.UpdatedAt),
+		lastLoginAtColumn:   formatCSVTime(user.LastLoginAt),
+		expiresAtColumn:     formatCSVTime(user.ExpiresAt),
+		versionColumn:       strconv.FormatInt(user.Version, 10),
+	}
+}
+
+func fieldsToUser(fields map[string]string) (entities.User, error) {
+	user := entities.User{}
+	user.Username = fields[usernameColumn]
+	user.Password = fields[passwordColumn]
+	user.Enabled, _ = strconv.ParseBool(fields[enabledColumn])
+	user.Roles = splitList(fields[rolesColumn])
+	claims, err := decodeClaims(fields[claimsColumn])
+	if err != nil {
+		return user, fmt.Errorf("bad claims '%v' : %v", fields[claimsColumn], err)
+	}
+	if len(claims) > 0 {
+		user.Claims = claims
+	}
+	user.FailedLogins, _ = strconv.Atoi(fields[failedLoginsColumn])
+	user.FirstFailedAt = parseCSVTime(fields[firstFailedAtColumn])
+	user.LockedUntil = parseCSVTime(fields[lockedUntilColumn])
+	user.Lockouts, _ = strconv.Atoi(fields[lockoutsColumn])
+	user.PasswordHistory = splitList(fields[historyColumn])
+	user.ResetTokenHash = fields[resetTokenColumn]
+	user.ResetExpiresAt = parseCSVTime(fields[resetExpiresColumn])
+	user.TOTPSecret = fields[totpSecretColumn]
+	user.TOTPEnabled, _ = strconv.ParseBool(fields[totpEnabledColumn])
+	user.TOTPLastStep, _ = strconv.ParseInt(fields[totpLastStepColumn], 10, 64)
+	user.RecoveryCodes = splitList(fields[recoveryColumn])
+	user.CreatedAt = parseCSVTime(fields[createdAtColumn])
+	user.UpdatedAt = parseCSVTime(fields[updatedAtColumn])
+	user.LastLoginAt = parseCSVTime(fields[lastLoginAtColumn])
+	user.ExpiresAt = parseCSVTime(fields[expiresAtColumn])
+	user.Version, _ = strconv.ParseInt(fields[versionColumn], 10, 64)
+	return user, nil
+}
+
+// Claims are held as a json object within the column
+func encodeClaims(claims map[string]string) string {
+	if len(claims) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(claims)
+	return string(data)
+}
+
+func decodeClaims(value string) (map[string]string, error) {
+	claims := make(map[string]string)
+	if len(value) > 0 {
+		if err := json.Unmarshal([]byte(value), &claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// Role to/from column name -> value
+func roleToFields(role entities.Role) map[string]string {
+	return map[string]string{
+		roleNameColumn:        role.Name,
+		roleDescriptionColumn: role.Description,
+		roleCreatedColumn:     formatCSVTime(role.CreatedAt),
+		rolePermissionsColumn: strings.Join(role.Permissions, ":"),
+		roleIncludesColumn:    strings.Join(role.Includes, ":"),
+	}
+}
+
+func fieldsToRole(fields map[string]string) entities.Role {
+	role := entities.Role{}
+	role.Name = fields[roleNameColumn]
+	role.Description = fields[roleDescriptionColumn]
+	role.CreatedAt = parseCSVTime(fields[roleCreatedColumn])
+	role.Permissions = splitList(fields[rolePermissionsColumn])
+	role.Includes = splitList(fields[roleIncludesColumn])
+	return role
+}
+
+// Times are RFC3339 in UTC to the nanosecond, as in the other stores - empty for 'not set'.
+// Files written with whole seconds read the same.
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseCSVTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, value)
+	return t
+}
+
+// Colon separated list to slice - empty gives an empty list rather than one blank entry
+func splitList(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return strings.Split(value, ":")
+}
+
+// Columns within 'columns' which are not in 'known'
+func extraColumns(columns, known []string) []string {
+	extras := make([]string, 0)
+	for _, column := range columns {
+		if indexOf(known, column) < 0 {
+			extras = append(extras, column)
+		}
+	}
+	return extras
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,222 @@
+package frameworks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// How long to wait for a burst of file events (editors, ansible copies) to settle
+const reloadSettleTime = 500 * time.Millisecond
+
+// How often a reload is retried if it keeps racing with changes made through the API
+const reloadAttempts = 3
+
+// Watch reloads the users and roles files whenever they change on disk. The containing
+// directories are watched rather than the files themselves because tools such as ansible
+// replace a file by renaming a new one over it.
+func (db *CSVReaderDatabaseInteractor) Watch() error {
+	files := db.watchedFiles()
+	if len(files) == 0 {
+		return nil
+	}
+	db.lazyLoad()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	db.watcher = watcher
+	db.registry.Logger.Log("INFO", fmt.Sprintf("Watching %v for changes", strings.Join(files, ", ")))
+
+	go db.watch(watcher, files)
+	return nil
+}
+
+// StopWatching stops reloading on file changes
+func (db *CSVReaderDatabaseInteractor) StopWatching() {
+	if db.watcher != nil {
+		db.watcher.Close()
+		db.watcher = nil
+	}
+}
+
+func (db *CSVReaderDatabaseInteractor) watch(watcher *fsnotify.Watcher, files []string) {
+	settle := time.NewTimer(reloadSettleTime)
+	settle.Stop()
+	touched := make(map[string]bool)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if name := filepath.Clean(event.Name); indexOf(files, name) >= 0 {
+				touched[name] = true
+				settle.Reset(reloadSettleTime)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			db.registry.Logger.Log("ERROR", fmt.Sprintf("File watcher : %v", err))
+		case <-settle.C:
+			// Our own writes fire events too - only reload for someone else's
+			if db.changedSinceWritten(touched) {
+				db.Reload()
+			}
+			touched = make(map[string]bool)
+		}
+	}
+}
+
+// Notes what a write of ours left on disk so the watcher can tell it from an edit
+func (db *CSVReaderDatabaseInteractor) noteWritten(filename string) {
+	if info, err := os.Stat(filename); err == nil {
+		db.written[filepath.Clean(filename)] = info
+	}
+}
+
+// Reports whether any of files is not as our last write left it - replaced, modified or
+// never written by us at all
+func (db *CSVReaderDatabaseInteractor) changedSinceWritten(files map[string]bool) bool {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	for file := range files {
+		info, err := os.Stat(file)
+		written, ok := db.written[file]
+		if err != nil || !ok || !os.SameFile(info, written) || !info.ModTime().Equal(written.ModTime()) || info.Size() != written.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *CSVReaderDatabaseInteractor) watchedFiles() []string {
+	files := make([]string, 0)
+	for _, file := range []string{db.registry.Configuration.UserStore, db.registry.Configuration.RoleStore} {
+		if len(file) > 0 && strings.Compare("NONE", strings.ToUpper(file)) != 0 {
+			files = append(files, filepath.Clean(file))
+		}
+	}
+	return files
+}
+
+// Reload re-reads the users and roles files. Everything is read and validated before any
+// of it is used; if either file has problems the current data is kept. The new data is
+// swapped in under the write lock so requests in flight see either the old or the new
+// data and are never dropped.
+func (db *CSVReaderDatabaseInteractor) Reload() error {
+	for attempt := 1; attempt <= reloadAttempts; attempt++ {
+		db.mux.RLock()
+		generation := db.generation
+		db.mux.RUnlock()
+
+		// Read into a separate instance so nothing is touched until it is all valid. A
+		// missing file is fine at first start up but here it is more likely mid-copy.
+		fresh := NewCSVReaderDatabaseInteractor(db.registry)
+		_, err := os.Stat(db.registry.Configuration.UserStore)
+		if err == nil {
+			_, err = fresh.loadUsers()
+		}
+		if err == nil {
+			fresh.roledb, err = fresh.loadRoles()
+		}
+		if err == nil && fresh.problems > 0 {
+			err = fmt.Errorf("%v malformed rows", fresh.problems)
+		}
+		if err != nil {
+			db.registry.Logger.Log("ERROR", fmt.Sprintf("Reload rejected - keeping current users and roles : %v", err))
+			return err
+		}
+
+		db.mux.Lock()
+		if db.generation != generation {
+			// A change was made through the api while we were reading - it may not be in
+			// what we read, so start again
+			db.mux.Unlock()
+			db.registry.Logger.Log("DEBUG", "Reload raced with an update - retrying")
+			continue
+		}
+		summary := db.diffSummary(fresh)
+		db.userdb = fresh.userdb
+		db.extras = fresh.extras
+		db.extraCols = fresh.extraCols
+		db.roledb = fresh.roledb
+		db.roleExtras = fresh.roleExtras
+		db.roleCols = fresh.roleCols
+		db.names = fresh.names
+		db.initialized = true
+		db.loadError = nil
+		db.roleError = nil
+		db.generation++
+		// Anything journalled but not yet in a snapshot still needs applying
+		err = db.replayJournal()
+		db.mux.Unlock()
+
+		if len(summary) > 0 {
+			db.registry.Logger.Log("INFO", fmt.Sprintf("Reloaded users and roles : %v", summary))
+		}
+		return err
+	}
+	err := errors.New("reload kept racing with updates")
+	db.registry.Logger.Log("ERROR", fmt.Sprintf("Reload abandoned : %v", err))
+	return err
+}
+
+// Describes what is different between our data and fresh - empty if nothing is
+func (db *CSVReaderDatabaseInteractor) diffSummary(fresh *CSVReaderDatabaseInteractor) string {
+	added, removed, changed := 0, 0, 0
+	for name, user := range fresh.userdb {
+		if current, ok := db.userdb[name]; !ok {
+			added++
+		} else if !reflect.DeepEqual(current, user) || !reflect.DeepEqual(db.extras[name], fresh.extras[name]) {
+			changed++
+		}
+	}
+	for name := range db.userdb {
+		if _, ok := fresh.userdb[name]; !ok {
+			removed++
+		}
+	}
+
+	currentRoles := make(map[string]entities.Role)
+	for _, role := range db.roledb {
+		currentRoles[role.Name] = role
+	}
+	rolesAdded, rolesRemoved, rolesChanged := 0, 0, 0
+	for _, role := range fresh.roledb {
+		if current, ok := currentRoles[role.Name]; ok {
+			if !reflect.DeepEqual(current, role) {
+				rolesChanged++
+			}
+			delete(currentRoles, role.Name)
+		} else {
+			rolesAdded++
+		}
+	}
+	rolesRemoved = len(currentRoles)
+
+	if added+removed+changed+rolesAdded+rolesRemoved+rolesChanged == 0 {
+		return ""
+	}
+	return fmt.Sprintf("users %v added, %v removed, %v changed; roles %v added, %v removed, %v changed",
+		added, removed, changed, rolesAdded, rolesRemoved, rolesChanged)
+}
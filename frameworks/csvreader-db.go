@@ -1,54 +1,65 @@
 package frameworks
 
 import (
-	"encoding/csv"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/nightlyone/lockfile"
 	"github.com/riomhaire/lightauthuserapi/entities"
 	"github.com/riomhaire/lightauthuserapi/usecases"
 )
 
-const (
-	usernameField = 0
-	passwordField = 1
-	enabledField  = 2
-	rolesField    = 3
-	claim1Field   = 4
-	claim2Field   = 5
-	roleNameField = 0
-)
-
 // This is a test implementation for test purposes
 type CSVReaderDatabaseInteractor struct {
 	registry    *usecases.Registry
 	userdb      map[string]entities.User
 	roledb      []entities.Role
 	names       []string
+	extras      map[string]map[string]string // username -> columns we do not understand but keep
+	extraCols   []string                     // ... and the order they appeared in
+	roleExtras  map[string]map[string]string // Same again for roles
+	roleCols    []string
 	initialized bool
-	mux         sync.Mutex
+	loadError   error // Set if the store could not be read - we refuse to overwrite it
+	roleError   error // ... and the same for the roles file
+	problems    int   // Rows skipped during the last load
+	generation  int   // Bumped on every change so a reload can tell it raced with one
+	watcher     *fsnotify.Watcher
+	written     map[string]os.FileInfo // What our last write of each file left there - not a change to reload
+	journal     *csvJournal
+	mux         sync.RWMutex
 }
 
 func NewCSVReaderDatabaseInteractor(registry *usecases.Registry) *CSVReaderDatabaseInteractor {
 	d := CSVReaderDatabaseInteractor{}
 	d.userdb = make(map[string]entities.User)
 	d.roledb = make([]entities.Role, 0)
+	d.extras = make(map[string]map[string]string)
+	d.roleExtras = make(map[string]map[string]string)
+	d.written = make(map[string]os.FileInfo)
 	d.registry = registry
 
+	// If filename is none - no journal either (test usage)
+	if strings.Compare("NONE", strings.ToUpper(registry.Configuration.UserStore)) != 0 {
+		d.journal = newCSVJournal(registry.Configuration.UserStore + ".journal")
+	}
 	return &d
 }
 
 func (db *CSVReaderDatabaseInteractor) LookupUserByName(username string) (entities.User, error) {
-	db.lazyLoad()
+	if err := db.lazyLoad(); err != nil {
+		return entities.User{}, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 	if val, ok := db.userdb[username]; ok {
 		return val, nil
 	} else {
@@ -56,74 +67,216 @@ func (db *CSVReaderDatabaseInteractor) LookupUserByName(username string) (entiti
 	}
 }
 
+func (db *CSVReaderDatabaseInteractor) LookupUsersByName(usernames []string) ([]entities.User, error) {
+	if err := db.lazyLoad(); err != nil {
+		return nil, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	users := make([]entities.User, 0, len(usernames))
+	for _, name := range usernames {
+		if user, ok := db.userdb[name]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
 func (db *CSVReaderDatabaseInteractor) CreateUser(user entities.User) error {
-	db.lazyLoad()
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
 	if _, ok := db.userdb[user.Username]; ok {
 		return errors.New("User exists")
 	}
+	if err := db.journalChange(journalCreate, user.Username, &user); err != nil {
+		return err
+	}
 	db.userdb[user.Username] = user
-	db.writeUsers()
+	db.generation++
 	db.rebuildNameIndex()
-	return nil
+	return db.snapshot()
 }
 
+// LookupUserNames returns the usernames containing search (all if empty) in username order.
+// Pages start at 1, and a page or pageSize of -1 returns everything.
 func (db *CSVReaderDatabaseInteractor) LookupUserNames(search string, page int, pageSize int) ([]string, error) {
-	db.lazyLoad()
+	if err := db.lazyLoad(); err != nil {
+		return nil, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
+	before := time.Now()
+	skip := 0
+	if pageSize > 0 && page > 1 {
+		skip = (page - 1) * pageSize
+	}
+	matchNames := make([]string, 0)
+	for _, name := range db.names {
+		if pageSize > 0 && len(matchNames) >= pageSize {
+			break
+		}
+		if !strings.Contains(name, search) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		matchNames = append(matchNames, name)
+	}
 	if len(search) > 0 {
-		// How many results
-		minReq := min(pageSize, len(db.names))
-		if minReq == -1 {
-			minReq = len(db.names)
+		db.registry.Logger.Log("DEBUG", fmt.Sprintf("Search for '%v' and %v hits took %v", search, len(matchNames), time.Now().Sub(before)))
+	}
+	return matchNames, nil
+}
+
+func (db *CSVReaderDatabaseInteractor) LookupUserNamesAfter(search string, after string, limit int) ([]string, error) {
+	if err := db.lazyLoad(); err != nil {
+		return nil, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	// The index is sorted so start just past 'after'
+	names := make([]string, 0)
+	for i := sort.SearchStrings(db.names, after); i < len(db.names); i++ {
+		if limit >= 0 && len(names) >= limit {
+			break
 		}
-		i := 0
-		matchNames := make([]string, 0)
-		before := time.Now()
-		for len(matchNames) < minReq && i < len(db.names) {
-			potentialMatch := db.names[i]
-			if strings.Contains(potentialMatch, search) {
-				matchNames = append(matchNames, potentialMatch)
-			}
-			i++
+		if name := db.names[i]; name > after && strings.Contains(name, search) {
+			names = append(names, name)
 		}
-		now := time.Now()
-		diff := now.Sub(before)
-		db.registry.Logger.Log("DEBUG", fmt.Sprintf("Search for '%v' and %v hits took %v", search, len(matchNames), diff))
+	}
+	return names, nil
+}
 
-		return matchNames, nil
+func (db *CSVReaderDatabaseInteractor) CountUserNames(search string) (int, error) {
+	if err := db.lazyLoad(); err != nil {
+		return 0, err
 	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	return db.names, nil
+	count := 0
+	for _, name := range db.names {
+		if strings.Contains(name, search) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// LookupUserNamesByClaim returns, in username order, the users holding the claim key with the given value
+func (db *CSVReaderDatabaseInteractor) LookupUserNamesByClaim(key string, value string) ([]string, error) {
+	if err := db.lazyLoad(); err != nil {
+		return nil, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	names := make([]string, 0)
+	for _, name := range db.names {
+		if claim, ok := db.userdb[name].Claims[key]; ok && claim == value {
+			names = append(names, name)
+		}
+	}
+	return names, nil
 }
 
 func (db *CSVReaderDatabaseInteractor) UpdateUser(user entities.User) error {
-	db.lazyLoad()
-	if _, ok := db.userdb[user.Username]; ok {
-		db.userdb[user.Username] = user
-	} else {
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	existing, ok := db.userdb[user.Username]
+	if !ok {
 		return errors.New("User Does Not Exists")
 	}
+	if existing.Version != user.Version {
+		return usecases.ErrVersionConflict
+	}
+	user.Version++
+	if err := db.journalChange(journalUpdate, user.Username, &user); err != nil {
+		return err
+	}
+	db.userdb[user.Username] = user
+	db.generation++
 	// Flush to file
-	db.writeUsers()
+	return db.snapshot()
+}
 
-	return nil
+func (db *CSVReaderDatabaseInteractor) DeleteUser(user string, version int64) error {
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	existing, ok := db.userdb[user]
+	if !ok {
+		return errors.New("User Does Not Exists")
+	}
+	if version != 0 && existing.Version != version {
+		return usecases.ErrVersionConflict
+	}
+	if err := db.journalChange(journalDelete, user, nil); err != nil {
+		return err
+	}
+	delete(db.userdb, user)
+	delete(db.extras, user)
+	db.generation++
+	// Flush to file
+	db.rebuildNameIndex()
+	return db.snapshot()
 }
 
-func (db *CSVReaderDatabaseInteractor) DeleteUser(user string) error {
-	db.lazyLoad()
-	if _, ok := db.userdb[user]; ok {
-		delete(db.userdb, user)
-	} else {
+func (db *CSVReaderDatabaseInteractor) RenameUser(from string, user entities.User) error {
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	existing, ok := db.userdb[from]
+	if !ok {
 		return errors.New("User Does Not Exists")
 	}
+	if existing.Version != user.Version {
+		return usecases.ErrVersionConflict
+	}
+	if _, ok = db.userdb[user.Username]; ok {
+		return usecases.ErrUserExists
+	}
+	user.Version++
+	if err := db.journalChange(journalRename, from, &user); err != nil {
+		return err
+	}
+	delete(db.userdb, from)
+	db.userdb[user.Username] = user
+	db.moveExtras(from, user.Username)
+	db.generation++
 	// Flush to file
-	db.writeUsers()
 	db.rebuildNameIndex()
-	return nil
+	return db.snapshot()
+}
+
+// Columns we do not understand stay with the user when it is renamed
+func (db *CSVReaderDatabaseInteractor) moveExtras(from, to string) {
+	if extras, ok := db.extras[from]; ok {
+		db.extras[to] = extras
+		delete(db.extras, from)
+	}
 }
 
 func (db *CSVReaderDatabaseInteractor) LookupRoleNames() ([]string, error) {
-	db.lazyLoad()
+	if err := db.lazyLoad(); err != nil {
+		return nil, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 	var roles []string
 	for _, r := range db.roledb {
 		roles = append(roles, r.Name)
@@ -131,6 +284,144 @@ func (db *CSVReaderDatabaseInteractor) LookupRoleNames() ([]string, error) {
 	return roles, nil
 }
 
+func (db *CSVReaderDatabaseInteractor) LookupRoleByName(name string) (entities.Role, error) {
+	if err := db.lazyLoad(); err != nil {
+		return entities.Role{}, err
+	}
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	for _, r := range db.roledb {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return entities.Role{}, errors.New("Unknown role")
+}
+
+func (db *CSVReaderDatabaseInteractor) CreateRole(role entities.Role) error {
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	for _, r := range db.roledb {
+		if r.Name == role.Name {
+			return errors.New("Role exists")
+		}
+	}
+	roles := append(append([]entities.Role{}, db.roledb...), role)
+	return db.writeRoles(roles)
+}
+
+func (db *CSVReaderDatabaseInteractor) UpdateRole(role entities.Role) error {
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	roles := append([]entities.Role{}, db.roledb...)
+	for i, r := range roles {
+		if r.Name == role.Name {
+			roles[i] = role
+			return db.writeRoles(roles)
+		}
+	}
+	return errors.New("Role Does Not Exists")
+}
+
+func (db *CSVReaderDatabaseInteractor) DeleteRole(name string) error {
+	if err := db.lazyLoad(); err != nil {
+		return err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	roles := make([]entities.Role, 0, len(db.roledb))
+	for _, r := range db.roledb {
+		if r.Name != name {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == len(db.roledb) {
+		return errors.New("Role Does Not Exists")
+	}
+	return db.writeRoles(roles)
+}
+
+// Records a change in the journal. Once this has succeeded the change is durable -
+// if the snapshot which follows fails it is replayed at the next start up.
+func (db *CSVReaderDatabaseInteractor) journalChange(op, username string, user *entities.User) error {
+	if db.journal == nil {
+		return nil
+	}
+	entry := journalEntry{Op: op, Name: username}
+	if user != nil {
+		entry.User = userToFields(*user)
+	}
+	err := db.journal.Append(entry)
+	if err != nil {
+		db.registry.Logger.Log("ERROR", fmt.Sprintf("Cannot journal %v of %v : %v", op, username, err))
+	}
+	return err
+}
+
+// Rewrites the user file and, if that worked, empties the journal. A failed write
+// leaves the change in the journal to be replayed at the next start.
+func (db *CSVReaderDatabaseInteractor) snapshot() error {
+	if err := db.writeUsers(); err != nil {
+		db.registry.Logger.Log("ERROR", fmt.Sprintf("Cannot write User Database %s - changes kept in journal : %v", db.registry.Configuration.UserStore, err))
+		return err
+	}
+	if db.journal != nil {
+		if err := db.journal.Reset(); err != nil {
+			db.registry.Logger.Log("ERROR", fmt.Sprintf("Cannot reset journal : %v", err))
+		}
+	}
+	return nil
+}
+
+// Applies anything left in the journal by a snapshot which never completed
+func (db *CSVReaderDatabaseInteractor) replayJournal() error {
+	if db.journal == nil {
+		return nil
+	}
+	entries, err := db.journal.Entries()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	db.registry.Logger.Log("WARN", fmt.Sprintf("Replaying %v journal entries from an incomplete snapshot", len(entries)))
+	for _, entry := range entries {
+		switch entry.Op {
+		case journalCreate, journalUpdate:
+			if err := upgradeUserFields(entry.User); err != nil {
+				return err
+			}
+			user, err := fieldsToUser(entry.User)
+			if err != nil {
+				return err
+			}
+			db.userdb[user.Username] = user
+		case journalDelete:
+			delete(db.userdb, entry.Name)
+			delete(db.extras, entry.Name)
+		case journalRename:
+			if err := upgradeUserFields(entry.User); err != nil {
+				return err
+			}
+			user, err := fieldsToUser(entry.User)
+			if err != nil {
+				return err
+			}
+			delete(db.userdb, entry.Name)
+			db.userdb[user.Username] = user
+			db.moveExtras(entry.Name, user.Username)
+		}
+	}
+	db.rebuildNameIndex()
+	// The data is loaded either way - a failed write keeps the journal for next time
+	db.snapshot()
+	return nil
+}
+
 // Initiaizes data structues - IE Read user DB
 func (db *CSVReaderDatabaseInteractor) loadUsers() (map[string]entities.User, error) {
 	filename := db.registry.Configuration.UserStore
@@ -142,38 +433,47 @@ func (db *CSVReaderDatabaseInteractor) loadUsers() (map[string]entities.User, er
 		return users, nil
 	}
 
-	csvfile, err := os.Open(filename)
-
-	if err != nil {
-		log.Fatal(err)
-		return users, err
-	}
-	defer csvfile.Close()
-	r := csv.NewReader(csvfile)
-	records, err := r.ReadAll()
-	if err != nil {
-		log.Fatal(err)
+	table, err := readCSVTable(filename, usernameColumn)
+	if os.IsNotExist(err) {
+		// Will be created on the first write
+		db.registry.Logger.Log("WARN", fmt.Sprintf("User Database %s does not exist - starting empty", filename))
+		return users, nil
+	} else if err != nil {
 		return users, err
 	}
 	// Create user map
-	for index, row := range records {
-		if index > 0 && len(row) > 0 {
-			user := entities.User{}
-			user.Username = row[usernameField]
-			user.Password = row[passwordField]
-
-			v, _ := strconv.ParseBool(row[enabledField])
-			user.Enabled = v
-			roles := strings.Split(row[rolesField], ":")
-			user.Roles = roles
-			user.Claim1 = row[claim1Field]
-			user.Claim2 = row[claim2Field]
-
-			// Add
-			users[user.Username] = user
+	extraCols := extraColumns(table.Columns, append(append([]string{}, userColumns...), retiredUserColumns...))
+	extras := make(map[string]map[string]string)
+	for _, row := range table.Rows {
+		if err := upgradeUserFields(row.Fields); err != nil {
+			table.Problems = append(table.Problems, fmt.Sprintf("%v line %v : %v", filename, row.Line, err))
+			continue
+		}
+		user, err := fieldsToUser(row.Fields)
+		if err != nil {
+			table.Problems = append(table.Problems, fmt.Sprintf("%v line %v : %v", filename, row.Line, err))
+			continue
+		}
+		if _, exists := users[user.Username]; exists {
+			table.Problems = append(table.Problems, fmt.Sprintf("%v line %v : duplicate user '%v'", filename, row.Line, user.Username))
+			continue
 		}
+		if len(extraCols) > 0 {
+			extras[user.Username] = make(map[string]string)
+			for _, column := range extraCols {
+				extras[user.Username][column] = row.Fields[column]
+			}
+		}
+		// Add
+		users[user.Username] = user
+	}
+	for _, problem := range table.Problems {
+		db.registry.Logger.Log("WARN", fmt.Sprintf("Skipping %v", problem))
 	}
+	db.problems += len(table.Problems)
 	db.userdb = users
+	db.extras = extras
+	db.extraCols = extraCols
 	db.rebuildNameIndex()
 	db.registry.Logger.Log("INFO", fmt.Sprintf("#Number of users = %v", len(users)))
 	return users, nil
@@ -191,6 +491,8 @@ func (db *CSVReaderDatabaseInteractor) rebuildNameIndex() {
 	db.names = names
 }
 
+// Writes the whole user database via a temporary file which replaces the original
+// only once it is complete.
 func (db *CSVReaderDatabaseInteractor) writeUsers() error {
 	db.registry.Logger.Log("INFO", fmt.Sprintf("Writing User Database %s", db.registry.Configuration.UserStore))
 	// If filename is none - dont load (test usage)
@@ -200,38 +502,33 @@ func (db *CSVReaderDatabaseInteractor) writeUsers() error {
 	// Setup file lock
 	lock, err := lockfile.New(filepath.Join(os.TempDir(), "userstore.lock"))
 	if err != nil {
-		fmt.Printf("Cannot init lock. reason: %v", err)
-		return nil // May loose - need to retry
+		return fmt.Errorf("cannot init lock : %v", err)
 	}
 	err = lock.TryLock()
 
 	// Error handling is essential, as we only try to get the lock.
 	if err != nil {
-		fmt.Printf("Cannot lock %q, reason: %v", lock, err)
-		panic(err) // handle properly please!
+		return fmt.Errorf("cannot lock %q : %v", lock, err)
 	}
 
 	defer lock.Unlock()
 
-	csvfile, err := os.Create(db.registry.Configuration.UserStore)
-	if err != nil {
-		log.Fatal(err)
-		return err
-	}
-	defer csvfile.Close()
-
-	csvfile.Write([]byte("username,password,enabled,roles,claim1,claim2\n"))
-	// Iterate through
-	for _, v := range db.userdb {
-		record := fmt.Sprintf("%v,%v,%v,%v,%v,%v\n", v.Username, v.Password, v.Enabled, strings.Join(v.Roles, ":"), v.Claim1, v.Claim2)
-		_, err = csvfile.Write([]byte(record))
-		if err != nil {
-			log.Fatal(err)
-			return err
+	columns := append(append([]string{}, userColumns...), db.extraCols...)
+	rows := make([]map[string]string, 0, len(db.names))
+	for _, name := range db.names {
+		row := userToFields(db.userdb[name])
+		for column, value := range db.extras[name] {
+			row[column] = value
 		}
+		rows = append(rows, row)
 	}
-
-	return nil
+	err = writeFileAtomic(db.registry.Configuration.UserStore, func(w io.Writer) error {
+		return writeCSVTable(w, columns, rows)
+	})
+	if err == nil {
+		db.noteWritten(db.registry.Configuration.UserStore)
+	}
+	return err
 }
 
 // Initiaizes data structues - IE Read roles DB
@@ -245,48 +542,98 @@ func (db *CSVReaderDatabaseInteractor) loadRoles() ([]entities.Role, error) {
 		return roles, nil
 	}
 
-	csvfile, err := os.Open(filename)
+	table, err := readCSVTable(filename, roleNameColumn)
 	if err != nil {
-		log.Fatal(err)
 		return roles, err
 	}
-	defer csvfile.Close()
-	r := csv.NewReader(csvfile)
-	records, err := r.ReadAll()
-	if err != nil {
-		log.Fatal(err)
-		return roles, err
+	for _, problem := range table.Problems {
+		db.registry.Logger.Log("WARN", fmt.Sprintf("Skipping %v", problem))
 	}
+	db.problems += len(table.Problems)
 	// Create roles
-	for index, row := range records {
-		if index > 0 && len(row) > 0 {
-			role := entities.Role{}
-			role.Name = row[roleNameField]
-			// Add
-			roles = append(roles, role)
+	roleCols := extraColumns(table.Columns, roleColumns)
+	extras := make(map[string]map[string]string)
+	for _, row := range table.Rows {
+		role := fieldsToRole(row.Fields)
+		if len(roleCols) > 0 {
+			extras[role.Name] = make(map[string]string)
+			for _, column := range roleCols {
+				extras[role.Name][column] = row.Fields[column]
+			}
 		}
+		// Add
+		roles = append(roles, role)
 	}
+	db.roleExtras = extras
+	db.roleCols = roleCols
 	db.registry.Logger.Log("INFO", fmt.Sprintf("#Number of Roles = %v", len(roles)))
 	return roles, nil
 
 }
 
-// Function loads the datastore if it has not aleady been loaded
-func (db *CSVReaderDatabaseInteractor) lazyLoad() {
-	if db.initialized {
-		return
+// Writes the given roles (atomically) - only once that has worked are they used
+func (db *CSVReaderDatabaseInteractor) writeRoles(roles []entities.Role) error {
+	if db.roleError != nil {
+		return db.roleError
+	}
+	filename := db.registry.Configuration.RoleStore
+	db.registry.Logger.Log("INFO", fmt.Sprintf("Writing Roles Database %s", filename))
+	if strings.Compare("NONE", strings.ToUpper(filename)) != 0 {
+		columns := append(append([]string{}, roleColumns...), db.roleCols...)
+		rows := make([]map[string]string, 0, len(roles))
+		for _, role := range roles {
+			row := roleToFields(role)
+			for column, value := range db.roleExtras[role.Name] {
+				row[column] = value
+			}
+			rows = append(rows, row)
+		}
+		err := writeFileAtomic(filename, func(w io.Writer) error {
+			return writeCSVTable(w, columns, rows)
+		})
+		if err != nil {
+			return err
+		}
+		db.noteWritten(filename)
+	}
+	db.roledb = roles
+	db.generation++
+	return nil
+}
+
+// Function loads the datastore if it has not aleady been loaded. If it could not be read
+// the error is returned (every time) so that writes do not replace a file we never saw.
+func (db *CSVReaderDatabaseInteractor) lazyLoad() error {
+	db.mux.RLock()
+	initialized, loadError := db.initialized, db.loadError
+	db.mux.RUnlock()
+	if initialized {
+		return loadError
 	}
 	before := time.Now()
 	db.mux.Lock()
+	defer db.mux.Unlock()
 	if db.initialized == false {
 		db.initialized = true
-		db.userdb, _ = db.loadUsers()
-		db.roledb, _ = db.loadRoles()
+		var err error
+		if db.userdb, err = db.loadUsers(); err == nil {
+			err = db.replayJournal()
+		}
+		if err != nil {
+			db.loadError = err
+			db.registry.Logger.Log("ERROR", fmt.Sprintf("Cannot load User Database %s : %v", db.registry.Configuration.UserStore, err))
+		}
+		if db.roledb, err = db.loadRoles(); err != nil {
+			db.registry.Logger.Log("ERROR", fmt.Sprintf("Cannot load Roles Database %s : %v", db.registry.Configuration.RoleStore, err))
+			if !os.IsNotExist(err) {
+				db.roleError = err
+			}
+		}
+		now := time.Now()
+		diff := now.Sub(before)
+		db.registry.Logger.Log("DEBUG", fmt.Sprintf("Load user file took %v", diff))
 	}
-	db.mux.Unlock()
-	now := time.Now()
-	diff := now.Sub(before)
-	db.registry.Logger.Log("DEBUG", fmt.Sprintf("Load user file took %v", diff))
+	return db.loadError
 }
 
 func max(x, y int) int {
@@ -0,0 +1,418 @@
+package frameworks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/test"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// Builds a registry whose csv files live in a temporary directory
+func createCSVTestRegistry(t *testing.T) *usecases.Registry {
+	dir := t.TempDir()
+	registry := usecases.Registry{}
+	registry.Logger = test.NewStringLogger()
+	registry.Configuration.UserStore = filepath.Join(dir, "users.csv")
+	registry.Configuration.RoleStore = filepath.Join(dir, "roles.csv")
+
+	os.WriteFile(registry.Configuration.UserStore, []byte("username,password,enabled,roles,claim1,claim2\nexisting,pwd,true,TEST,c1,c2\n"), 0644)
+	os.WriteFile(registry.Configuration.RoleStore, []byte("role\nTEST\n"), 0644)
+	return &registry
+}
+
+func TestCSVWriteIsReadBack(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+
+	if err := db.CreateUser(entities.User{Username: "new", Password: "pwd", Enabled: true, Roles: []string{"TEST"}}); err != nil {
+		t.Fatalf("Unexpected create error - %v", err)
+	}
+	// Journal should be empty once the snapshot is written
+	if _, err := os.Stat(registry.Configuration.UserStore + ".journal"); !os.IsNotExist(err) {
+		t.Errorf("Expected journal to be removed after snapshot")
+	}
+
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	for _, name := range []string{"existing", "new"} {
+		if _, err := reread.LookupUserByName(name); err != nil {
+			t.Errorf("Expected %v to be persisted", name)
+		}
+	}
+}
+
+func TestCSVJournalReplayedAfterIncompleteSnapshot(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+
+	// Simulate a crash after journalling but before the snapshot was renamed into place
+	journal := newCSVJournal(registry.Configuration.UserStore + ".journal")
+	journal.Append(journalEntry{Op: journalCreate, Name: "crashed", User: userToFields(entities.User{Username: "crashed", Enabled: true})})
+	journal.Append(journalEntry{Op: journalDelete, Name: "existing"})
+	// Torn final write - never acknowledged so ignored
+	f, _ := os.OpenFile(registry.Configuration.UserStore+".journal", os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write([]byte(`{"op":"delete","name":"cra`))
+	f.Close()
+
+	db := NewCSVReaderDatabaseInteractor(registry)
+	if _, err := db.LookupUserByName("crashed"); err != nil {
+		t.Errorf("Expected journalled user to be replayed")
+	}
+	if _, err := db.LookupUserByName("existing"); err == nil {
+		t.Errorf("Expected journalled delete to be replayed")
+	}
+	// Replay should have produced a fresh snapshot
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	if _, err := reread.LookupUserByName("crashed"); err != nil {
+		t.Errorf("Expected replayed user to be in the snapshot")
+	}
+}
+
+func TestCSVFailedWritesAreReported(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+	existing, _ := db.LookupUserByName("existing")
+
+	// A directory where the file should be cannot be renamed over
+	os.Remove(registry.Configuration.UserStore)
+	os.Mkdir(registry.Configuration.UserStore, 0755)
+	os.WriteFile(filepath.Join(registry.Configuration.UserStore, "blocker"), []byte("x"), 0644)
+
+	if err := db.CreateUser(entities.User{Username: "new"}); err == nil {
+		t.Errorf("Expected a failed create to be reported")
+	}
+	if err := db.UpdateUser(existing); err == nil {
+		t.Errorf("Expected a failed update to be reported")
+	}
+	existing.Version++
+	renamed := existing
+	renamed.Username = "renamed"
+	if err := db.RenameUser("existing", renamed); err == nil {
+		t.Errorf("Expected a failed rename to be reported")
+	}
+	if err := db.DeleteUser("new", 0); err == nil {
+		t.Errorf("Expected a failed delete to be reported")
+	}
+	if entries, _ := db.journal.Entries(); len(entries) != 4 {
+		t.Errorf("Expected the changes to be kept in the journal - got %v", len(entries))
+	}
+}
+
+func TestCSVUnreadableStoreIsNotOverwritten(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	os.Remove(registry.Configuration.UserStore)
+	os.Mkdir(registry.Configuration.UserStore, 0755) // Cannot be read as a file
+
+	db := NewCSVReaderDatabaseInteractor(registry)
+	if err := db.CreateUser(entities.User{Username: "new"}); err == nil {
+		t.Errorf("Expected create to fail when the store could not be loaded")
+	}
+	// Nothing answers as if the store were empty
+	if _, err := db.LookupUserByName("existing"); err == nil {
+		t.Errorf("Expected lookups to report the load failure")
+	}
+	if _, err := db.LookupUserNames("", -1, -1); err == nil {
+		t.Errorf("Expected listing to report the load failure")
+	}
+	if _, err := db.LookupRoleNames(); err == nil {
+		t.Errorf("Expected role listing to report the load failure")
+	}
+	if err := db.CreateRole(entities.Role{Name: "NEW"}); err == nil {
+		t.Errorf("Expected role changes to fail when the store could not be loaded")
+	}
+	if data, _ := os.ReadFile(registry.Configuration.RoleStore); string(data) != "role\nTEST\n" {
+		t.Errorf("Expected the roles file to be left alone - got %q", data)
+	}
+}
+
+func TestCSVQuotingExtraColumnsAndBadRows(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	// Columns out of order, an unknown column, a short row and a row with a bad quote
+	os.WriteFile(registry.Configuration.UserStore, []byte(
+		"roles,username,enabled,password,claim1,claim2,department\n"+
+			"TEST,first,true,pwd,a,b,sales\n"+
+			"TEST,short\n"+
+			"TEST,\"bad\"quote,true,pwd,a,b,x\n"+
+			"TEST,second,false,pwd,a,b,support\n"), 0644)
+
+	db := NewCSVReaderDatabaseInteractor(registry)
+	names, _ := db.LookupUserNames("", -1, -1)
+	if len(names) != 2 {
+		t.Fatalf("Expected malformed rows to be skipped - got %v", names)
+	}
+
+	awkward := entities.User{Username: "comma, \"quote\"\nnewline", Password: "p,w", Enabled: true, Claims: map[string]string{"display": "x,y \"z\""}}
+	if err := db.CreateUser(awkward); err != nil {
+		t.Fatalf("Unexpected create error - %v", err)
+	}
+
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	user, err := reread.LookupUserByName(awkward.Username)
+	if err != nil || user.Password != awkward.Password || user.Claims["display"] != awkward.Claims["display"] {
+		t.Errorf("Expected awkward values to survive a round trip - got %+v", user)
+	}
+	// Unknown column should have been kept
+	data, _ := os.ReadFile(registry.Configuration.UserStore)
+	if !strings.Contains(string(data), "department") || !strings.Contains(string(data), "support") {
+		t.Errorf("Expected unknown column to be preserved - got %v", string(data))
+	}
+	if !strings.Contains(string(data), schemaColumn) {
+		t.Errorf("Expected file to be upgraded to carry the schema version")
+	}
+}
+
+func TestCSVUnparseableFirstFieldIsSkipped(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.csv")
+	os.WriteFile(filename, []byte(
+		"username,password,enabled,roles\n"+
+			"first,pwd,true,A\n"+
+			"bad\"name,x,true,A\n"+
+			"second,pwd,true,A\n"+
+			"\"unterminated,x,true,A\n"), 0644)
+
+	table, err := readCSVTable(filename, usernameColumn)
+	if err != nil {
+		t.Fatalf("Unexpected read error - %v", err)
+	}
+	if len(table.Rows) != 2 || table.Rows[0].Fields["username"] != "first" || table.Rows[1].Fields["username"] != "second" {
+		t.Errorf("Expected the good rows either side of the bad ones - got %+v", table.Rows)
+	}
+	if len(table.Problems) != 2 || !strings.Contains(table.Problems[0], "line 3") || !strings.Contains(table.Problems[1], "line 5") {
+		t.Errorf("Expected both bad rows reported with their lines - got %v", table.Problems)
+	}
+}
+
+func TestCSVBadSchemaVersionsAreSkipped(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	os.WriteFile(registry.Configuration.UserStore, []byte(
+		"username,password,enabled,roles,schema_version\n"+
+			"zero,pwd,true,TEST,0\n"+
+			"negative,pwd,true,TEST,-1\n"+
+			"good,pwd,true,TEST,1\n"), 0644)
+
+	db := NewCSVReaderDatabaseInteractor(registry)
+	names, _ := db.LookupUserNames("", -1, -1)
+	if len(names) != 1 || names[0] != "good" {
+		t.Errorf("Expected rows with bad schema versions to be skipped - got %v", names)
+	}
+}
+
+func TestCSVUnreadableClaimsAreReported(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	os.WriteFile(registry.Configuration.UserStore, []byte(
+		"username,password,enabled,roles,claims,schema_version\n"+
+			"broken,pwd,true,TEST,{not json,9\n"+
+			"fine,pwd,true,TEST,\"{\"\"tenant\"\":\"\"acme\"\"}\",9\n"), 0644)
+
+	db := NewCSVReaderDatabaseInteractor(registry)
+	if _, err := db.LookupUserByName("broken"); err == nil {
+		t.Errorf("Expected a row with unreadable claims to be skipped rather than loaded without them")
+	}
+	if user, err := db.LookupUserByName("fine"); err != nil || user.Claims["tenant"] != "acme" {
+		t.Errorf("Expected the good row to load - got %+v %v", user, err)
+	}
+	if db.problems != 1 {
+		t.Errorf("Expected the bad row to be reported - got %v problems", db.problems)
+	}
+}
+
+func TestCSVFixedClaimsMigratedToClaims(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+
+	user, err := db.LookupUserByName("existing")
+	if err != nil || user.Claims["claim1"] != "c1" || user.Claims["claim2"] != "c2" {
+		t.Fatalf("Expected claim1/claim2 to be read as claims - got %+v", user)
+	}
+	user.Claims["email"] = "existing@example.com"
+	if err = db.UpdateUser(user); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	data, _ := os.ReadFile(registry.Configuration.UserStore)
+	if strings.Contains(string(data), claim1Column+",") {
+		t.Errorf("Expected claim1 column to be retired - got %v", string(data))
+	}
+
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	names, _ := reread.LookupUserNamesByClaim("email", "existing@example.com")
+	if len(names) != 1 || names[0] != "existing" {
+		t.Errorf("Expected to find user by claim - got %v", names)
+	}
+	if names, _ = reread.LookupUserNamesByClaim("email", "other"); len(names) != 0 {
+		t.Errorf("Expected no match for a different value - got %v", names)
+	}
+}
+
+func TestCSVReloadSwapsInEditedFiles(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+	if _, err := db.LookupUserByName("existing"); err != nil {
+		t.Fatalf("Expected initial user")
+	}
+
+	// Hand edit - replace the user and add a role
+	os.WriteFile(registry.Configuration.UserStore, []byte("username,password,enabled,roles,claim1,claim2\nedited,pwd,true,TEST,c1,c2\n"), 0644)
+	os.WriteFile(registry.Configuration.RoleStore, []byte("role\nTEST\nNEW\n"), 0644)
+	if err := db.Reload(); err != nil {
+		t.Fatalf("Unexpected reload error - %v", err)
+	}
+	if _, err := db.LookupUserByName("edited"); err != nil {
+		t.Errorf("Expected edited user after reload")
+	}
+	if _, err := db.LookupUserByName("existing"); err == nil {
+		t.Errorf("Expected removed user to be gone after reload")
+	}
+	if roles, _ := db.LookupRoleNames(); len(roles) != 2 {
+		t.Errorf("Expected new role after reload - got %v", roles)
+	}
+
+	// A broken edit is rejected and the current data kept
+	os.WriteFile(registry.Configuration.UserStore, []byte("username,password,enabled,roles,claim1,claim2\nbroken\n"), 0644)
+	if err := db.Reload(); err == nil {
+		t.Errorf("Expected malformed file to be rejected")
+	}
+	if _, err := db.LookupUserByName("edited"); err != nil {
+		t.Errorf("Expected current data to be kept after a rejected reload")
+	}
+}
+
+func TestCSVWatcherIgnoresOwnWrites(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+	if err := db.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.StopWatching()
+	generation := func() int {
+		db.mux.RLock()
+		defer db.mux.RUnlock()
+		return db.generation
+	}
+
+	user, _ := db.LookupUserByName("existing")
+	user.Enabled = false
+	if err := db.UpdateUser(user); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	db.CreateRole(entities.Role{Name: "NEW"})
+	written := generation()
+	time.Sleep(3 * reloadSettleTime)
+	if generation() != written {
+		t.Errorf("Expected our own writes not to be reloaded")
+	}
+
+	// Someone else's edit still is
+	os.WriteFile(registry.Configuration.UserStore, []byte("username,password,enabled,roles,claim1,claim2\nedited,pwd,true,TEST,c1,c2\n"), 0644)
+	for deadline := time.Now().Add(5 * reloadSettleTime); time.Now().Before(deadline) && generation() == written; {
+		time.Sleep(reloadSettleTime / 5)
+	}
+	if _, err := db.LookupUserByName("edited"); err != nil {
+		t.Errorf("Expected an edit to be reloaded")
+	}
+}
+
+func TestCSVLockoutStateIsPersisted(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+
+	until := time.Now().Add(time.Hour).UTC() // Not whole seconds - times keep their nanoseconds
+	user, _ := db.LookupUserByName("existing")
+	user.FailedLogins = 2
+	user.FirstFailedAt = until.Add(-time.Hour - 1500*time.Millisecond)
+	user.LockedUntil = until
+	user.Lockouts = 1
+	if err := db.UpdateUser(user); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	user, _ = reread.LookupUserByName("existing")
+	if user.FailedLogins != 2 || !user.FirstFailedAt.Equal(until.Add(-time.Hour-1500*time.Millisecond)) || !user.LockedUntil.Equal(until) || user.Lockouts != 1 {
+		t.Errorf("Expected lockout state to survive a round trip - got %+v", user)
+	}
+}
+
+func TestCSVStaleVersionIsRefused(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+
+	// Users from files without versions start at 1
+	first, _ := db.LookupUserByName("existing")
+	second := first
+	if first.Version != 1 {
+		t.Errorf("Expected upgraded user at version 1 - got %v", first.Version)
+	}
+	first.Enabled = !first.Enabled
+	if err := db.UpdateUser(first); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	if err := db.UpdateUser(second); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale update to be refused - got %v", err)
+	}
+	if err := db.DeleteUser("existing", 1); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale delete to be refused - got %v", err)
+	}
+
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	if user, _ := reread.LookupUserByName("existing"); user.Version != 2 || user.Enabled != first.Enabled {
+		t.Errorf("Expected the first update at version 2 - got %+v", user)
+	}
+	if err := reread.DeleteUser("existing", 2); err != nil {
+		t.Errorf("Unexpected delete error - %v", err)
+	}
+}
+
+func TestCSVRenameMovesUserAndExtras(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	os.WriteFile(registry.Configuration.UserStore, []byte("username,password,enabled,roles,department\nfirst,pwd,true,TEST,sales\nsecond,pwd,true,TEST,support\n"), 0644)
+	db := NewCSVReaderDatabaseInteractor(registry)
+
+	user, _ := db.LookupUserByName("first")
+	user.Username = "second"
+	if err := db.RenameUser("first", user); err != usecases.ErrUserExists {
+		t.Errorf("Expected rename onto an existing user to be refused - got %v", err)
+	}
+	user.Username = "renamed"
+	if err := db.RenameUser("first", user); err != nil {
+		t.Fatalf("Unexpected rename error - %v", err)
+	}
+
+	reread := NewCSVReaderDatabaseInteractor(registry)
+	if _, err := reread.LookupUserByName("first"); err == nil {
+		t.Errorf("Expected old name to be gone")
+	}
+	if user, err := reread.LookupUserByName("renamed"); err != nil || user.Version != 2 || len(user.Roles) != 1 {
+		t.Errorf("Expected renamed user at the next version - got %+v %v", user, err)
+	}
+	if names, _ := reread.LookupUserNames("", -1, -1); len(names) != 2 || names[0] != "renamed" {
+		t.Errorf("Expected name index to follow the rename - got %v", names)
+	}
+	data, _ := os.ReadFile(registry.Configuration.UserStore)
+	if !strings.Contains(string(data), "renamed,") || !strings.Contains(string(data), "sales") {
+		t.Errorf("Expected unknown columns to move with the user - got %v", string(data))
+	}
+}
+
+func TestCSVPagingByOffsetAndCursor(t *testing.T) {
+	registry := createCSVTestRegistry(t)
+	db := NewCSVReaderDatabaseInteractor(registry)
+	for _, name := range []string{"a1", "a2", "a3", "b1"} {
+		db.CreateUser(entities.User{Username: name})
+	}
+
+	if names, _ := db.LookupUserNames("a", 2, 2); len(names) != 1 || names[0] != "a3" {
+		t.Errorf("Expected second page of a's - got %v", names)
+	}
+	if names, _ := db.LookupUserNames("", 2, 2); len(names) != 2 || names[0] != "a3" || names[1] != "b1" {
+		t.Errorf("Expected second page of everyone - got %v", names)
+	}
+	if names, _ := db.LookupUserNamesAfter("", "a2", 2); len(names) != 2 || names[0] != "a3" || names[1] != "b1" {
+		t.Errorf("Expected names after a2 - got %v", names)
+	}
+	if count, _ := db.CountUserNames("a"); count != 3 {
+		t.Errorf("Expected 3 a's - got %v", count)
+	}
+}
@@ -0,0 +1,244 @@
+package frameworks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// Allowed difference between our clock and the issuer's when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// JWTAuthenticator accepts bearer JWTs signed with one of the configured HS256 secrets or
+// by an RS256/ES256 key in a local JWKS file. exp is required, nbf is checked when present
+// and iss and aud when configured. The JWKS file is re-read when it changes so keys can be
+// rotated without a restart.
+type JWTAuthenticator struct {
+	registry   *usecases.Registry
+	parser     *jwt.Parser
+	secrets    [][]byte
+	jwksFile   string
+	rolesClaim string
+	mux        sync.RWMutex
+	keys       []jwksKey
+	modified   int64 // Modification time of the JWKS file when last read
+}
+
+// A JWKS file as written - only what is needed for RS256 and ES256 keys
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// A key from the JWKS file ready to verify with
+type jwksKey struct {
+	kid string
+	alg string // RS256 or ES256
+	key interface{}
+}
+
+// NewJWTAuthenticator builds an authenticator from the registry's configuration - it needs
+// at least one secret or a JWKS file.
+func NewJWTAuthenticator(registry *usecases.Registry) (*JWTAuthenticator, error) {
+	configuration := registry.Configuration
+	authenticator := JWTAuthenticator{registry: registry, jwksFile: configuration.JWKSFile, rolesClaim: configuration.JWTRolesClaim}
+	if len(authenticator.rolesClaim) == 0 {
+		authenticator.rolesClaim = "roles"
+	}
+	for _, secret := range configuration.JWTSecrets {
+		if len(secret) > 0 {
+			authenticator.secrets = append(authenticator.secrets, []byte(secret))
+		}
+	}
+	if len(authenticator.secrets) == 0 && len(authenticator.jwksFile) == 0 {
+		return nil, errors.New("JWTs need a secret or a JWKS file to be verified with")
+	}
+	if err := authenticator.refresh(); err != nil {
+		return nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithTimeFunc(authenticator.now),
+	}
+	if len(configuration.JWTIssuer) > 0 {
+		options = append(options, jwt.WithIssuer(configuration.JWTIssuer))
+	}
+	if len(configuration.JWTAudience) > 0 {
+		options = append(options, jwt.WithAudience(configuration.JWTAudience))
+	}
+	authenticator.parser = jwt.NewParser(options...)
+	return &authenticator, nil
+}
+
+// AuthenticateToken verifies token if it looks like a JWT, returning its sub and roles
+func (authenticator *JWTAuthenticator) AuthenticateToken(token string) (string, []string, bool, error) {
+	if strings.Count(token, ".") != 2 {
+		return "", nil, false, nil
+	}
+	if err := authenticator.refresh(); err != nil {
+		// Carry on with the keys we have - the file may be half written
+		authenticator.registry.Logger.Log("WARN", fmt.Sprintf("Cannot re-read JWKS '%v' : %v", authenticator.jwksFile, err))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := authenticator.parser.ParseWithClaims(token, claims, authenticator.keyFor); err != nil {
+		return "", nil, true, err
+	}
+	subject, err := claims.GetSubject()
+	if err != nil || len(subject) == 0 {
+		return "", nil, true, errors.New("token has no subject")
+	}
+	return subject, tokenRoles(claims[authenticator.rolesClaim]), true, nil
+}
+
+// The keys a token could have been signed with given its alg and kid
+func (authenticator *JWTAuthenticator) keyFor(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	kid, _ := token.Header["kid"].(string)
+	set := jwt.VerificationKeySet{}
+	if alg == "HS256" {
+		for _, secret := range authenticator.secrets {
+			set.Keys = append(set.Keys, secret)
+		}
+	} else {
+		authenticator.mux.RLock()
+		for _, key := range authenticator.keys {
+			if key.alg == alg && (len(kid) == 0 || len(key.kid) == 0 || key.kid == kid) {
+				set.Keys = append(set.Keys, key.key)
+			}
+		}
+		authenticator.mux.RUnlock()
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no %v key '%v'", alg, kid)
+	}
+	return set, nil
+}
+
+func (authenticator *JWTAuthenticator) now() time.Time {
+	if authenticator.registry.Clock != nil {
+		return authenticator.registry.Clock()
+	}
+	return time.Now()
+}
+
+// Roles may be a list or a comma or space separated string
+func tokenRoles(claim interface{}) []string {
+	roles := make([]string, 0)
+	switch value := claim.(type) {
+	case string:
+		roles = strings.FieldsFunc(value, func(c rune) bool { return c == ',' || c == ' ' })
+	case []interface{}:
+		for _, role := range value {
+			if name, ok := role.(string); ok && len(name) > 0 {
+				roles = append(roles, name)
+			}
+		}
+	}
+	return roles
+}
+
+// Re-reads the JWKS file if it has changed since it was last read
+func (authenticator *JWTAuthenticator) refresh() error {
+	if len(authenticator.jwksFile) == 0 {
+		return nil
+	}
+	info, err := os.Stat(authenticator.jwksFile)
+	if err != nil {
+		return err
+	}
+	authenticator.mux.Lock()
+	defer authenticator.mux.Unlock()
+	if info.ModTime().UnixNano() == authenticator.modified {
+		return nil
+	}
+
+	data, err := os.ReadFile(authenticator.jwksFile)
+	if err != nil {
+		return err
+	}
+	set := jsonWebKeySet{}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	keys := make([]jwksKey, 0, len(set.Keys))
+	for i, held := range set.Keys {
+		if len(held.Use) > 0 && held.Use != "sig" {
+			continue
+		}
+		if len(held.Alg) > 0 && held.Alg != "RS256" && held.Alg != "ES256" {
+			authenticator.registry.Logger.Log("WARN", fmt.Sprintf("Skipping JWT key '%v' - %v is not supported", held.Kid, held.Alg))
+			continue
+		}
+		key, err := held.verificationKey()
+		if err != nil {
+			return fmt.Errorf("key %v '%v' : %v", i+1, held.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+	authenticator.keys = keys
+	authenticator.modified = info.ModTime().UnixNano()
+	authenticator.registry.Logger.Log("INFO", fmt.Sprintf("Loaded %v JWT keys from '%v'", len(keys), authenticator.jwksFile))
+	return nil
+}
+
+// The public key a JWK holds
+func (held jsonWebKey) verificationKey() (jwksKey, error) {
+	switch held.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(held.N)
+		if err != nil || len(n) == 0 {
+			return jwksKey{}, errors.New("bad modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(held.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return jwksKey{}, errors.New("bad exponent")
+		}
+		key := rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return jwksKey{}, errors.New("RSA keys should be at least 2048 bits")
+		}
+		return jwksKey{kid: held.Kid, alg: "RS256", key: &key}, nil
+	case "EC":
+		if held.Crv != "P-256" {
+			return jwksKey{}, fmt.Errorf("unsupported curve '%v' - only P-256 (ES256) is", held.Crv)
+		}
+		x, xerr := base64.RawURLEncoding.DecodeString(held.X)
+		y, yerr := base64.RawURLEncoding.DecodeString(held.Y)
+		if xerr != nil || yerr != nil {
+			return jwksKey{}, errors.New("bad point")
+		}
+		key := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return jwksKey{}, errors.New("point is not on the curve")
+		}
+		return jwksKey{kid: held.Kid, alg: "ES256", key: &key}, nil
+	}
+	return jwksKey{}, fmt.Errorf("unsupported key type '%v' - should be RSA or EC", held.Kty)
+}
@@ -0,0 +1,131 @@
+package frameworks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/riomhaire/lightauthuserapi/test"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+func writeJWKS(t *testing.T, filename string, keys ...jsonWebKey) {
+	data, _ := json.Marshal(jsonWebKeySet{Keys: keys})
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTAuthenticatorChecksSignaturesAndClaims(t *testing.T) {
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	rsaJWK := jsonWebKey{Kty: "RSA", Kid: "rsa-1", Alg: "RS256", N: encode(rsaKey.N.Bytes()), E: encode(big.NewInt(int64(rsaKey.E)).Bytes())}
+	ecJWK := jsonWebKey{Kty: "EC", Kid: "ec-1", Crv: "P-256", X: encode(ecKey.X.FillBytes(make([]byte, 32))), Y: encode(ecKey.Y.FillBytes(make([]byte, 32)))}
+
+	registry := usecases.Registry{Logger: test.NewStringLogger()}
+	registry.Clock = func() time.Time { return now }
+	registry.Configuration.JWTSecrets = []string{"an-hs256-secret-of-some-length!!"}
+	registry.Configuration.JWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	registry.Configuration.JWTIssuer = "lightauth"
+	registry.Configuration.JWTAudience = "userapi"
+	writeJWKS(t, registry.Configuration.JWKSFile, rsaJWK, ecJWK)
+
+	authenticator, err := NewJWTAuthenticator(&registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{"sub": "fred", "iss": "lightauth", "aud": "userapi", "exp": now.Add(time.Hour).Unix(), "roles": []string{"ADMIN", "AUDIT"}}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		if len(kid) > 0 {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	secret := []byte(registry.Configuration.JWTSecrets[0])
+
+	for name, token := range map[string]string{
+		"HS256": sign(jwt.SigningMethodHS256, "", secret, claims(nil)),
+		"RS256": sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)),
+		"ES256": sign(jwt.SigningMethodES256, "ec-1", ecKey, claims(nil)),
+		"nbf":   sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"nbf": now.Add(-time.Minute).Unix()})),
+		"skew":  sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()})),
+		"roles": sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"roles": "ADMIN, AUDIT"})),
+	} {
+		subject, roles, ok, err := authenticator.AuthenticateToken(token)
+		if !ok || err != nil || subject != "fred" || strings.Join(roles, ",") != "ADMIN,AUDIT" {
+			t.Errorf("Expected the %v token to be accepted - got %v %v %v %v", name, subject, roles, ok, err)
+		}
+	}
+
+	for name, token := range map[string]string{
+		"expired":      sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})),
+		"no expiry":    sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"exp": nil})),
+		"not yet":      sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})),
+		"issuer":       sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"iss": "someone-else"})),
+		"audience":     sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"aud": "billing"})),
+		"no subject":   sign(jwt.SigningMethodHS256, "", secret, claims(jwt.MapClaims{"sub": nil})),
+		"wrong secret": sign(jwt.SigningMethodHS256, "", []byte("not-the-secret-we-were-given!!!!"), claims(nil)),
+		"wrong kid":    sign(jwt.SigningMethodRS256, "ec-1", rsaKey, claims(nil)),
+		"HS384":        sign(jwt.SigningMethodHS384, "", secret, claims(nil)),
+		"none":         sign(jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, claims(nil)),
+		// The public key used as an HMAC secret
+		"confused": sign(jwt.SigningMethodHS256, "rsa-1", []byte(rsaJWK.N), claims(nil)),
+	} {
+		if _, _, ok, err := authenticator.AuthenticateToken(token); !ok || err == nil {
+			t.Errorf("Expected the %v token to be refused - got %v %v", name, ok, err)
+		}
+	}
+
+	if _, _, ok, _ := authenticator.AuthenticateToken("la_0123456789abcdef.secret"); ok {
+		t.Errorf("Expected api keys to be left alone")
+	}
+
+	// Keys dropped from the file stop working without a restart
+	rsaToken := sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil))
+	writeJWKS(t, registry.Configuration.JWKSFile, ecJWK)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(registry.Configuration.JWKSFile, later, later)
+	if _, _, ok, err := authenticator.AuthenticateToken(rsaToken); !ok || err == nil {
+		t.Errorf("Expected a token from a removed key to be refused - got %v %v", ok, err)
+	}
+}
+
+func TestJWTAuthenticatorNeedsKeys(t *testing.T) {
+	registry := usecases.Registry{Logger: test.NewStringLogger()}
+	if _, err := NewJWTAuthenticator(&registry); err == nil {
+		t.Errorf("Expected an authenticator without secrets or keys to be refused")
+	}
+	registry.Configuration.JWKSFile = filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, registry.Configuration.JWKSFile, jsonWebKey{Kty: "EC", Crv: "P-256", X: "AQ", Y: "Ag"})
+	if _, err := NewJWTAuthenticator(&registry); err == nil {
+		t.Errorf("Expected a JWKS with a bad key to be refused")
+	}
+}
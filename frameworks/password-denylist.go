@@ -0,0 +1,28 @@
+package frameworks
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// LoadPasswordDenyList reads a file of passwords which may not be used - one per line,
+// ignoring blank lines and those starting with '#'. They are matched ignoring case.
+func LoadPasswordDenyList(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denied := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denied[strings.ToLower(line)] = true
+	}
+	return denied, scanner.Err()
+}
@@ -0,0 +1,825 @@
+package frameworks
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// Each entry upgrades the schema by one version. The current version is kept in
+// 'PRAGMA user_version' so only the missing steps are applied on start up. New
+// changes must be appended - never edit an entry which has been released.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		username TEXT PRIMARY KEY NOT NULL,
+		password TEXT NOT NULL DEFAULT '',
+		enabled  INTEGER NOT NULL DEFAULT 0,
+		claim1   TEXT NOT NULL DEFAULT '',
+		claim2   TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS user_roles (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		role     TEXT NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (username, role)
+	);
+	CREATE INDEX IF NOT EXISTS user_roles_role ON user_roles(role);`,
+
+	// Roles gain a description, when they were created and permissions
+	`ALTER TABLE roles ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE roles ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role       TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE ON UPDATE CASCADE,
+		permission TEXT NOT NULL,
+		position   INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (role, permission)
+	);`,
+
+	// Roles can include other roles
+	`CREATE TABLE IF NOT EXISTS role_includes (
+		role     TEXT NOT NULL REFERENCES roles(name) ON DELETE CASCADE ON UPDATE CASCADE,
+		includes TEXT NOT NULL,
+		position INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (role, includes)
+	);`,
+
+	// The fixed claim1/claim2 columns become any number of named claims
+	`CREATE TABLE IF NOT EXISTS user_claims (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		key      TEXT NOT NULL,
+		value    TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (username, key)
+	);
+	CREATE INDEX IF NOT EXISTS user_claims_key_value ON user_claims(key, value);
+	INSERT INTO user_claims (username, key, value) SELECT username, 'claim1', claim1 FROM users WHERE claim1 <> '';
+	INSERT INTO user_claims (username, key, value) SELECT username, 'claim2', claim2 FROM users WHERE claim2 <> '';
+	ALTER TABLE users DROP COLUMN claim1;
+	ALTER TABLE users DROP COLUMN claim2;`,
+
+	// Lockout state
+	`ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN first_failed_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN locked_until TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN lockouts INTEGER NOT NULL DEFAULT 0;`,
+
+	// Earlier password hashes which may not be reused
+	`CREATE TABLE IF NOT EXISTS user_password_history (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		position INTEGER NOT NULL,
+		hash     TEXT NOT NULL,
+		PRIMARY KEY (username, position)
+	);`,
+
+	// Outstanding admin password resets
+	`ALTER TABLE users ADD COLUMN reset_token_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN reset_expires_at TEXT NOT NULL DEFAULT '';`,
+
+	// Second factor - the secret is encrypted before it gets here
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS user_recovery_codes (
+		username TEXT NOT NULL REFERENCES users(username) ON DELETE CASCADE ON UPDATE CASCADE,
+		hash     TEXT NOT NULL,
+		PRIMARY KEY (username, hash)
+	);`,
+
+	// When users were created, updated and last logged in, and when they expire
+	`ALTER TABLE users ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN last_login_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN expires_at TEXT NOT NULL DEFAULT '';`,
+
+	// Optimistic concurrency - existing users start at 1 as new ones do
+	`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+}
+
+// SQLiteDatabaseInteractor stores users and roles within an embedded sqlite database
+type SQLiteDatabaseInteractor struct {
+	registry *usecases.Registry
+	db       *sql.DB
+}
+
+// NewSQLiteDatabaseInteractor opens (creating if required) the database at the given path
+// and brings its schema up to date.
+func NewSQLiteDatabaseInteractor(registry *usecases.Registry, filename string) (*SQLiteDatabaseInteractor, error) {
+	d := SQLiteDatabaseInteractor{}
+	d.registry = registry
+
+	registry.Logger.Log("INFO", fmt.Sprintf("Opening SQLite Database %s", filename))
+	// Transactions read then write, so they take the write lock up front - one which
+	// started as a reader could not be upgraded while another writer held it
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate", filename))
+	if err != nil {
+		return nil, err
+	}
+	d.db = db
+
+	if err = d.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Close releases the underlying database
+func (db *SQLiteDatabaseInteractor) Close() error {
+	return db.db.Close()
+}
+
+// Columns read for a user - as scanned by scanSQLiteUser
+const sqliteUserColumns = `username, password, enabled, failed_logins, first_failed_at, locked_until, lockouts,
+	reset_token_hash, reset_expires_at, totp_secret, totp_enabled, totp_last_step,
+	created_at, updated_at, last_login_at, expires_at, version`
+
+// How many users are read by each query of LookupUsersByName - well within the limit on parameters
+const sqliteBatchSize = 500
+
+func (db *SQLiteDatabaseInteractor) LookupUserByName(username string) (entities.User, error) {
+	user, err := scanSQLiteUser(db.db.QueryRow("SELECT "+sqliteUserColumns+" FROM users WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return entities.User{}, errors.New("Unknown user")
+	} else if err != nil {
+		return entities.User{}, err
+	}
+
+	user.Roles, err = db.lookupUserRoles(db.db, username)
+	if err != nil {
+		return entities.User{}, err
+	}
+	user.Claims, err = db.lookupUserClaims(username)
+	if err != nil {
+		return entities.User{}, err
+	}
+	user.PasswordHistory, err = db.lookupList("SELECT hash FROM user_password_history WHERE username = ? ORDER BY position", username)
+	if err != nil {
+		return entities.User{}, err
+	}
+	user.RecoveryCodes, err = db.lookupList("SELECT hash FROM user_recovery_codes WHERE username = ? ORDER BY hash", username)
+	if err != nil {
+		return entities.User{}, err
+	}
+	return user, nil
+}
+
+// LookupUsersByName reads each batch of users with one query per table rather than per user,
+// all within one transaction so they are read as they stood at one moment.
+func (db *SQLiteDatabaseInteractor) LookupUsersByName(usernames []string) ([]entities.User, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	found := make(map[string]*entities.User, len(usernames))
+	for start := 0; start < len(usernames); start += sqliteBatchSize {
+		batch := usernames[start:min(start+sqliteBatchSize, len(usernames))]
+		in := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ") + ")"
+		args := make([]interface{}, len(batch))
+		for i, name := range batch {
+			args[i] = name
+		}
+
+		err = eachSQLiteRow(tx, "SELECT "+sqliteUserColumns+" FROM users WHERE username IN "+in, args, func(rows *sql.Rows) error {
+			user, err := scanSQLiteUser(rows)
+			if err != nil {
+				return err
+			}
+			found[user.Username] = &user
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = eachSQLiteRow(tx, "SELECT username, role FROM user_roles WHERE username IN "+in+" ORDER BY username, position", args, func(rows *sql.Rows) error {
+			var name, role string
+			if err := rows.Scan(&name, &role); err != nil {
+				return err
+			}
+			found[name].Roles = append(found[name].Roles, role)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = eachSQLiteRow(tx, "SELECT username, key, value FROM user_claims WHERE username IN "+in, args, func(rows *sql.Rows) error {
+			var name, key, value string
+			if err := rows.Scan(&name, &key, &value); err != nil {
+				return err
+			}
+			if found[name].Claims == nil {
+				found[name].Claims = make(map[string]string)
+			}
+			found[name].Claims[key] = value
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = eachSQLiteRow(tx, "SELECT username, hash FROM user_password_history WHERE username IN "+in+" ORDER BY username, position", args, func(rows *sql.Rows) error {
+			var name, hash string
+			if err := rows.Scan(&name, &hash); err != nil {
+				return err
+			}
+			found[name].PasswordHistory = append(found[name].PasswordHistory, hash)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = eachSQLiteRow(tx, "SELECT username, hash FROM user_recovery_codes WHERE username IN "+in+" ORDER BY username, hash", args, func(rows *sql.Rows) error {
+			var name, hash string
+			if err := rows.Scan(&name, &hash); err != nil {
+				return err
+			}
+			found[name].RecoveryCodes = append(found[name].RecoveryCodes, hash)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	users := make([]entities.User, 0, len(found))
+	for _, name := range usernames {
+		if user, ok := found[name]; ok {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+func (db *SQLiteDatabaseInteractor) CreateUser(user entities.User) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", user.Username).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return errors.New("User exists")
+	}
+
+	_, err = tx.Exec(`INSERT INTO users (username, password, enabled, failed_logins, first_failed_at, locked_until, lockouts,
+		reset_token_hash, reset_expires_at, totp_secret, totp_enabled, totp_last_step,
+		created_at, updated_at, last_login_at, expires_at, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.Username, user.Password, user.Enabled, user.FailedLogins, formatSQLiteTime(user.FirstFailedAt), formatSQLiteTime(user.LockedUntil), user.Lockouts,
+		user.ResetTokenHash, formatSQLiteTime(user.ResetExpiresAt), user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep,
+		formatSQLiteTime(user.CreatedAt), formatSQLiteTime(user.UpdatedAt), formatSQLiteTime(user.LastLoginAt), formatSQLiteTime(user.ExpiresAt), user.Version)
+	if err != nil {
+		return err
+	}
+	if err = db.writeUserRoles(tx, user); err != nil {
+		return err
+	}
+	if err = db.writeUserClaims(tx, user); err != nil {
+		return err
+	}
+	if err = db.writePasswordHistory(tx, user); err != nil {
+		return err
+	}
+	if err = db.writeRecoveryCodes(tx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LookupUserNames returns the usernames containing search (all if empty) in username order.
+// Pages start at 1, and a page or pageSize of -1 returns everything. Names are read in
+// order from the primary key index, but a search for part of a name has to look at each
+// of them.
+func (db *SQLiteDatabaseInteractor) LookupUserNames(search string, page int, pageSize int) ([]string, error) {
+	before := time.Now()
+	limit, offset := -1, 0
+	if pageSize > 0 {
+		limit = pageSize
+		if page > 1 {
+			offset = (page - 1) * pageSize
+		}
+	}
+
+	rows, err := db.db.Query("SELECT username FROM users WHERE instr(username, ?) > 0 ORDER BY username LIMIT ? OFFSET ?", search, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if len(search) > 0 {
+		db.registry.Logger.Log("DEBUG", fmt.Sprintf("Search for '%v' and %v hits took %v", search, len(names), time.Now().Sub(before)))
+	}
+	return names, rows.Err()
+}
+
+func (db *SQLiteDatabaseInteractor) LookupUserNamesAfter(search string, after string, limit int) ([]string, error) {
+	names, err := db.lookupList("SELECT username FROM users WHERE instr(username, ?) > 0 AND username > ? ORDER BY username LIMIT ?", search, after, limit)
+	if names == nil {
+		names = make([]string, 0)
+	}
+	return names, err
+}
+
+func (db *SQLiteDatabaseInteractor) CountUserNames(search string) (int, error) {
+	var count int
+	err := db.db.QueryRow("SELECT COUNT(*) FROM users WHERE instr(username, ?) > 0", search).Scan(&count)
+	return count, err
+}
+
+func (db *SQLiteDatabaseInteractor) UpdateUser(user entities.User) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = db.updateUser(tx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RenameUser changes the username - the cascades take roles, claims and history with it -
+// then stores the rest of the user, all within one transaction
+func (db *SQLiteDatabaseInteractor) RenameUser(from string, user entities.User) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", user.Username).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return usecases.ErrUserExists
+	}
+	result, err := tx.Exec("UPDATE users SET username = ? WHERE username = ? AND version = ?", user.Username, from, user.Version)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return db.missingOrChanged(tx, from)
+	}
+	if err = db.updateUser(tx, user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Stores the user if it is at user.Version - moving it to the next
+func (db *SQLiteDatabaseInteractor) updateUser(tx *sql.Tx, user entities.User) error {
+	result, err := tx.Exec(`UPDATE users SET password = ?, enabled = ?, failed_logins = ?, first_failed_at = ?, locked_until = ?, lockouts = ?,
+		reset_token_hash = ?, reset_expires_at = ?, totp_secret = ?, totp_enabled = ?, totp_last_step = ?,
+		created_at = ?, updated_at = ?, last_login_at = ?, expires_at = ?, version = version + 1 WHERE username = ? AND version = ?`,
+		user.Password, user.Enabled, user.FailedLogins, formatSQLiteTime(user.FirstFailedAt), formatSQLiteTime(user.LockedUntil), user.Lockouts,
+		user.ResetTokenHash, formatSQLiteTime(user.ResetExpiresAt), user.TOTPSecret, user.TOTPEnabled, user.TOTPLastStep,
+		formatSQLiteTime(user.CreatedAt), formatSQLiteTime(user.UpdatedAt), formatSQLiteTime(user.LastLoginAt), formatSQLiteTime(user.ExpiresAt), user.Username, user.Version)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return db.missingOrChanged(tx, user.Username)
+	}
+	if _, err = tx.Exec("DELETE FROM user_roles WHERE username = ?", user.Username); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM user_claims WHERE username = ?", user.Username); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM user_password_history WHERE username = ?", user.Username); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM user_recovery_codes WHERE username = ?", user.Username); err != nil {
+		return err
+	}
+	if err = db.writeUserRoles(tx, user); err != nil {
+		return err
+	}
+	if err = db.writeUserClaims(tx, user); err != nil {
+		return err
+	}
+	if err = db.writePasswordHistory(tx, user); err != nil {
+		return err
+	}
+	return db.writeRecoveryCodes(tx, user)
+}
+
+// LookupUserNamesByClaim returns, in username order, the users holding the claim key with the given value
+func (db *SQLiteDatabaseInteractor) LookupUserNamesByClaim(key string, value string) ([]string, error) {
+	names, err := db.lookupList("SELECT username FROM user_claims WHERE key = ? AND value = ? ORDER BY username", key, value)
+	if names == nil {
+		names = make([]string, 0)
+	}
+	return names, err
+}
+
+// QueryUsers runs the query as a single select - roles are followed through role_includes
+// by a recursive query, so users match on roles they hold indirectly too. A prefix is
+// looked up as a range of the primary key; a search looks at every name.
+func (db *SQLiteDatabaseInteractor) QueryUsers(query usecases.UserQuery) ([]entities.User, error) {
+	where := []string{"instr(username, ?) > 0"}
+	args := []interface{}{query.Search}
+	if len(query.Prefix) > 0 {
+		where = append(where, "username >= ?")
+		args = append(args, query.Prefix)
+		if after, ok := prefixEnd(query.Prefix); ok {
+			where = append(where, "username < ?")
+			args = append(args, after)
+		}
+	}
+	if query.Enabled != nil {
+		where = append(where, "enabled = ?")
+		args = append(args, *query.Enabled)
+	}
+	for key, value := range query.Claims {
+		where = append(where, "EXISTS (SELECT 1 FROM user_claims c WHERE c.username = users.username AND c.key = ? AND c.value = ?)")
+		args = append(args, key, value)
+	}
+	for _, role := range query.Roles {
+		where = append(where, `EXISTS (WITH RECURSIVE held(role) AS (
+				SELECT role FROM user_roles r WHERE r.username = users.username
+				UNION SELECT i.includes FROM role_includes i JOIN held ON i.role = held.role)
+			SELECT 1 FROM held WHERE held.role = ?)`)
+		args = append(args, role)
+	}
+	if !query.InactiveSince.IsZero() {
+		where = append(where, "(last_login_at = '' OR julianday(last_login_at) < julianday(?))")
+		args = append(args, formatSQLiteTime(query.InactiveSince))
+	}
+
+	names, err := db.lookupList("SELECT username FROM users WHERE "+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+	return db.LookupUsersByName(names)
+}
+
+// The first string after every one starting with prefix, so a prefix can be searched for
+// as a range of the primary key. There is none if prefix is all 0xff bytes.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return "", false
+	}
+	end[len(end)-1]++
+	return string(end), true
+}
+
+func (db *SQLiteDatabaseInteractor) DeleteUser(user string, version int64) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Role membership goes with the user via the cascade
+	result, err := tx.Exec("DELETE FROM users WHERE username = ? AND (? = 0 OR version = ?)", user, version, version)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return db.missingOrChanged(tx, user)
+	}
+	return tx.Commit()
+}
+
+// Why a change to a user matched no rows - it is not there, or not at the version given
+func (db *SQLiteDatabaseInteractor) missingOrChanged(tx *sql.Tx, username string) error {
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return usecases.ErrVersionConflict
+	}
+	return errors.New("User Does Not Exists")
+}
+
+func (db *SQLiteDatabaseInteractor) LookupRoleNames() ([]string, error) {
+	rows, err := db.db.Query("SELECT name FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		roles = append(roles, name)
+	}
+	return roles, rows.Err()
+}
+
+func (db *SQLiteDatabaseInteractor) LookupRoleByName(name string) (entities.Role, error) {
+	role := entities.Role{}
+	var created string
+	err := db.db.QueryRow("SELECT name, description, created_at FROM roles WHERE name = ?", name).Scan(&role.Name, &role.Description, &created)
+	if err == sql.ErrNoRows {
+		return entities.Role{}, errors.New("Unknown role")
+	} else if err != nil {
+		return entities.Role{}, err
+	}
+	role.CreatedAt = parseSQLiteTime(created)
+
+	role.Permissions, err = db.lookupList("SELECT permission FROM role_permissions WHERE role = ? ORDER BY position", name)
+	if err != nil {
+		return entities.Role{}, err
+	}
+	role.Includes, err = db.lookupList("SELECT includes FROM role_includes WHERE role = ? ORDER BY position", name)
+	if err != nil {
+		return entities.Role{}, err
+	}
+	return role, nil
+}
+
+func (db *SQLiteDatabaseInteractor) CreateRole(role entities.Role) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM roles WHERE name = ?", role.Name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return errors.New("Role exists")
+	}
+	_, err = tx.Exec("INSERT INTO roles (name, description, created_at) VALUES (?, ?, ?)", role.Name, role.Description, formatSQLiteTime(role.CreatedAt))
+	if err != nil {
+		return err
+	}
+	if err = db.writeRoleLists(tx, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDatabaseInteractor) UpdateRole(role entities.Role) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE roles SET description = ?, created_at = ? WHERE name = ?", role.Description, formatSQLiteTime(role.CreatedAt), role.Name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("Role Does Not Exists")
+	}
+	if _, err = tx.Exec("DELETE FROM role_permissions WHERE role = ?", role.Name); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM role_includes WHERE role = ?", role.Name); err != nil {
+		return err
+	}
+	if err = db.writeRoleLists(tx, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteDatabaseInteractor) DeleteRole(name string) error {
+	result, err := db.db.Exec("DELETE FROM roles WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("Role Does Not Exists")
+	}
+	return nil
+}
+
+// Applies any migrations the database has not yet seen
+func (db *SQLiteDatabaseInteractor) migrate() error {
+	var version int
+	if err := db.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		db.registry.Logger.Log("INFO", fmt.Sprintf("Upgrading SQLite schema to version %v", i+1))
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqliteMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("schema version %v: %v", i+1, err)
+		}
+		// Pragmas cannot take parameters
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Something which can run a query - either the database or a transaction
+type sqliteQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (db *SQLiteDatabaseInteractor) lookupUserRoles(q sqliteQueryer, username string) ([]string, error) {
+	rows, err := q.Query("SELECT role FROM user_roles WHERE username = ? ORDER BY position", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err = rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (db *SQLiteDatabaseInteractor) writeUserRoles(tx *sql.Tx, user entities.User) error {
+	for position, role := range user.Roles {
+		if len(role) == 0 {
+			continue
+		}
+		_, err := tx.Exec("INSERT OR IGNORE INTO user_roles (username, role, position) VALUES (?, ?, ?)", user.Username, role, position)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDatabaseInteractor) lookupUserClaims(username string) (map[string]string, error) {
+	rows, err := db.db.Query("SELECT key, value FROM user_claims WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claims map[string]string
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		if claims == nil {
+			claims = make(map[string]string)
+		}
+		claims[key] = value
+	}
+	return claims, rows.Err()
+}
+
+func (db *SQLiteDatabaseInteractor) writeUserClaims(tx *sql.Tx, user entities.User) error {
+	for key, value := range user.Claims {
+		_, err := tx.Exec("INSERT INTO user_claims (username, key, value) VALUES (?, ?, ?)", user.Username, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDatabaseInteractor) writePasswordHistory(tx *sql.Tx, user entities.User) error {
+	for position, hash := range user.PasswordHistory {
+		_, err := tx.Exec("INSERT INTO user_password_history (username, position, hash) VALUES (?, ?, ?)", user.Username, position, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDatabaseInteractor) writeRecoveryCodes(tx *sql.Tx, user entities.User) error {
+	for _, hash := range user.RecoveryCodes {
+		_, err := tx.Exec("INSERT OR IGNORE INTO user_recovery_codes (username, hash) VALUES (?, ?)", user.Username, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDatabaseInteractor) writeRoleLists(tx *sql.Tx, role entities.Role) error {
+	for position, permission := range role.Permissions {
+		_, err := tx.Exec("INSERT OR IGNORE INTO role_permissions (role, permission, position) VALUES (?, ?, ?)", role.Name, permission, position)
+		if err != nil {
+			return err
+		}
+	}
+	for position, included := range role.Includes {
+		_, err := tx.Exec("INSERT OR IGNORE INTO role_includes (role, includes, position) VALUES (?, ?, ?)", role.Name, included, position)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A single row or one of many
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Reads the sqliteUserColumns of a row
+func scanSQLiteUser(row sqliteScanner) (entities.User, error) {
+	user := entities.User{}
+	var firstFailedAt, lockedUntil, resetExpiresAt, createdAt, updatedAt, lastLoginAt, expiresAt string
+	err := row.Scan(&user.Username, &user.Password, &user.Enabled, &user.FailedLogins, &firstFailedAt, &lockedUntil, &user.Lockouts,
+		&user.ResetTokenHash, &resetExpiresAt, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep,
+		&createdAt, &updatedAt, &lastLoginAt, &expiresAt, &user.Version)
+	if err != nil {
+		return entities.User{}, err
+	}
+	user.FirstFailedAt = parseSQLiteTime(firstFailedAt)
+	user.LockedUntil = parseSQLiteTime(lockedUntil)
+	user.ResetExpiresAt = parseSQLiteTime(resetExpiresAt)
+	user.CreatedAt = parseSQLiteTime(createdAt)
+	user.UpdatedAt = parseSQLiteTime(updatedAt)
+	user.LastLoginAt = parseSQLiteTime(lastLoginAt)
+	user.ExpiresAt = parseSQLiteTime(expiresAt)
+	return user, nil
+}
+
+// Runs a query calling read for each row
+func eachSQLiteRow(q sqliteQueryer, query string, args []interface{}, read func(rows *sql.Rows) error) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = read(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Runs a query returning a single column of strings
+func (db *SQLiteDatabaseInteractor) lookupList(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err = rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Times are held as RFC3339 text - empty for 'not set'
+func formatSQLiteTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseSQLiteTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, value)
+	return t
+}
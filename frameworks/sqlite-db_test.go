@@ -0,0 +1,269 @@
+package frameworks
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"github.com/riomhaire/lightauthuserapi/test"
+	"github.com/riomhaire/lightauthuserapi/usecases"
+)
+
+// Opens a new database in a temporary directory
+func createSQLiteTestDatabase(t *testing.T) (*SQLiteDatabaseInteractor, string) {
+	filename := filepath.Join(t.TempDir(), "users.db")
+	registry := usecases.Registry{Logger: test.NewStringLogger()}
+	db, err := NewSQLiteDatabaseInteractor(&registry, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, filename
+}
+
+func TestSQLiteWriteIsReadBack(t *testing.T) {
+	db, _ := createSQLiteTestDatabase(t)
+	db.CreateRole(entities.Role{Name: "AUDIT", Description: "Reads", Permissions: []string{"users:read"}})
+	db.CreateRole(entities.Role{Name: "ADMIN", Permissions: []string{"users:write", "roles:admin"}, Includes: []string{"AUDIT"}})
+	if err := db.CreateRole(entities.Role{Name: "ADMIN"}); err == nil {
+		t.Errorf("Expected a duplicate role to be refused")
+	}
+
+	user := entities.User{Username: "fred", Password: "hash", Enabled: true, Roles: []string{"ADMIN", "AUDIT"},
+		Claims: map[string]string{"tenant": "acme"}, PasswordHistory: []string{"old"}, Version: 1}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("Unexpected create error - %v", err)
+	}
+	if err := db.CreateUser(user); err == nil {
+		t.Errorf("Expected a duplicate user to be refused")
+	}
+
+	read, err := db.LookupUserByName("fred")
+	if err != nil || read.Password != "hash" || !read.Enabled || strings.Join(read.Roles, ",") != "ADMIN,AUDIT" ||
+		read.Claims["tenant"] != "acme" || len(read.PasswordHistory) != 1 || read.Version != 1 {
+		t.Errorf("Expected the user back as written - got %+v %v", read, err)
+	}
+
+	read.Roles = []string{"AUDIT"}
+	read.Claims = map[string]string{"tenant": "globex", "team": "blue"}
+	read.Enabled = false
+	if err = db.UpdateUser(read); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	if read, _ = db.LookupUserByName("fred"); strings.Join(read.Roles, ",") != "AUDIT" || len(read.Claims) != 2 || read.Enabled || read.Version != 2 {
+		t.Errorf("Expected the update at version 2 - got %+v", read)
+	}
+	if names, _ := db.LookupUserNamesByClaim("team", "blue"); len(names) != 1 {
+		t.Errorf("Expected to find fred by claim - got %v", names)
+	}
+
+	role, err := db.LookupRoleByName("ADMIN")
+	if err != nil || strings.Join(role.Permissions, ",") != "users:write,roles:admin" || strings.Join(role.Includes, ",") != "AUDIT" {
+		t.Errorf("Expected the role back as written - got %+v %v", role, err)
+	}
+	role.Permissions = []string{"users:write"}
+	role.Includes = nil
+	if err = db.UpdateRole(role); err != nil {
+		t.Fatalf("Unexpected role update error - %v", err)
+	}
+	if role, _ = db.LookupRoleByName("ADMIN"); len(role.Permissions) != 1 || len(role.Includes) != 0 {
+		t.Errorf("Expected the role update - got %+v", role)
+	}
+	if err = db.DeleteRole("ADMIN"); err != nil {
+		t.Errorf("Unexpected role delete error - %v", err)
+	}
+	if names, _ := db.LookupRoleNames(); len(names) != 1 || names[0] != "AUDIT" {
+		t.Errorf("Expected only AUDIT to be left - got %v", names)
+	}
+
+	if err = db.DeleteUser("fred", 2); err != nil {
+		t.Fatalf("Unexpected delete error - %v", err)
+	}
+	if _, err = db.LookupUserByName("fred"); err == nil {
+		t.Errorf("Expected fred to be gone")
+	}
+	if names, _ := db.LookupUserNamesByClaim("team", "blue"); len(names) != 0 {
+		t.Errorf("Expected claims to go with the user - got %v", names)
+	}
+}
+
+func TestSQLiteMigratesFirstSchema(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "users.db")
+	raw, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		sqliteMigrations[0],
+		"PRAGMA user_version = 1",
+		"INSERT INTO users (username, password, enabled, claim1, claim2) VALUES ('old', 'pwd', 1, 'c1', '')",
+		"INSERT INTO roles (name) VALUES ('TEST')",
+		"INSERT INTO user_roles (username, role) VALUES ('old', 'TEST')",
+	} {
+		if _, err = raw.Exec(statement); err != nil {
+			t.Fatalf("%v : %v", statement, err)
+		}
+	}
+	raw.Close()
+
+	registry := usecases.Registry{Logger: test.NewStringLogger()}
+	db, err := NewSQLiteDatabaseInteractor(&registry, filename)
+	if err != nil {
+		t.Fatalf("Unexpected migration error - %v", err)
+	}
+	defer db.Close()
+
+	var version int
+	db.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if version != len(sqliteMigrations) {
+		t.Errorf("Expected schema version %v - got %v", len(sqliteMigrations), version)
+	}
+	user, err := db.LookupUserByName("old")
+	if err != nil || user.Password != "pwd" || !user.Enabled || len(user.Roles) != 1 || user.Version != 1 {
+		t.Errorf("Expected the user to survive the upgrade - got %+v %v", user, err)
+	}
+	if len(user.Claims) != 1 || user.Claims["claim1"] != "c1" {
+		t.Errorf("Expected the fixed claims to become named claims - got %v", user.Claims)
+	}
+	if role, err := db.LookupRoleByName("TEST"); err != nil || role.Name != "TEST" {
+		t.Errorf("Expected the role to survive the upgrade - got %+v %v", role, err)
+	}
+}
+
+func TestSQLiteStaleVersionIsRefused(t *testing.T) {
+	db, _ := createSQLiteTestDatabase(t)
+	db.CreateUser(entities.User{Username: "fred", Password: "pwd", Version: 1})
+
+	first, _ := db.LookupUserByName("fred")
+	second := first
+	first.Enabled = true
+	if err := db.UpdateUser(first); err != nil {
+		t.Fatalf("Unexpected update error - %v", err)
+	}
+	if err := db.UpdateUser(second); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale update to be refused - got %v", err)
+	}
+	if err := db.DeleteUser("fred", 1); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected stale delete to be refused - got %v", err)
+	}
+	if err := db.UpdateUser(entities.User{Username: "nobody", Version: 1}); err == nil || err == usecases.ErrVersionConflict {
+		t.Errorf("Expected a missing user to be reported as missing - got %v", err)
+	}
+	if user, _ := db.LookupUserByName("fred"); user.Version != 2 || !user.Enabled {
+		t.Errorf("Expected the first update at version 2 - got %+v", user)
+	}
+}
+
+func TestSQLiteReadThenWriteIsNotLockedOut(t *testing.T) {
+	db, _ := createSQLiteTestDatabase(t)
+
+	// A transaction which reads before it writes, as CreateUser and RenameUser do
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var exists int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", "first").Scan(&exists); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer comes along - it has to wait rather than leave the first unable to write
+	other := make(chan error)
+	go func() { other <- db.CreateUser(entities.User{Username: "second", Version: 1}) }()
+	time.Sleep(100 * time.Millisecond)
+	if _, err = tx.Exec("INSERT INTO users (username, version) VALUES (?, 1)", "first"); err != nil {
+		t.Errorf("Expected the first writer to keep its lock - got %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Errorf("Unexpected commit error - %v", err)
+	}
+	if err = <-other; err != nil {
+		t.Errorf("Expected the second writer to go once the first was done - got %v", err)
+	}
+	if count, _ := db.CountUserNames(""); count != 2 {
+		t.Errorf("Expected both users - got %v", count)
+	}
+}
+
+func TestSQLiteRenameCarriesRolesAndClaims(t *testing.T) {
+	db, _ := createSQLiteTestDatabase(t)
+	db.CreateRole(entities.Role{Name: "TEST"})
+	db.CreateUser(entities.User{Username: "first", Roles: []string{"TEST"}, Claims: map[string]string{"tenant": "acme"}, Version: 1})
+	db.CreateUser(entities.User{Username: "second", Version: 1})
+
+	user, _ := db.LookupUserByName("first")
+	user.Username = "second"
+	if err := db.RenameUser("first", user); err != usecases.ErrUserExists {
+		t.Errorf("Expected rename onto an existing user to be refused - got %v", err)
+	}
+	user.Username = "renamed"
+	stale := user
+	stale.Version = 7
+	if err := db.RenameUser("first", stale); err != usecases.ErrVersionConflict {
+		t.Errorf("Expected a stale rename to be refused - got %v", err)
+	}
+	if err := db.RenameUser("first", user); err != nil {
+		t.Fatalf("Unexpected rename error - %v", err)
+	}
+
+	if _, err := db.LookupUserByName("first"); err == nil {
+		t.Errorf("Expected old name to be gone")
+	}
+	renamed, err := db.LookupUserByName("renamed")
+	if err != nil || renamed.Version != 2 || strings.Join(renamed.Roles, ",") != "TEST" || renamed.Claims["tenant"] != "acme" {
+		t.Errorf("Expected roles and claims to follow the rename - got %+v %v", renamed, err)
+	}
+	if names, _ := db.LookupUserNamesByClaim("tenant", "acme"); len(names) != 1 || names[0] != "renamed" {
+		t.Errorf("Expected claims to be found under the new name - got %v", names)
+	}
+}
+
+func TestSQLitePagingAndQueries(t *testing.T) {
+	db, _ := createSQLiteTestDatabase(t)
+	db.CreateRole(entities.Role{Name: "AUDIT"})
+	db.CreateRole(entities.Role{Name: "ADMIN", Includes: []string{"AUDIT"}})
+	db.CreateUser(entities.User{Username: "a1", Enabled: true, Roles: []string{"ADMIN"}, Claims: map[string]string{"tenant": "acme"}, Version: 1})
+	db.CreateUser(entities.User{Username: "a2", Enabled: false, Roles: []string{"AUDIT"}, Claims: map[string]string{"tenant": "acme"}, Version: 1})
+	db.CreateUser(entities.User{Username: "a3", Enabled: true, Version: 1})
+	db.CreateUser(entities.User{Username: "b1", Enabled: true, Roles: []string{"AUDIT"}, Version: 1})
+
+	if names, _ := db.LookupUserNames("a", 2, 2); len(names) != 1 || names[0] != "a3" {
+		t.Errorf("Expected second page of a's - got %v", names)
+	}
+	if names, _ := db.LookupUserNamesAfter("", "a2", 2); len(names) != 2 || names[0] != "a3" || names[1] != "b1" {
+		t.Errorf("Expected names after a2 - got %v", names)
+	}
+	if count, _ := db.CountUserNames("a"); count != 3 {
+		t.Errorf("Expected 3 a's - got %v", count)
+	}
+
+	usernames := func(users []entities.User) string {
+		names := make([]string, len(users))
+		for i, user := range users {
+			names[i] = user.Username
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	enabled := true
+	for expected, query := range map[string]usecases.UserQuery{
+		"a1,a2,b1": {Roles: []string{"AUDIT"}},
+		"a1,b1":    {Roles: []string{"AUDIT"}, Enabled: &enabled},
+		"a1,a2":    {Claims: map[string]string{"tenant": "acme"}},
+		"a1":       {Prefix: "a", Roles: []string{"ADMIN"}},
+		"b1":       {Search: "1", Prefix: "b"},
+		"a3":       {Prefix: "a3"},
+		"":         {Prefix: "a4"},
+	} {
+		users, err := db.QueryUsers(query)
+		if err != nil || usernames(users) != expected {
+			t.Errorf("Expected %v from %+v - got %v %v", expected, query, usernames(users), err)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package test
 
 import (
 	"errors"
+	"sort"
+	"strings"
 
 	"github.com/riomhaire/lightauthuserapi/entities"
 	"github.com/riomhaire/lightauthuserapi/usecases"
@@ -31,6 +33,16 @@ func (db *InMemoryDBInteractor) LookupUserByName(username string) (entities.User
 	}
 }
 
+func (db *InMemoryDBInteractor) LookupUsersByName(usernames []string) ([]entities.User, error) {
+	users := make([]entities.User, 0, len(usernames))
+	for _, name := range usernames {
+		if user, ok := db.userdb[name]; ok {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
 func (db *InMemoryDBInteractor) CreateUser(user entities.User) error {
 	if _, ok := db.userdb[user.Username]; ok {
 		return errors.New("User exists")
@@ -40,16 +52,63 @@ func (db *InMemoryDBInteractor) CreateUser(user entities.User) error {
 }
 
 func (db *InMemoryDBInteractor) LookupUserNames(search string, page int, pageSize int) ([]string, error) {
-	var s []string
+	s := db.matchingNames(search)
+	if pageSize > 0 {
+		start := 0
+		if page > 1 {
+			start = min((page-1)*pageSize, len(s))
+		}
+		s = s[start:min(start+pageSize, len(s))]
+	}
+	return s, nil
+}
+
+func (db *InMemoryDBInteractor) LookupUserNamesAfter(search string, after string, limit int) ([]string, error) {
+	s := make([]string, 0)
+	for _, k := range db.matchingNames(search) {
+		if limit >= 0 && len(s) >= limit {
+			break
+		}
+		if k > after {
+			s = append(s, k)
+		}
+	}
+	return s, nil
+}
+
+func (db *InMemoryDBInteractor) CountUserNames(search string) (int, error) {
+	return len(db.matchingNames(search)), nil
+}
+
+// Usernames containing search in order
+func (db *InMemoryDBInteractor) matchingNames(search string) []string {
+	s := make([]string, 0)
 	for k := range db.userdb {
-		s = append(s, k)
+		if strings.Contains(k, search) {
+			s = append(s, k)
+		}
 	}
+	sort.Strings(s)
+	return s
+}
 
+func (db *InMemoryDBInteractor) LookupUserNamesByClaim(key string, value string) ([]string, error) {
+	var s []string
+	for k, u := range db.userdb {
+		if claim, ok := u.Claims[key]; ok && claim == value {
+			s = append(s, k)
+		}
+	}
+	sort.Strings(s)
 	return s, nil
 }
 
 func (db *InMemoryDBInteractor) UpdateUser(user entities.User) error {
-	if _, ok := db.userdb[user.Username]; ok {
+	if existing, ok := db.userdb[user.Username]; ok {
+		if existing.Version != user.Version {
+			return usecases.ErrVersionConflict
+		}
+		user.Version++
 		db.userdb[user.Username] = user
 	} else {
 		return errors.New("User Does Not Exists")
@@ -57,8 +116,11 @@ func (db *InMemoryDBInteractor) UpdateUser(user entities.User) error {
 	return nil
 }
 
-func (db *InMemoryDBInteractor) DeleteUser(user string) error {
-	if _, ok := db.userdb[user]; ok {
+func (db *InMemoryDBInteractor) DeleteUser(user string, version int64) error {
+	if existing, ok := db.userdb[user]; ok {
+		if version != 0 && existing.Version != version {
+			return usecases.ErrVersionConflict
+		}
 		delete(db.userdb, user)
 	} else {
 		return errors.New("User Does Not Exists")
@@ -66,6 +128,23 @@ func (db *InMemoryDBInteractor) DeleteUser(user string) error {
 	return nil
 }
 
+func (db *InMemoryDBInteractor) RenameUser(from string, user entities.User) error {
+	existing, ok := db.userdb[from]
+	if !ok {
+		return errors.New("User Does Not Exists")
+	}
+	if existing.Version != user.Version {
+		return usecases.ErrVersionConflict
+	}
+	if _, ok = db.userdb[user.Username]; ok {
+		return usecases.ErrUserExists
+	}
+	user.Version++
+	delete(db.userdb, from)
+	db.userdb[user.Username] = user
+	return nil
+}
+
 func (db *InMemoryDBInteractor) LookupRoleNames() ([]string, error) {
 	var roles []string
 	for _, r := range db.roledb {
@@ -73,3 +152,40 @@ func (db *InMemoryDBInteractor) LookupRoleNames() ([]string, error) {
 	}
 	return roles, nil
 }
+
+func (db *InMemoryDBInteractor) LookupRoleByName(name string) (entities.Role, error) {
+	for _, r := range db.roledb {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return entities.Role{}, errors.New("Unknown role")
+}
+
+func (db *InMemoryDBInteractor) CreateRole(role entities.Role) error {
+	if _, err := db.LookupRoleByName(role.Name); err == nil {
+		return errors.New("Role exists")
+	}
+	db.roledb = append(db.roledb, role)
+	return nil
+}
+
+func (db *InMemoryDBInteractor) UpdateRole(role entities.Role) error {
+	for i, r := range db.roledb {
+		if r.Name == role.Name {
+			db.roledb[i] = role
+			return nil
+		}
+	}
+	return errors.New("Role Does Not Exists")
+}
+
+func (db *InMemoryDBInteractor) DeleteRole(name string) error {
+	for i, r := range db.roledb {
+		if r.Name == name {
+			db.roledb = append(db.roledb[:i], db.roledb[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Role Does Not Exists")
+}
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"errors"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// Api keys held in memory for test purposes
+type InMemoryAPIKeyStore struct {
+	keys []entities.APIKey
+}
+
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{keys: make([]entities.APIKey, 0)}
+}
+
+func (store *InMemoryAPIKeyStore) LookupAPIKey(id string) (entities.APIKey, error) {
+	for _, key := range store.keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return entities.APIKey{}, errors.New("Unknown key")
+}
+
+func (store *InMemoryAPIKeyStore) LookupAPIKeys() ([]entities.APIKey, error) {
+	return append([]entities.APIKey{}, store.keys...), nil
+}
+
+func (store *InMemoryAPIKeyStore) CreateAPIKey(key entities.APIKey) error {
+	store.keys = append(store.keys, key)
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) DeleteAPIKey(id string) error {
+	for i, key := range store.keys {
+		if key.ID == id {
+			store.keys = append(store.keys[:i], store.keys[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Unknown key")
+}
@@ -0,0 +1,200 @@
+package usecases
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// What an api key can be allowed to do
+const (
+	ScopeUsersRead    = "users:read"         // Read and list users
+	ScopeUsersWrite   = "users:write"        // Create, change and delete users - and their locks, resets and second factors
+	ScopeAuthenticate = "users:authenticate" // Check passwords, change them given the current one and complete resets
+	ScopeRolesRead    = "roles:read"         // Read and list roles
+	ScopeRolesAdmin   = "roles:admin"        // Create, change and delete roles
+	ScopeKeysAdmin    = "keys:admin"         // Mint, list and revoke api keys
+	ScopeStoreAdmin   = "store:admin"        // Reload the store
+)
+
+// Scopes lists every scope there is
+var Scopes = []string{ScopeUsersRead, ScopeUsersWrite, ScopeAuthenticate, ScopeRolesRead, ScopeRolesAdmin, ScopeKeysAdmin, ScopeStoreAdmin}
+
+// Name the shared configured key goes by
+const sharedKeyName = "shared key"
+
+// Minted keys look like la_<id>.<secret>
+const apiKeyPrefix = "la_"
+
+// MintedAPIKey is a newly made key - this is the only time Key is ever seen
+type MintedAPIKey struct {
+	entities.APIKey
+	Key string `json:"key"`
+}
+
+// HasScope says whether the key may do what scope allows
+func HasScope(key entities.APIKey, scope string) bool {
+	for _, held := range key.Scopes {
+		if held == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticateAPIKey finds the key a caller presented. The shared key from the
+// configuration holds every scope. Unknown, wrong and expired keys all give the same error.
+func (usecases *Usecases) AuthenticateAPIKey(presented string) (entities.APIKey, LightAuthError) {
+	failed := NewError(NotAuthorized, errors.New("Not Authorized"))
+	if len(presented) == 0 {
+		return entities.APIKey{}, failed
+	}
+	shared := usecases.Registry.Configuration.APIKey
+	if len(shared) > 0 && subtle.ConstantTimeCompare([]byte(shared), []byte(presented)) == 1 {
+		return entities.APIKey{Name: sharedKeyName, Scopes: Scopes}, NewError(NoError, nil)
+	}
+
+	store := usecases.Registry.APIKeyStore
+	id, _, ok := strings.Cut(strings.TrimPrefix(presented, apiKeyPrefix), ".")
+	if store == nil || !ok || !strings.HasPrefix(presented, apiKeyPrefix) {
+		return entities.APIKey{}, failed
+	}
+	key, err := store.LookupAPIKey(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(presented))) != 1 {
+		return entities.APIKey{}, failed
+	}
+	if !key.ExpiresAt.IsZero() && !usecases.now().Before(key.ExpiresAt) {
+		usecases.Registry.Logger.Log("WARN", fmt.Sprintf("Expired api key %v (%v) used", key.ID, key.Name))
+		return entities.APIKey{}, failed
+	}
+	return key, NewError(NoError, nil)
+}
+
+// CreateAPIKey mints a key with the scopes given which expires at expiresAt, or after lifetime
+// when that is set. A key cannot be given a scope its creator does not hold, so keys can
+// never be used to gain more than their maker has.
+func (usecases *Usecases) CreateAPIKey(name string, scopes []string, expiresAt time.Time, lifetime time.Duration, creator entities.APIKey) (MintedAPIKey, LightAuthError) {
+	store := usecases.Registry.APIKeyStore
+	if store == nil {
+		return MintedAPIKey{}, NewError(NotImplemented, errors.New("No api key store"))
+	}
+	now := usecases.now()
+	if lifetime > 0 {
+		expiresAt = now.Add(lifetime)
+	}
+	violations := make([]Violation, 0)
+	if len(strings.TrimSpace(name)) == 0 {
+		violations = append(violations, Violation{Field: "name", Message: "A key needs a name"})
+	}
+	if len(scopes) == 0 {
+		violations = append(violations, Violation{Field: "scopes", Message: "A key needs at least one scope"})
+	}
+	for _, scope := range scopes {
+		if !HasScope(entities.APIKey{Scopes: Scopes}, scope) {
+			violations = append(violations, Violation{Field: "scopes", Message: fmt.Sprintf("Unknown scope '%v'", scope)})
+		}
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		violations = append(violations, Violation{Field: "expiresAt", Message: "A key must expire in the future"})
+	}
+	if len(violations) > 0 {
+		return MintedAPIKey{}, NewValidationError(violations)
+	}
+	for _, scope := range scopes {
+		if !HasScope(creator, scope) {
+			return MintedAPIKey{}, NewError(Forbidden, fmt.Errorf("Cannot give a key the %v scope without holding it", scope))
+		}
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return MintedAPIKey{}, NewError(InternalError, err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return MintedAPIKey{}, NewError(InternalError, err)
+	}
+	minted := MintedAPIKey{APIKey: entities.APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Scopes:    scopes,
+		CreatedBy: keyDescription(creator),
+		CreatedAt: now.UTC().Truncate(time.Second),
+		ExpiresAt: expiresAt.UTC().Truncate(time.Second),
+	}}
+	minted.Key = apiKeyPrefix + minted.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	minted.Hash = hashAPIKey(minted.Key)
+	if err := store.CreateAPIKey(minted.APIKey); err != nil {
+		return MintedAPIKey{}, NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Api key %v (%v) created by %v with scopes %v", minted.ID, name, minted.CreatedBy, strings.Join(scopes, ", ")))
+	return minted, NewError(NoError, nil)
+}
+
+// ListAPIKeys returns every minted key - without their hashes
+func (usecases *Usecases) ListAPIKeys() ([]entities.APIKey, LightAuthError) {
+	store := usecases.Registry.APIKeyStore
+	if store == nil {
+		return nil, NewError(NotImplemented, errors.New("No api key store"))
+	}
+	keys, err := store.LookupAPIKeys()
+	if err != nil {
+		return nil, NewError(InternalError, err)
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	return keys, NewError(NoError, nil)
+}
+
+// ReadAPIKey returns a minted key - without its hash
+func (usecases *Usecases) ReadAPIKey(id string) (entities.APIKey, LightAuthError) {
+	store := usecases.Registry.APIKeyStore
+	if store == nil {
+		return entities.APIKey{}, NewError(NotImplemented, errors.New("No api key store"))
+	}
+	key, err := store.LookupAPIKey(id)
+	if err != nil {
+		return entities.APIKey{}, NewError(Unknown, errors.New("No Such Key"))
+	}
+	key.Hash = ""
+	return key, NewError(NoError, nil)
+}
+
+// RevokeAPIKey deletes a key - it stops working straight away
+func (usecases *Usecases) RevokeAPIKey(id string, revoker entities.APIKey) LightAuthError {
+	store := usecases.Registry.APIKeyStore
+	if store == nil {
+		return NewError(NotImplemented, errors.New("No api key store"))
+	}
+	key, err := store.LookupAPIKey(id)
+	if err != nil {
+		return NewError(Unknown, errors.New("No Such Key"))
+	}
+	if err = store.DeleteAPIKey(id); err != nil {
+		return NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Api key %v (%v) revoked by %v", key.ID, key.Name, keyDescription(revoker)))
+	return NewError(NoError, nil)
+}
+
+// How a key is named in logs and createdBy
+func keyDescription(key entities.APIKey) string {
+	if len(key.ID) == 0 {
+		return key.Name
+	}
+	return fmt.Sprintf("%v (%v)", key.Name, key.ID)
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// Authenticate checks a username and password, returning the user (without its password)
+// if they match and the user is enabled and not expired. Every failure gives the same error, and an unknown
+// user costs as much as a wrong password, so callers cannot tell which users exist.
+// Users with a second factor must use AuthenticateWithCode.
+func (usecases *Usecases) Authenticate(username, password string) (entities.User, LightAuthError) {
+	return usecases.AuthenticateWithCode(username, password, "")
+}
+
+// AuthenticateWithCode is Authenticate along with a TOTP or recovery code for users who
+// have enrolled one. A good password without a code gives NotAuthorized with a violation
+// saying the code is needed so callers know to ask for it.
+func (usecases *Usecases) AuthenticateWithCode(username, password, code string) (entities.User, LightAuthError) {
+	failed := NewError(NotAuthorized, errors.New("Invalid credentials"))
+
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		// Spend the same effort as checking a real password
+		usecases.hashPassword(password)
+		return entities.User{}, failed
+	}
+	now := usecases.now()
+	if isLocked(user, now) {
+		// Locked users are refused whatever the password - but it still costs the same
+		usecases.hashPassword(password)
+		usecases.Registry.Logger.Log("WARN", fmt.Sprintf("Login refused for %v - locked until %v", username, user.LockedUntil.Format(time.RFC3339)))
+		return entities.User{}, failed
+	}
+	if !usecases.checkPassword(user, password) {
+		usecases.recordFailedLogin(user, now)
+		return entities.User{}, failed
+	}
+	if !user.Enabled || isExpired(user, now) {
+		return entities.User{}, failed
+	}
+
+	// checkPassword may have upgraded the hash so work from what is stored now
+	if current, err := usecases.Registry.StorageInteractor.LookupUserByName(username); err == nil {
+		user = current
+	}
+	if user.TOTPEnabled {
+		if len(code) == 0 {
+			return entities.User{}, LightAuthError{Code: NotAuthorized, Error: errors.New("One time code required"),
+				Violations: []Violation{{Field: "code", Message: "A one time code is required"}}}
+		}
+		var ok bool
+		if user, ok = usecases.checkSecondFactor(user, code); !ok {
+			usecases.recordFailedLogin(user, now)
+			return entities.User{}, failed
+		}
+	}
+	user = usecases.recordLogin(user, now)
+	user.Password = ""
+	return user, NewError(NoError, nil)
+}
+
+// Removes the password hash from users being returned if so configured
+func (usecases *Usecases) redact(user entities.User) entities.User {
+	if usecases.Registry.Configuration.HidePasswords {
+		user.Password = ""
+	}
+	return user
+}
@@ -0,0 +1,67 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// AuthenticateCaller finds who presented a bearer token - an api key, or failing that a
+// token one of the registry's authenticators accepts. Token callers get the scopes their
+// roles' permissions name.
+func (usecases *Usecases) AuthenticateCaller(presented string) (entities.APIKey, LightAuthError) {
+	key, lerror := usecases.AuthenticateAPIKey(presented)
+	if lerror.Code == NoError || len(presented) == 0 {
+		return key, lerror
+	}
+	for _, authenticator := range usecases.Registry.Authenticators {
+		subject, roles, ok, err := authenticator.AuthenticateToken(presented)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			usecases.Registry.Logger.Log("WARN", fmt.Sprintf("Token refused : %v", err))
+			return entities.APIKey{}, NewError(NotAuthorized, errors.New("Not Authorized"))
+		}
+		scopes, err := usecases.ScopesForRoles(roles)
+		if err != nil {
+			return entities.APIKey{}, NewError(InternalError, err)
+		}
+		return entities.APIKey{Name: fmt.Sprintf("token for %v", subject), Scopes: scopes}, NewError(NoError, nil)
+	}
+	return key, lerror
+}
+
+// AuthorizeCaller is AuthenticateCaller for a caller who needs scope
+func (usecases *Usecases) AuthorizeCaller(presented string, scope string) (entities.APIKey, LightAuthError) {
+	caller, lerror := usecases.AuthenticateCaller(presented)
+	if lerror.Code == NoError && !HasScope(caller, scope) {
+		return caller, NewError(Forbidden, fmt.Errorf("Caller does not have the %v scope", scope))
+	}
+	return caller, lerror
+}
+
+// ScopesForRoles returns the scopes named by the permissions of the given roles and
+// everything they include. Unknown roles and permissions which are not scopes give nothing.
+func (usecases *Usecases) ScopesForRoles(roles []string) ([]string, error) {
+	expanded, err := usecases.ExpandRoles(roles)
+	if err != nil {
+		return nil, err
+	}
+	held := entities.APIKey{}
+	for _, name := range expanded {
+		role, err := usecases.Registry.StorageInteractor.LookupRoleByName(name)
+		if err != nil {
+			continue
+		}
+		held.Scopes = append(held.Scopes, role.Permissions...)
+	}
+	scopes := make([]string, 0)
+	for _, scope := range Scopes {
+		if HasScope(held, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
@@ -1,6 +1,12 @@
 package usecases
 
-import "github.com/riomhaire/lightauthuserapi/entities"
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
 
 const (
 	NoError        = 0
@@ -10,15 +16,40 @@ const (
 	Invalid        = 4
 	NotAuthorized  = 5
 	InternalError  = 6
+	InUse          = 7
+	VersionChanged = 8 // The user is not at the version the caller expected
+	Forbidden      = 9 // The caller is known but may not do this
+)
+
+// Errors stores return which callers act on
+var (
+	ErrVersionConflict = errors.New("User has been changed since it was read") // Not at the version given
+	ErrUserExists      = errors.New("User exists")
 )
 
 type LightAuthError struct {
-	Code  int
-	Error error
+	Code       int
+	Error      error
+	Violations []Violation // Why an Invalid request was refused - if known
+}
+
+// Violation is one reason a request was invalid
+type Violation struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
 }
 
 func NewError(code int, err error) LightAuthError {
-	return LightAuthError{code, err}
+	return LightAuthError{Code: code, Error: err}
+}
+
+// NewValidationError is an Invalid error listing everything which was wrong
+func NewValidationError(violations []Violation) LightAuthError {
+	messages := make([]string, 0, len(violations))
+	for _, v := range violations {
+		messages = append(messages, v.Message)
+	}
+	return LightAuthError{Code: Invalid, Error: errors.New(strings.Join(messages, "; ")), Violations: violations}
 }
 
 type Logger interface {
@@ -27,14 +58,72 @@ type Logger interface {
 
 type StorageInteractor interface {
 	LookupUserByName(username string) (entities.User, error)
+	// LookupUsersByName returns the users named, in the order given, in one read rather
+	// than one per user. Names which are not users are left out.
+	LookupUsersByName(usernames []string) ([]entities.User, error)
 	LookupUserNames(search string, page int, pageSize int) ([]string, error)
+	// LookupUserNamesAfter returns, in username order, up to limit usernames containing
+	// search which sort after the name given ("" for the first). A limit of -1 returns all.
+	LookupUserNamesAfter(search string, after string, limit int) ([]string, error)
+	CountUserNames(search string) (int, error)
+	LookupUserNamesByClaim(key string, value string) ([]string, error)
 	CreateUser(user entities.User) error
+	// UpdateUser stores user only if the stored copy is still at user.Version, and
+	// stores it at the next version - otherwise ErrVersionConflict. The check and
+	// write happen together so concurrent updates cannot both succeed.
 	UpdateUser(user entities.User) error
-	DeleteUser(user string) error
+	// DeleteUser is refused with ErrVersionConflict unless the user is at version -
+	// a version of 0 deletes whatever the version.
+	DeleteUser(user string, version int64) error
+	// RenameUser moves the user stored as from to user.Username, storing user in its place
+	// at the next version. As with UpdateUser from must be at user.Version, and the new
+	// name must be free (ErrUserExists) - the move is made in one step so nothing is
+	// ever stored under both names or neither.
+	RenameUser(from string, user entities.User) error
 
 	LookupRoleNames() ([]string, error)
+	LookupRoleByName(name string) (entities.Role, error)
+	CreateRole(role entities.Role) error
+	UpdateRole(role entities.Role) error
+	DeleteRole(name string) error
+}
+
+// Stores which can run a UserQuery themselves implement this - for the rest every user
+// is read and checked
+type UserQueryRunner interface {
+	// QueryUsers returns every user matching the query - in any order
+	QueryUsers(query UserQuery) ([]entities.User, error)
+}
+
+// Where api keys are kept - apart from users and roles so any store can be used with any key store
+type APIKeyStore interface {
+	LookupAPIKey(id string) (entities.APIKey, error)
+	LookupAPIKeys() ([]entities.APIKey, error) // In the order they were made
+	CreateAPIKey(key entities.APIKey) error
+	DeleteAPIKey(id string) error
+}
+
+// Recognises a kind of bearer token other than api keys - EG JWTs from LightAuth.
+// ok is false when the token is not of its kind so the next can be tried; err is why
+// a token of its kind was refused. The roles are those the token gives its subject.
+type TokenAuthenticator interface {
+	AuthenticateToken(token string) (subject string, roles []string, ok bool, err error)
+}
+
+// Stores backed by files which can be edited outside of the api implement this
+// so they can be told to re-read them.
+type ReloadableStorageInteractor interface {
+	Reload() error
 }
 
 type Usecases struct {
 	Registry *Registry
 }
+
+// The current time from the registry's clock
+func (usecases *Usecases) now() time.Time {
+	if usecases.Registry.Clock != nil {
+		return usecases.Registry.Clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,48 @@
+package usecases
+
+import (
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+func (usecases *Usecases) CreateRole(role entities.Role) (entities.Role, LightAuthError) {
+	if lerror := validateRole(role); lerror.Code != NoError {
+		return role, lerror
+	}
+	if lerror := usecases.checkIncludes(role); lerror.Code != NoError {
+		return role, lerror
+	}
+	// Role should not exist
+	lerror := NewError(NoError, nil)
+	_, err := usecases.Registry.StorageInteractor.LookupRoleByName(role.Name)
+
+	if err != nil {
+		role.CreatedAt = usecases.now().UTC().Truncate(time.Second)
+		err = usecases.Registry.StorageInteractor.CreateRole(role)
+		if err != nil {
+			lerror = NewError(InternalError, err)
+		}
+	} else {
+		lerror = NewError(AlreadyExists, nil)
+	}
+
+	return role, lerror
+}
+
+// Roles created on first use say so
+func newRole(name string) entities.Role {
+	return entities.Role{Name: name, Description: "Created automatically"}
+}
+
+// Role names end up in colon separated lists so cannot contain one
+func validateRole(role entities.Role) LightAuthError {
+	if len(strings.TrimSpace(role.Name)) == 0 {
+		return NewValidationError([]Violation{{Field: "name", Message: "Role name is required"}})
+	}
+	if strings.ContainsAny(role.Name, ":,\n") {
+		return NewValidationError([]Violation{{Field: "name", Message: "Role name cannot contain ':', ',' or new lines"}})
+	}
+	return NewError(NoError, nil)
+}
@@ -1,6 +1,8 @@
 package usecases
 
 import (
+	"time"
+
 	"github.com/riomhaire/lightauthuserapi/entities"
 )
 
@@ -10,6 +12,17 @@ func (usecases *Usecases) CreateUser(user entities.User) (entities.User, LightAu
 	_, err := usecases.Registry.StorageInteractor.LookupUserByName(user.Username)
 
 	if err != nil {
+		if lerror = usecases.checkRoles(user.Roles); lerror.Code != NoError {
+			return user, lerror
+		}
+		keepServerState(&user, entities.User{})
+		user.CreatedAt = usecases.now().UTC().Truncate(time.Second)
+		user.UpdatedAt = user.CreatedAt
+		user.Version = 1
+		// Passwords arrive in plaintext and are only ever stored hashed
+		if lerror = usecases.applyPassword(&user, entities.User{}); lerror.Code != NoError {
+			return user, lerror
+		}
 		err = usecases.Registry.StorageInteractor.CreateUser(user)
 		if err != nil {
 			lerror = NewError(InternalError, err)
@@ -18,6 +31,6 @@ func (usecases *Usecases) CreateUser(user entities.User) (entities.User, LightAu
 		lerror = NewError(AlreadyExists, nil)
 	}
 
-	return user, lerror
+	return usecases.redact(user), lerror
 
 }
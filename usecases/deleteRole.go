@@ -0,0 +1,128 @@
+package usecases
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// DeleteRole removes a role. If users still hold the role (or other roles include it)
+// it is refused unless force is set, in which case the role is first taken away from
+// those users and roles.
+func (usecases *Usecases) DeleteRole(name string, force bool) LightAuthError {
+	storage := usecases.Registry.StorageInteractor
+	if _, err := storage.LookupRoleByName(name); err != nil {
+		return NewError(Unknown, err)
+	}
+
+	holders, err := usecases.usersWithRole(name)
+	if err != nil {
+		return NewError(InternalError, err)
+	}
+	includers, err := usecases.rolesIncluding(name)
+	if err != nil {
+		return NewError(InternalError, err)
+	}
+	if (len(holders) > 0 || len(includers) > 0) && !force {
+		return NewError(InUse, fmt.Errorf("Role %v is held by %v users and included by %v roles", name, len(holders), len(includers)))
+	}
+	for _, role := range includers {
+		role.Includes = removeRole(role.Includes, name)
+		if err = storage.UpdateRole(role); err != nil {
+			return NewError(InternalError, err)
+		}
+		usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Removed role %v from role %v", name, role.Name))
+	}
+	for _, user := range holders {
+		if err = usecases.takeRoleFrom(user, name); err != nil {
+			return NewError(InternalError, fmt.Errorf("Role %v not deleted - could not take it from %v : %v", name, user.Username, err))
+		}
+		usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Removed role %v from %v", name, user.Username))
+	}
+
+	if err = storage.DeleteRole(name); err != nil {
+		return NewError(InternalError, err)
+	}
+	return NewError(NoError, nil)
+}
+
+// How often taking a role from a user is retried when another change to the user gets in first
+const roleRemovalAttempts = 20
+
+// Takes the role from the user, re-reading and trying again if the user is changed by
+// someone else first. A user who has gone or no longer holds the role needs nothing.
+func (usecases *Usecases) takeRoleFrom(user entities.User, name string) error {
+	storage := usecases.Registry.StorageInteractor
+	for attempt := 1; ; attempt++ {
+		roles := removeRole(user.Roles, name)
+		if len(roles) == len(user.Roles) {
+			return nil
+		}
+		user.Roles = roles
+		user.UpdatedAt = usecases.now().UTC().Truncate(time.Second)
+		err := storage.UpdateUser(user)
+		if err != ErrVersionConflict || attempt == roleRemovalAttempts {
+			return err
+		}
+		if user, err = storage.LookupUserByName(user.Username); err != nil {
+			return nil // Gone since we looked
+		}
+	}
+}
+
+// Finds everyone who has the role
+func (usecases *Usecases) usersWithRole(role string) ([]entities.User, error) {
+	storage := usecases.Registry.StorageInteractor
+	names, err := storage.LookupUserNames("", -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]entities.User, 0)
+	for _, name := range names {
+		user, err := storage.LookupUserByName(name)
+		if err != nil {
+			continue // Gone since we listed
+		}
+		for _, r := range user.Roles {
+			if r == role {
+				holders = append(holders, user)
+				break
+			}
+		}
+	}
+	return holders, nil
+}
+
+// Finds every role which includes the role
+func (usecases *Usecases) rolesIncluding(name string) ([]entities.Role, error) {
+	storage := usecases.Registry.StorageInteractor
+	names, err := storage.LookupRoleNames()
+	if err != nil {
+		return nil, err
+	}
+	includers := make([]entities.Role, 0)
+	for _, n := range names {
+		role, err := storage.LookupRoleByName(n)
+		if err != nil {
+			continue
+		}
+		for _, r := range role.Includes {
+			if r == name {
+				includers = append(includers, role)
+				break
+			}
+		}
+	}
+	return includers, nil
+}
+
+func removeRole(roles []string, role string) []string {
+	kept := make([]string, 0, len(roles))
+	for _, r := range roles {
+		if r != role {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
@@ -1,13 +1,16 @@
 package usecases
 
-func (usecases *Usecases) DeleteUser(user string) LightAuthError {
+// DeleteUser removes a user - if version is not 0 only while the user is still at that version
+func (usecases *Usecases) DeleteUser(user string, version int64) LightAuthError {
 	// Do some validation here before we save - IE User should not exist
 	lerror := NewError(NoError, nil)
 	_, err := usecases.Registry.StorageInteractor.LookupUserByName(user)
 
 	if err == nil {
-		err = usecases.Registry.StorageInteractor.DeleteUser(user)
-		if err != nil {
+		err = usecases.Registry.StorageInteractor.DeleteUser(user, version)
+		if err == ErrVersionConflict {
+			lerror = NewError(VersionChanged, err)
+		} else if err != nil {
 			lerror = NewError(InternalError, err)
 		}
 
@@ -0,0 +1,119 @@
+package usecases
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// EffectiveRoles returns every role a user holds - those given directly plus
+// everything they include, all the way down.
+func (usecases *Usecases) EffectiveRoles(username string) ([]string, LightAuthError) {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return nil, NewError(Unknown, err)
+	}
+	roles, err := usecases.ExpandRoles(user.Roles)
+	if err != nil {
+		return nil, NewError(InternalError, err)
+	}
+	return roles, NewError(NoError, nil)
+}
+
+// ExpandRoles returns the transitive closure of the given roles. The given roles come
+// first, in order, followed by those they imply.
+func (usecases *Usecases) ExpandRoles(roles []string) ([]string, error) {
+	hierarchy, err := usecases.roleHierarchy()
+	if err != nil {
+		return nil, err
+	}
+	return expandRoles(hierarchy, roles), nil
+}
+
+// The closure of roles over an already read hierarchy
+func expandRoles(hierarchy map[string][]string, roles []string) []string {
+	expanded := make([]string, 0, len(roles))
+	seen := make(map[string]bool)
+	queue := append([]string{}, roles...)
+	for len(queue) > 0 {
+		role := queue[0]
+		queue = queue[1:]
+		if len(role) == 0 || seen[role] {
+			continue
+		}
+		seen[role] = true
+		expanded = append(expanded, role)
+		queue = append(queue, hierarchy[role]...)
+	}
+	return expanded
+}
+
+// Role name -> the roles it includes
+func (usecases *Usecases) roleHierarchy() (map[string][]string, error) {
+	storage := usecases.Registry.StorageInteractor
+	names, err := storage.LookupRoleNames()
+	if err != nil {
+		return nil, err
+	}
+	hierarchy := make(map[string][]string, len(names))
+	for _, name := range names {
+		role, err := storage.LookupRoleByName(name)
+		if err != nil {
+			continue // Gone since we listed
+		}
+		hierarchy[name] = role.Includes
+	}
+	return hierarchy, nil
+}
+
+// checkIncludes makes sure everything a role includes exists and that saving it would
+// not make a role (eventually) include itself.
+func (usecases *Usecases) checkIncludes(role entities.Role) LightAuthError {
+	if len(role.Includes) == 0 {
+		return NewError(NoError, nil)
+	}
+	hierarchy, err := usecases.roleHierarchy()
+	if err != nil {
+		return NewError(InternalError, err)
+	}
+
+	violations := make([]Violation, 0)
+	for _, included := range role.Includes {
+		if _, ok := hierarchy[included]; !ok {
+			violations = append(violations, Violation{Field: "includes", Message: fmt.Sprintf("Unknown role '%v'", included)})
+		}
+	}
+	if len(violations) > 0 {
+		return NewValidationError(violations)
+	}
+
+	// As it would be once saved
+	hierarchy[role.Name] = role.Includes
+	if cycle := findCycle(hierarchy, role.Name); cycle != nil {
+		return NewValidationError([]Violation{{Field: "includes", Message: fmt.Sprintf("Roles would form a cycle %v", strings.Join(cycle, " -> "))}})
+	}
+	return NewError(NoError, nil)
+}
+
+// Depth first search from start looking for a way back to it. Returns the path if found.
+func findCycle(hierarchy map[string][]string, start string) []string {
+	visited := make(map[string]bool)
+	var walk func(path []string) []string
+	walk = func(path []string) []string {
+		for _, next := range hierarchy[path[len(path)-1]] {
+			if next == start {
+				return append(path, next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if cycle := walk(append(append([]string{}, path...), next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk([]string{start})
+}
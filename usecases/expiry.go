@@ -0,0 +1,39 @@
+package usecases
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+func isExpired(user entities.User, now time.Time) bool {
+	return !user.ExpiresAt.IsZero() && !now.Before(user.ExpiresAt)
+}
+
+// DisableExpiredUsers disables every enabled user whose expiry has passed, logging each,
+// and returns how many were disabled. Expired users cannot log in anyway - this makes
+// their state obvious to anyone reading them.
+func (usecases *Usecases) DisableExpiredUsers() (int, LightAuthError) {
+	names, err := usecases.Registry.StorageInteractor.LookupUserNames("", -1, -1)
+	if err != nil {
+		return 0, NewError(InternalError, err)
+	}
+	now := usecases.now()
+	disabled := 0
+	for _, name := range names {
+		user, err := usecases.Registry.StorageInteractor.LookupUserByName(name)
+		if err != nil || !user.Enabled || !isExpired(user, now) {
+			continue
+		}
+		user.Enabled = false
+		user.UpdatedAt = now.UTC().Truncate(time.Second)
+		if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+			usecases.Registry.Logger.Log("ERROR", fmt.Sprintf("Could not disable expired user %v : %v", name, err))
+			continue
+		}
+		usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Disabled %v which expired %v", name, user.ExpiresAt.Format(time.RFC3339)))
+		disabled++
+	}
+	return disabled, NewError(NoError, nil)
+}
@@ -0,0 +1,107 @@
+package usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// How much of each user a listing gives
+const (
+	ViewNames   = "names"   // Just the usernames - the default
+	ViewSummary = "summary" // Enough for a list of users - see summaryFields
+	ViewFull    = "full"    // Everything but the password
+)
+
+// Fields of the summary view
+var summaryFields = []string{"username", "enabled", "roles", "lastLoginAt", "expiresAt"}
+
+// ListUserViews is FindUsers giving the users themselves rather than their names. The view
+// picks which fields each has, or fields names them from any the api shows. Passwords are
+// never included. The page of users is read from the store in one go.
+func (usecases *Usecases) ListUserViews(query UserQuery, page int, pageSize int, cursor string, view string, fields []string) ([]map[string]json.RawMessage, UserPage, LightAuthError) {
+	selected, lerror := viewFields(view, fields)
+	if lerror.Code != NoError {
+		return nil, UserPage{}, lerror
+	}
+	result, lerror := usecases.FindUsers(query, page, pageSize, cursor)
+	if lerror.Code != NoError {
+		return nil, result, lerror
+	}
+	users, err := usecases.Registry.StorageInteractor.LookupUsersByName(result.Names)
+	if err != nil {
+		return nil, result, NewError(InternalError, err)
+	}
+
+	views := make([]map[string]json.RawMessage, 0, len(users))
+	for _, user := range users {
+		user.Password = ""
+		document, err := json.Marshal(user)
+		if err != nil {
+			return nil, result, NewError(InternalError, err)
+		}
+		all := make(map[string]json.RawMessage)
+		json.Unmarshal(document, &all)
+
+		view := make(map[string]json.RawMessage, len(selected))
+		for _, field := range selected {
+			if value, ok := all[field]; ok {
+				view[field] = value
+			}
+		}
+		views = append(views, view)
+	}
+	return views, result, NewError(NoError, nil)
+}
+
+// The fields to give for a view - fields given win over the view's own
+func viewFields(view string, fields []string) ([]string, LightAuthError) {
+	switch view {
+	case "", ViewFull:
+		if len(fields) == 0 {
+			return userFields(), NewError(NoError, nil)
+		}
+	case ViewSummary:
+		if len(fields) == 0 {
+			return summaryFields, NewError(NoError, nil)
+		}
+	case ViewNames:
+		if len(fields) == 0 {
+			return []string{"username"}, NewError(NoError, nil)
+		}
+		return nil, NewValidationError([]Violation{{Field: "fields", Message: fmt.Sprintf("Fields cannot be chosen for the %v view", ViewNames)}})
+	default:
+		return nil, NewValidationError([]Violation{{Field: "view", Message: fmt.Sprintf("View should be one of %v, %v or %v", ViewNames, ViewSummary, ViewFull)}})
+	}
+
+	known := make(map[string]bool)
+	for _, field := range userFields() {
+		known[field] = true
+	}
+	violations := make([]Violation, 0)
+	for _, field := range fields {
+		if !known[field] {
+			violations = append(violations, Violation{Field: "fields", Message: fmt.Sprintf("Unknown field '%v'", field)})
+		}
+	}
+	if len(violations) > 0 {
+		return nil, NewValidationError(violations)
+	}
+	return fields, NewError(NoError, nil)
+}
+
+// The json names of every field the api shows for a user - bar the password
+func userFields() []string {
+	fields := make([]string, 0)
+	userType := reflect.TypeOf(entities.User{})
+	for i := 0; i < userType.NumField(); i++ {
+		name, _, _ := strings.Cut(userType.Field(i).Tag.Get("json"), ",")
+		if len(name) > 0 && name != "-" && name != "password" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
@@ -1,8 +1,81 @@
 package usecases
 
+import (
+	"encoding/base64"
+	"time"
+)
+
+// UserPage is one page of a user listing
+type UserPage struct {
+	Names []string
+	Total int    // Users matching across every page
+	Next  string // Cursor for the page which follows - empty when this is the last
+}
+
 // List all users, page of users or users matching
 // search parameters.
 func (usecases *Usecases) ListUsers(search string, page int, pageSize int) (names []string) {
 	names, _ = usecases.Registry.StorageInteractor.LookupUserNames(search, page, pageSize)
 	return
 }
+
+// ListUsersPage lists the users whose name contains search. A page of 1 or more pages by
+// offset; otherwise the page starts after the cursor (from the start if empty). Either
+// way Next is a cursor for the following page. A pageSize below 1 gives everyone.
+func (usecases *Usecases) ListUsersPage(search string, page int, pageSize int, cursor string) (UserPage, LightAuthError) {
+	storage := usecases.Registry.StorageInteractor
+	result := UserPage{}
+	total, err := storage.CountUserNames(search)
+	if err != nil {
+		return result, NewError(InternalError, err)
+	}
+	result.Total = total
+
+	if pageSize < 1 {
+		result.Names, err = storage.LookupUserNames(search, -1, -1)
+	} else if page >= 1 {
+		result.Names, err = storage.LookupUserNames(search, page, pageSize)
+		if err == nil && page*pageSize < total && len(result.Names) > 0 {
+			result.Next = encodeCursor(result.Names[len(result.Names)-1])
+		}
+	} else {
+		after, lerror := decodeCursor(cursor)
+		if lerror.Code != NoError {
+			return result, lerror
+		}
+		// One extra tells us whether there is a next page
+		if result.Names, err = storage.LookupUserNamesAfter(search, after, pageSize+1); err == nil && len(result.Names) > pageSize {
+			result.Names = result.Names[:pageSize]
+			result.Next = encodeCursor(result.Names[pageSize-1])
+		}
+	}
+	if err != nil {
+		return result, NewError(InternalError, err)
+	}
+	return result, NewError(NoError, nil)
+}
+
+// Cursors are the last name on a page - encoded so clients treat them as opaque
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeCursor(cursor string) (string, LightAuthError) {
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", NewValidationError([]Violation{{Field: "after", Message: "Cursor is not valid"}})
+	}
+	return string(after), NewError(NoError, nil)
+}
+
+// ParseSince reads a point in time given either as RFC3339 or as a duration back from now (EG 720h)
+func (usecases *Usecases) ParseSince(value string) (time.Time, error) {
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+	ago, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return usecases.now().Add(-ago), nil
+}
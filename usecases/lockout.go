@@ -0,0 +1,145 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// Defaults used for any lockout setting not configured
+const (
+	defaultFailedLoginWindow  = 15 * time.Minute
+	defaultLockoutDuration    = 15 * time.Minute
+	defaultMaxLockoutDuration = 24 * time.Hour
+)
+
+// LockStatus is what admins see of a user's lockout state
+type LockStatus struct {
+	Username     string    `json:"username"`
+	Locked       bool      `json:"locked"`
+	LockedUntil  time.Time `json:"lockedUntil,omitzero"`
+	FailedLogins int       `json:"failedLogins"`
+	Lockouts     int       `json:"lockouts"`
+}
+
+func isLocked(user entities.User, now time.Time) bool {
+	return user.LockedUntil.After(now)
+}
+
+// How often a failed login is re-counted when another change to the user gets in first
+const failedLoginAttempts = 20
+
+// Records a bad password, locking the user once there have been too many within the
+// window. Each lock without a good login in between lasts twice as long as the last.
+// Parallel bad passwords each count - a write which loses to another is re-applied to
+// the user as it now is.
+func (usecases *Usecases) recordFailedLogin(user entities.User, now time.Time) {
+	config := usecases.Registry.Configuration
+	if config.MaxFailedLogins <= 0 {
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		counted := usecases.countFailedLogin(user, now)
+		err := usecases.Registry.StorageInteractor.UpdateUser(counted)
+		if err == nil {
+			if counted.Lockouts > user.Lockouts {
+				usecases.Registry.Logger.Log("WARN", fmt.Sprintf("Locked %v until %v after %v failed logins (lockout %v)",
+					user.Username, counted.LockedUntil.Format(time.RFC3339), config.MaxFailedLogins, counted.Lockouts))
+			}
+			return
+		}
+		if err == ErrVersionConflict && attempt < failedLoginAttempts {
+			if user, err = usecases.Registry.StorageInteractor.LookupUserByName(user.Username); err == nil {
+				continue
+			}
+		}
+		usecases.Registry.Logger.Log("ERROR", fmt.Sprintf("Could not record failed login for %v : %v", user.Username, err))
+		return
+	}
+}
+
+// The user with one more failed login counted
+func (usecases *Usecases) countFailedLogin(user entities.User, now time.Time) entities.User {
+	config := usecases.Registry.Configuration
+	window := config.FailedLoginWindow
+	if window == 0 {
+		window = defaultFailedLoginWindow
+	}
+	if user.FailedLogins == 0 || now.Sub(user.FirstFailedAt) > window {
+		user.FailedLogins = 0
+		user.FirstFailedAt = now
+	}
+	user.FailedLogins++
+
+	if user.FailedLogins >= config.MaxFailedLogins {
+		user.Lockouts++
+		user.LockedUntil = now.Add(usecases.lockoutDuration(user.Lockouts))
+		user.FailedLogins = 0
+		user.FirstFailedAt = time.Time{}
+	}
+	return user
+}
+
+// How long the nth lock lasts - doubling each time up to the maximum
+func (usecases *Usecases) lockoutDuration(lockouts int) time.Duration {
+	config := usecases.Registry.Configuration
+	duration, limit := config.LockoutDuration, config.MaxLockoutDuration
+	if duration == 0 {
+		duration = defaultLockoutDuration
+	}
+	if limit == 0 {
+		limit = defaultMaxLockoutDuration
+	}
+	for i := 1; i < lockouts && duration < limit; i++ {
+		duration *= 2
+	}
+	return min(duration, limit)
+}
+
+// A good login is recorded and forgets earlier failures
+func (usecases *Usecases) recordLogin(user entities.User, now time.Time) entities.User {
+	user.FailedLogins = 0
+	user.FirstFailedAt = time.Time{}
+	user.LockedUntil = time.Time{}
+	user.Lockouts = 0
+	user.LastLoginAt = now.UTC().Truncate(time.Second)
+	if err := usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		usecases.Registry.Logger.Log("ERROR", fmt.Sprintf("Could not record login for %v : %v", user.Username, err))
+	} else {
+		user.Version++
+	}
+	return user
+}
+
+// ReadLock returns the lockout state of a user
+func (usecases *Usecases) ReadLock(username string) (LockStatus, LightAuthError) {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return LockStatus{}, NewError(Unknown, errors.New("No Such User"))
+	}
+	status := LockStatus{Username: username, FailedLogins: user.FailedLogins, Lockouts: user.Lockouts}
+	if isLocked(user, usecases.now()) {
+		status.Locked = true
+		status.LockedUntil = user.LockedUntil
+	}
+	return status, NewError(NoError, nil)
+}
+
+// Unlock clears any lock and failure count on a user
+func (usecases *Usecases) Unlock(username string) LightAuthError {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return NewError(Unknown, errors.New("No Such User"))
+	}
+	user.FailedLogins = 0
+	user.FirstFailedAt = time.Time{}
+	user.LockedUntil = time.Time{}
+	user.Lockouts = 0
+	if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		return NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Unlocked %v", username))
+	return NewError(NoError, nil)
+}
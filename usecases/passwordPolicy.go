@@ -0,0 +1,120 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// checkPasswordPolicy checks a new plaintext password against every configured rule,
+// reporting all of those it breaks. existing is the user as currently stored (empty
+// when creating) and is used to refuse recently used passwords.
+func (usecases *Usecases) checkPasswordPolicy(username, password string, existing entities.User) LightAuthError {
+	config := usecases.Registry.Configuration
+	violations := make([]Violation, 0)
+	broken := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{Field: "password", Message: fmt.Sprintf(format, args...)})
+	}
+
+	if length := len([]rune(password)); length < config.MinPasswordLength {
+		broken("Password must be at least %v characters", config.MinPasswordLength)
+	}
+	if classes := characterClasses(password); classes < config.PasswordClasses {
+		broken("Password must contain at least %v of lower case letters, upper case letters, digits and symbols", config.PasswordClasses)
+	}
+	if usecases.Registry.DeniedPasswords[strings.ToLower(password)] {
+		broken("Password is too common")
+	}
+	if len(username) > 0 && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		broken("Password must not contain the username")
+	}
+	if config.PasswordHistory > 0 {
+		for _, hash := range append([]string{existing.Password}, existing.PasswordHistory...) {
+			if match, _ := usecases.verifyPassword(hash, password); match {
+				broken("Password must not be one of the last %v used", config.PasswordHistory)
+				break
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return NewValidationError(violations)
+	}
+	return NewError(NoError, nil)
+}
+
+// How many of lower case, upper case, digits and everything else appear
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// The history to keep once the existing password is replaced - it goes on the front
+// and the oldest drop off the end
+func (usecases *Usecases) passwordHistory(existing entities.User) []string {
+	keep := usecases.Registry.Configuration.PasswordHistory
+	if keep <= 0 {
+		return nil
+	}
+	history := existing.PasswordHistory
+	if len(existing.Password) > 0 {
+		history = append([]string{existing.Password}, history...)
+	}
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	return history
+}
+
+// ChangePassword replaces a user's password given the current one. A wrong current
+// password counts as a failed login.
+func (usecases *Usecases) ChangePassword(username, current, password string) LightAuthError {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return NewError(Unknown, errors.New("No Such User"))
+	}
+	failed := NewError(NotAuthorized, errors.New("Invalid credentials"))
+	now := usecases.now()
+	if isLocked(user, now) {
+		return failed
+	}
+	if !usecases.checkPassword(user, current) {
+		usecases.recordFailedLogin(user, now)
+		return failed
+	}
+	if len(password) == 0 {
+		return NewValidationError([]Violation{{Field: "password", Message: "Password is required"}})
+	}
+
+	// checkPassword may have upgraded the hash
+	if user, err = usecases.Registry.StorageInteractor.LookupUserByName(username); err != nil {
+		return NewError(InternalError, err)
+	}
+	updated := user
+	updated.Password = password
+	if lerror := usecases.applyPassword(&updated, user); lerror.Code != NoError {
+		return lerror
+	}
+	updated.UpdatedAt = usecases.now().UTC().Truncate(time.Second)
+	if err = usecases.Registry.StorageInteractor.UpdateUser(updated); err != nil {
+		return NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Password changed for %v", username))
+	return NewError(NoError, nil)
+}
@@ -0,0 +1,115 @@
+package usecases
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+const defaultResetTokenLifetime = time.Hour
+
+// PasswordReset is a newly created reset token - this is the only time it is ever seen
+type PasswordReset struct {
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CreatePasswordReset gives a user a single use token which can set their password
+// without knowing the current one. Only a hash of the token is stored and any earlier
+// token is replaced.
+func (usecases *Usecases) CreatePasswordReset(username string) (PasswordReset, LightAuthError) {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return PasswordReset{}, NewError(Unknown, errors.New("No Such User"))
+	}
+
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return PasswordReset{}, NewError(InternalError, err)
+	}
+	// The username travels in the token so it can be found without searching every user
+	token := base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + base64.RawURLEncoding.EncodeToString(secret)
+	lifetime := usecases.Registry.Configuration.ResetTokenLifetime
+	if lifetime == 0 {
+		lifetime = defaultResetTokenLifetime
+	}
+
+	user.ResetTokenHash = hashResetToken(token)
+	user.ResetExpiresAt = usecases.now().Add(lifetime).UTC().Truncate(time.Second)
+	if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		return PasswordReset{}, NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Password reset created for %v expiring %v", username, user.ResetExpiresAt.Format(time.RFC3339)))
+	return PasswordReset{Username: username, Token: token, ExpiresAt: user.ResetExpiresAt}, NewError(NoError, nil)
+}
+
+// ResetPassword sets a new password using a token from CreatePasswordReset. The token
+// is used up once the password is set (a password refused by the policy can be retried)
+// and a successful reset also clears any lockout.
+func (usecases *Usecases) ResetPassword(token, password string) LightAuthError {
+	invalid := NewError(NotAuthorized, errors.New("Invalid or expired reset token"))
+
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return invalid
+	}
+	username, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return invalid
+	}
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(string(username))
+	if err != nil || len(user.ResetTokenHash) == 0 {
+		return invalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashResetToken(token)), []byte(user.ResetTokenHash)) != 1 {
+		return invalid
+	}
+	if !usecases.now().Before(user.ResetExpiresAt) {
+		usecases.clearPasswordReset(user)
+		return invalid
+	}
+	if len(password) == 0 {
+		return NewValidationError([]Violation{{Field: "password", Message: "Password is required"}})
+	}
+
+	updated := user
+	updated.Password = password
+	if lerror := usecases.applyPassword(&updated, user); lerror.Code != NoError {
+		return lerror
+	}
+	updated.UpdatedAt = usecases.now().UTC().Truncate(time.Second)
+	updated.ResetTokenHash = ""
+	updated.ResetExpiresAt = time.Time{}
+	updated.FailedLogins = 0
+	updated.FirstFailedAt = time.Time{}
+	updated.LockedUntil = time.Time{}
+	updated.Lockouts = 0
+	if err = usecases.Registry.StorageInteractor.UpdateUser(updated); err != nil {
+		return NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Password reset for %v", user.Username))
+	return NewError(NoError, nil)
+}
+
+func (usecases *Usecases) clearPasswordReset(user entities.User) {
+	user.ResetTokenHash = ""
+	user.ResetExpiresAt = time.Time{}
+	if err := usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		usecases.Registry.Logger.Log("ERROR", fmt.Sprintf("Could not clear password reset for %v : %v", user.Username, err))
+	}
+}
+
+// Tokens are long and random so a fast unsalted hash is enough
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package usecases
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing schemes
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// Defaults used for any hashing parameter not configured - argon2id as recommended by OWASP
+const (
+	defaultArgon2Time    = 2
+	defaultArgon2Memory  = 19 * 1024 // KiB
+	defaultArgon2Threads = 1
+	argon2SaltLength     = 16
+	argon2KeyLength      = 32
+)
+
+// Hashes a plaintext password with the configured scheme, giving a PHC style string
+// EG $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash> or a bcrypt $2a$... string.
+func (usecases *Usecases) hashPassword(password string) (string, error) {
+	config := usecases.Registry.Configuration
+	switch strings.ToLower(config.PasswordHash) {
+	case "", Argon2id:
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		time, memory, threads := usecases.argon2Parameters()
+		key := argon2.IDKey([]byte(password), salt, time, memory, threads, argon2KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case Bcrypt:
+		cost := config.BcryptCost
+		if cost == 0 {
+			cost = bcrypt.DefaultCost
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		return string(hash), err
+	}
+	return "", fmt.Errorf("unknown password hash '%v'", config.PasswordHash)
+}
+
+func (usecases *Usecases) argon2Parameters() (time uint32, memory uint32, threads uint8) {
+	config := usecases.Registry.Configuration
+	time, memory, threads = config.Argon2Time, config.Argon2Memory, config.Argon2Threads
+	if time == 0 {
+		time = defaultArgon2Time
+	}
+	if memory == 0 {
+		memory = defaultArgon2Memory
+	}
+	if threads == 0 {
+		threads = defaultArgon2Threads
+	}
+	return
+}
+
+// Checks password against a stored hash. rehash is true when the password matched but
+// the hash should be replaced - it is a legacy SHA-256 hash, or was made with a scheme or
+// parameters other than those now configured.
+func (usecases *Usecases) verifyPassword(stored, password string) (match bool, rehash bool) {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		var version int
+		var memory, time uint32
+		var threads uint8
+		parts := strings.Split(stored, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, false
+		}
+		// argon2 panics given no time, memory or threads - such a hash matches nothing
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || memory < 1 || time < 1 || threads < 1 {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil || len(key) == 0 {
+			return false, false
+		}
+		given := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(given, key) != 1 {
+			return false, false
+		}
+		wantTime, wantMemory, wantThreads := usecases.argon2Parameters()
+		scheme := strings.ToLower(usecases.Registry.Configuration.PasswordHash)
+		return true, (scheme != "" && scheme != Argon2id) || time != wantTime || memory != wantMemory || threads != wantThreads
+
+	case isBcryptHash(stored):
+		if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+			return false, false
+		}
+		cost, _ := bcrypt.Cost([]byte(stored))
+		wantCost := usecases.Registry.Configuration.BcryptCost
+		if wantCost == 0 {
+			wantCost = bcrypt.DefaultCost
+		}
+		return true, strings.ToLower(usecases.Registry.Configuration.PasswordHash) != Bcrypt || cost != wantCost
+
+	case isLegacyPasswordHash(stored):
+		sum := sha256.Sum256([]byte(password))
+		given := hex.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(given), []byte(strings.ToLower(stored))) == 1, true
+	}
+	return false, false
+}
+
+func isBcryptHash(value string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unsalted hex SHA-256 - what clients used to send before passwords were hashed here
+func isLegacyPasswordHash(value string) bool {
+	if len(value) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// Works out what to store for a password given on create or update. Empty keeps
+// existing, as does being given back exactly what is stored (EG a client which
+// read the user, changed something else and wrote it back). Anything else is a
+// new plaintext password which must meet the policy - as must the first one.
+func (usecases *Usecases) applyPassword(user *entities.User, existing entities.User) LightAuthError {
+	given := user.Password
+	user.PasswordHistory = existing.PasswordHistory
+	if len(existing.Password) > 0 && (len(given) == 0 || given == existing.Password) {
+		user.Password = existing.Password
+		return NewError(NoError, nil)
+	}
+	if len(given) == 0 {
+		return NewValidationError([]Violation{{Field: "password", Message: "A password is required"}})
+	}
+	if lerror := usecases.checkPasswordPolicy(user.Username, given, existing); lerror.Code != NoError {
+		return lerror
+	}
+	hash, err := usecases.hashPassword(given)
+	if err != nil {
+		return NewError(InternalError, err)
+	}
+	user.Password = hash
+	user.PasswordHistory = usecases.passwordHistory(existing)
+	return NewError(NoError, nil)
+}
+
+// VerifyPassword reports whether password is that of the given user. Passwords held with
+// a legacy or out of date hash are re-hashed with the current settings once verified.
+func (usecases *Usecases) VerifyPassword(username, password string) (bool, LightAuthError) {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return false, NewError(Unknown, errors.New("No Such User"))
+	}
+	return usecases.checkPassword(user, password), NewError(NoError, nil)
+}
+
+// Verifies the password of a user we have already looked up, upgrading its hash if needed
+func (usecases *Usecases) checkPassword(user entities.User, password string) bool {
+	match, rehash := usecases.verifyPassword(user.Password, password)
+	if match && rehash {
+		if hash, err := usecases.hashPassword(password); err == nil {
+			user.Password = hash
+			if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+				usecases.Registry.Logger.Log("WARN", fmt.Sprintf("Could not upgrade password hash for %v : %v", user.Username, err))
+			} else {
+				usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Upgraded password hash for %v", user.Username))
+			}
+		}
+	}
+	return match
+}
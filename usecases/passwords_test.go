@@ -0,0 +1,30 @@
+package usecases
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBadArgon2ParametersNeverMatch(t *testing.T) {
+	usecases := Usecases{Registry: &Registry{Configuration: Configuration{Argon2Memory: 64, Argon2Time: 1}}}
+	hash, err := usecases.hashPassword("Correct-Horse-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if match, _ := usecases.verifyPassword(hash, "Correct-Horse-1"); !match {
+		t.Fatalf("Expected %v to match", hash)
+	}
+
+	parts := strings.Split(hash, "$")
+	for _, bad := range []string{
+		strings.Replace(hash, "m=64,", "m=0,", 1),
+		strings.Replace(hash, ",t=1,", ",t=0,", 1),
+		strings.Replace(hash, ",p=1$", ",p=0$", 1),
+		strings.Replace(hash, ",p=1$", ",p=-1$", 1),
+		strings.Join(append(parts[:5:5], ""), "$"),
+	} {
+		if match, rehash := usecases.verifyPassword(bad, "Correct-Horse-1"); match || rehash {
+			t.Errorf("Expected %v to match nothing - got %v %v", bad, match, rehash)
+		}
+	}
+}
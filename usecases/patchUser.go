@@ -0,0 +1,96 @@
+package usecases
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// Patch formats - named by their media types
+const (
+	MergePatch = "application/merge-patch+json" // RFC 7396
+	JSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// How often an unconditional patch is reapplied when someone else changes the user first
+const patchAttempts = 3
+
+// PatchUser applies an RFC 7396 merge patch or RFC 6902 JSON patch to a user. The patch
+// works on the user as it is read (with enabled, roles and claims always present so
+// operations can address them, and without the password hash so it cannot be tested for)
+// and the result is stored only if nobody has changed the user in between - so a patch is applied whole or not at all. A failed 'test' operation
+// refuses the patch. If version is not 0 the user must still be at that version.
+func (usecases *Usecases) PatchUser(username string, format string, patch []byte, version int64) (entities.User, LightAuthError) {
+	if format != MergePatch && format != JSONPatch {
+		return entities.User{}, NewValidationError([]Violation{{Field: "Content-Type", Message: fmt.Sprintf("Patches should be %v or %v", MergePatch, JSONPatch)}})
+	}
+	var user, patched entities.User
+	var lerror LightAuthError
+	for attempt := 0; attempt < patchAttempts; attempt++ {
+		existing, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+		if err != nil {
+			return entities.User{}, NewError(Unknown, errors.New("No Such User"))
+		}
+		if version != 0 && existing.Version != version {
+			return entities.User{}, NewError(VersionChanged, ErrVersionConflict)
+		}
+
+		if patched, lerror = applyUserPatch(existing, format, patch); lerror.Code != NoError {
+			return entities.User{}, lerror
+		}
+		if patched.Username != username {
+			return entities.User{}, NewValidationError([]Violation{{Field: "username", Message: "The username cannot be changed by a patch"}})
+		}
+		patched.Version = existing.Version
+
+		if user, lerror = usecases.UpdateUser(patched); lerror.Code != VersionChanged || version != 0 {
+			return user, lerror
+		}
+		// Changed since we read it - patch what is there now
+	}
+	return entities.User{}, lerror
+}
+
+// Applies the patch to the json form of the user
+func applyUserPatch(user entities.User, format string, patch []byte) (entities.User, LightAuthError) {
+	document, err := json.Marshal(user)
+	if err != nil {
+		return user, NewError(InternalError, err)
+	}
+	// Roles and claims are omitted when empty but should be there to add to
+	fields := make(map[string]json.RawMessage)
+	json.Unmarshal(document, &fields)
+	// The hash never goes in - a password comes out only if the patch adds one
+	delete(fields, "password")
+	if _, ok := fields["claims"]; !ok {
+		fields["claims"] = json.RawMessage("{}")
+	}
+	if _, ok := fields["roles"]; !ok {
+		fields["roles"] = json.RawMessage("[]")
+	}
+	document, _ = json.Marshal(fields)
+
+	var result []byte
+	if format == MergePatch {
+		result, err = jsonpatch.MergePatch(document, patch)
+	} else {
+		var operations jsonpatch.Patch
+		if operations, err = jsonpatch.DecodePatch(patch); err == nil {
+			result, err = operations.Apply(document)
+		}
+	}
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		return user, NewValidationError([]Violation{{Field: "patch", Message: "A test operation failed"}})
+	} else if err != nil {
+		return user, NewValidationError([]Violation{{Field: "patch", Message: fmt.Sprintf("Patch cannot be applied : %v", err)}})
+	}
+
+	patched := entities.User{}
+	if err = json.Unmarshal(result, &patched); err != nil {
+		return user, NewValidationError([]Violation{{Field: "patch", Message: fmt.Sprintf("Patched user is not valid : %v", err)}})
+	}
+	return patched, NewError(NoError, nil)
+}
@@ -0,0 +1,13 @@
+package usecases
+
+import "github.com/riomhaire/lightauthuserapi/entities"
+
+func (usecases *Usecases) ReadRole(name string) (entities.Role, LightAuthError) {
+	role, err := usecases.Registry.StorageInteractor.LookupRoleByName(name)
+	lerror := NewError(NoError, nil)
+	if err != nil {
+		lerror = NewError(Unknown, err)
+	}
+
+	return role, lerror
+}
@@ -9,6 +9,6 @@ func (usecases *Usecases) ReadUser(name string) (entities.User, LightAuthError)
 		lerror = NewError(Unknown, err)
 	}
 
-	return user, lerror
+	return usecases.redact(user), lerror
 
 }
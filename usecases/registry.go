@@ -2,6 +2,7 @@ package usecases
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/riomhaire/lightauthuserapi/frameworks/serviceregistry"
 )
@@ -12,35 +13,92 @@ type Configuration struct {
 	Version     string
 	RoleStore   string
 	UserStore   string
+	Store       string // Non csv backend url EG sqlite:///path
 	Port        int
-	APIKey      string
+	APIKey      string // Shared key holding every scope - empty for none
+	APIKeysFile string // Where minted api keys are kept
 	Host        string
 	Consul      bool
 	ConsulHost  string
 	ConsulId    string // ID of this client
+
+	AutoCreateRoles bool // Create unknown roles given to users rather than refuse them (migrations)
+
+	PasswordHash  string // argon2id (default) or bcrypt
+	Argon2Time    uint32 // Iterations - zero for the default
+	Argon2Memory  uint32 // KiB - zero for the default
+	Argon2Threads uint8  // Zero for the default
+	BcryptCost    int    // Zero for the default
+	HidePasswords bool   // Never return password hashes from user reads
+
+	MinPasswordLength    int           // Zero for no minimum
+	PasswordClasses      int           // How many of lower, upper, digits and symbols a password needs
+	PasswordHistory      int           // Previous passwords which may not be reused
+	PasswordDenyListFile string        // Common passwords, one per line, which may not be used
+	ResetTokenLifetime   time.Duration // How long an admin password reset lasts - zero for the default
+
+	MFAKey    string // Secret from which the key encrypting TOTP secrets is derived
+	MFAIssuer string // Shown in authenticator apps
+
+	MaxFailedLogins    int           // Bad passwords within the window before locking - zero never locks
+	FailedLoginWindow  time.Duration // Zero for the default
+	LockoutDuration    time.Duration // First lock - each following one doubles. Zero for the default
+	MaxLockoutDuration time.Duration // Zero for the default
+
+	ExpirySweepInterval time.Duration // How often expired users are disabled - zero never sweeps
+
+	JWTSecrets    []string // HS256 secrets bearer JWTs may be signed with
+	JWKSFile      string   // Local JWKS file of RS256/ES256 public keys bearer JWTs may be signed with
+	JWTIssuer     string   // Required iss - empty for any
+	JWTAudience   string   // Required aud - empty for any
+	JWTRolesClaim string   // Claim holding the token's roles - empty for roles
 }
 
 type Registry struct {
 	Configuration           Configuration
 	Logger                  Logger
+	DeniedPasswords         map[string]bool // Lower case - loaded from the deny list file
 	StorageInteractor       StorageInteractor
+	APIKeyStore             APIKeyStore          // nil when only the shared key is used
+	Authenticators          []TokenAuthenticator // Tried in turn for bearer tokens which are not api keys
 	Usecases                Usecases
 	ExternalServiceRegistry serviceregistry.ServiceRegistry
+	Clock                   func() time.Time // What the time is - nil for the system clock. Lets tests move time along
 }
 
 func (c *Configuration) String() string {
-	return fmt.Sprintf("\nCONFIGURATION\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n",
+	return fmt.Sprintf("\nCONFIGURATION\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n\t%15s : '%v'\n",
 		"Application",
 		c.Application,
 		"APIKey",
-		c.APIKey,
+		maskSecret(c.APIKey),
+		"APIKeysFile",
+		c.APIKeysFile,
 		"UserStore",
 		c.UserStore,
 		"RoleStore",
 		c.RoleStore,
+		"Store",
+		c.Store,
 		"Version",
 		c.Version,
 		"Port",
 		c.Port,
+		"PasswordHash",
+		c.PasswordHash,
+		"HidePasswords",
+		c.HidePasswords,
+		"MaxFailedLogins",
+		c.MaxFailedLogins,
+		"JWKSFile",
+		c.JWKSFile,
 	)
 }
+
+// Secrets are logged only as whether they are set
+func maskSecret(secret string) string {
+	if len(secret) == 0 {
+		return "(none)"
+	}
+	return "********"
+}
@@ -0,0 +1,16 @@
+package usecases
+
+import "errors"
+
+// Reload asks the store to re-read its backing data (EG after the csv files have been
+// edited by hand). Not every store needs or supports this.
+func (usecases *Usecases) Reload() LightAuthError {
+	reloadable, ok := usecases.Registry.StorageInteractor.(ReloadableStorageInteractor)
+	if !ok {
+		return NewError(NotImplemented, errors.New("Store does not support reload"))
+	}
+	if err := reloadable.Reload(); err != nil {
+		return NewError(InternalError, err)
+	}
+	return NewError(NoError, nil)
+}
@@ -0,0 +1,41 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// RenameUser moves a user, with everything it holds, to a new username. Any outstanding
+// password reset is dropped as its token names the old user. If version is not 0 the
+// user must still be at that version.
+func (usecases *Usecases) RenameUser(from, to string, version int64) (entities.User, LightAuthError) {
+	if len(to) == 0 || to == from {
+		return entities.User{}, NewValidationError([]Violation{{Field: "username", Message: "A new username is required"}})
+	}
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(from)
+	if err != nil {
+		return entities.User{}, NewError(Unknown, errors.New("No Such User"))
+	}
+	if version != 0 && user.Version != version {
+		return entities.User{}, NewError(VersionChanged, ErrVersionConflict)
+	}
+
+	user.Username = to
+	user.ResetTokenHash = ""
+	user.ResetExpiresAt = time.Time{}
+	user.UpdatedAt = usecases.now().UTC().Truncate(time.Second)
+	err = usecases.Registry.StorageInteractor.RenameUser(from, user)
+	if err == ErrVersionConflict {
+		return entities.User{}, NewError(VersionChanged, err)
+	} else if err == ErrUserExists {
+		return entities.User{}, NewError(AlreadyExists, err)
+	} else if err != nil {
+		return entities.User{}, NewError(InternalError, err)
+	}
+	user.Version++
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Renamed %v to %v", from, to))
+	return usecases.redact(user), NewError(NoError, nil)
+}
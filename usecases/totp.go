@@ -0,0 +1,249 @@
+package usecases
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// RFC 6238 settings - those assumed by authenticator apps when the uri does not say otherwise
+const (
+	totpDigits        = 6
+	totpPeriod        = 30 // Seconds
+	totpSkew          = 1  // Periods either side of now which are accepted
+	totpSecretLength  = 20
+	recoveryCodeCount = 10
+	defaultMFAIssuer  = "LightAuth"
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrolment is what a user needs to set up their authenticator - shown only once
+type TOTPEnrolment struct {
+	Secret          string   `json:"secret"`
+	ProvisioningURI string   `json:"provisioningUri"`
+	RecoveryCodes   []string `json:"recoveryCodes"`
+}
+
+// EnrolTOTP gives a user a new TOTP secret and recovery codes. It is not required at
+// login until confirmed with a code from the authenticator (see ConfirmTOTP). Enrolling
+// again before then replaces the secret and codes; once confirmed the second factor has
+// to be removed (DisableTOTP) first, so starting an enrolment cannot turn it off.
+func (usecases *Usecases) EnrolTOTP(username string) (TOTPEnrolment, LightAuthError) {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return TOTPEnrolment{}, NewError(Unknown, errors.New("No Such User"))
+	}
+	if user.TOTPEnabled {
+		return TOTPEnrolment{}, NewError(AlreadyExists, errors.New("TOTP is already enabled - remove it before enrolling again"))
+	}
+
+	secret := make([]byte, totpSecretLength)
+	if _, err = rand.Read(secret); err != nil {
+		return TOTPEnrolment{}, NewError(InternalError, err)
+	}
+	if user.TOTPSecret, err = usecases.encryptSecret(secret); err != nil {
+		return TOTPEnrolment{}, NewError(InternalError, err)
+	}
+
+	enrolment := TOTPEnrolment{Secret: base32NoPadding.EncodeToString(secret)}
+	user.RecoveryCodes = make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := make([]byte, 5)
+		if _, err = rand.Read(code); err != nil {
+			return TOTPEnrolment{}, NewError(InternalError, err)
+		}
+		plain := strings.ToLower(base32NoPadding.EncodeToString(code))
+		enrolment.RecoveryCodes = append(enrolment.RecoveryCodes, plain)
+		user.RecoveryCodes = append(user.RecoveryCodes, hashRecoveryCode(plain))
+	}
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+
+	issuer := usecases.Registry.Configuration.MFAIssuer
+	if len(issuer) == 0 {
+		issuer = defaultMFAIssuer
+	}
+	enrolment.ProvisioningURI = fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(username), url.Values{
+		"secret":    {enrolment.Secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}.Encode())
+
+	if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		return TOTPEnrolment{}, NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("TOTP enrolment started for %v", username))
+	return enrolment, NewError(NoError, nil)
+}
+
+// ConfirmTOTP completes enrolment given a current code - from then on logins need a code
+func (usecases *Usecases) ConfirmTOTP(username, code string) LightAuthError {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return NewError(Unknown, errors.New("No Such User"))
+	}
+	if len(user.TOTPSecret) == 0 {
+		return NewValidationError([]Violation{{Field: "code", Message: "No TOTP enrolment to confirm"}})
+	}
+	ok, step := usecases.checkTOTP(user, code)
+	if !ok {
+		return NewValidationError([]Violation{{Field: "code", Message: "Code is not valid"}})
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		return NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("TOTP enabled for %v", username))
+	return NewError(NoError, nil)
+}
+
+// DisableTOTP removes a user's second factor
+func (usecases *Usecases) DisableTOTP(username string) LightAuthError {
+	user, err := usecases.Registry.StorageInteractor.LookupUserByName(username)
+	if err != nil {
+		return NewError(Unknown, errors.New("No Such User"))
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	if err = usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		return NewError(InternalError, err)
+	}
+	usecases.Registry.Logger.Log("INFO", fmt.Sprintf("TOTP disabled for %v", username))
+	return NewError(NoError, nil)
+}
+
+// Checks a second factor at login - either a TOTP code or an unused recovery code.
+// Whatever is used cannot be used again, so the user is stored (and returned) when it matches.
+func (usecases *Usecases) checkSecondFactor(user entities.User, code string) (entities.User, bool) {
+	if ok, step := usecases.checkTOTP(user, code); ok {
+		user.TOTPLastStep = step
+	} else if i := indexOfRecoveryCode(user.RecoveryCodes, code); i >= 0 {
+		user.RecoveryCodes = append(append([]string{}, user.RecoveryCodes[:i]...), user.RecoveryCodes[i+1:]...)
+		usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Recovery code used by %v - %v left", user.Username, len(user.RecoveryCodes)))
+	} else {
+		return user, false
+	}
+	if err := usecases.Registry.StorageInteractor.UpdateUser(user); err != nil {
+		usecases.Registry.Logger.Log("ERROR", fmt.Sprintf("Could not record second factor use for %v : %v", user.Username, err))
+		return user, false
+	}
+	user.Version++
+	return user, true
+}
+
+// Checks a code against the user's secret, allowing for clock skew. Codes from the
+// last step used (or before) are refused so a code cannot be replayed.
+func (usecases *Usecases) checkTOTP(user entities.User, code string) (bool, int64) {
+	if len(code) != totpDigits || len(user.TOTPSecret) == 0 {
+		return false, 0
+	}
+	secret, err := usecases.decryptSecret(user.TOTPSecret)
+	if err != nil {
+		usecases.Registry.Logger.Log("ERROR", fmt.Sprintf("Cannot read TOTP secret for %v : %v", user.Username, err))
+		return false, 0
+	}
+	now := usecases.now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= user.TOTPLastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return true, step
+		}
+	}
+	return false, 0
+}
+
+// RFC 4226 HOTP of the step - RFC 6238 uses the time step as the counter
+func totpCode(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+func indexOfRecoveryCode(hashes []string, code string) int {
+	if len(code) == 0 {
+		return -1
+	}
+	hashed := hashRecoveryCode(code)
+	found := -1
+	for i, hash := range hashes {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(hashed)) == 1 {
+			found = i
+		}
+	}
+	return found
+}
+
+// Secrets are stored AES-256-GCM encrypted with a key derived from the configured MFA key,
+// as base64 of nonce followed by ciphertext
+func (usecases *Usecases) encryptSecret(secret []byte) (string, error) {
+	aead, err := usecases.secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func (usecases *Usecases) decryptSecret(stored string) ([]byte, error) {
+	aead, err := usecases.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted secret too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+func (usecases *Usecases) secretCipher() (cipher.AEAD, error) {
+	key := usecases.Registry.Configuration.MFAKey
+	if len(key) == 0 {
+		return nil, errors.New("no MFA key configured")
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
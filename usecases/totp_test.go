@@ -0,0 +1,36 @@
+package usecases
+
+import "testing"
+
+// RFC 6238 appendix B (SHA1) - the 8 digit codes there end with these 6 digits
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{20000000000, "353130"},
+	} {
+		if code := totpCode(secret, tc.time/totpPeriod); code != tc.code {
+			t.Errorf("At %v expected %v got %v", tc.time, tc.code, code)
+		}
+	}
+}
+
+func TestSecretEncryptionRoundTrip(t *testing.T) {
+	usecases := Usecases{Registry: &Registry{Configuration: Configuration{MFAKey: "key"}}}
+	stored, err := usecases.encryptSecret([]byte("secret"))
+	if err != nil || stored == "secret" {
+		t.Fatalf("Unexpected encryption %v %v", stored, err)
+	}
+	if plain, err := usecases.decryptSecret(stored); err != nil || string(plain) != "secret" {
+		t.Errorf("Expected round trip - got %v %v", string(plain), err)
+	}
+	usecases.Registry.Configuration.MFAKey = "other"
+	if _, err := usecases.decryptSecret(stored); err == nil {
+		t.Errorf("Expected a different key to fail")
+	}
+}
@@ -0,0 +1,31 @@
+package usecases
+
+import (
+	"errors"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+func (usecases *Usecases) UpdateRole(role entities.Role) (entities.Role, LightAuthError) {
+	if lerror := validateRole(role); lerror.Code != NoError {
+		return role, lerror
+	}
+	if lerror := usecases.checkIncludes(role); lerror.Code != NoError {
+		return role, lerror
+	}
+	lerror := NewError(NoError, nil)
+	current, err := usecases.Registry.StorageInteractor.LookupRoleByName(role.Name)
+
+	if err == nil {
+		// When a role was created is not something which can be changed
+		role.CreatedAt = current.CreatedAt
+		err = usecases.Registry.StorageInteractor.UpdateRole(role)
+		if err != nil {
+			lerror = NewError(InternalError, err)
+		}
+	} else {
+		lerror = NewError(Unknown, errors.New("No Such Role"))
+	}
+
+	return role, lerror
+}
@@ -2,24 +2,61 @@ package usecases
 
 import (
 	"errors"
+	"time"
 
 	"github.com/riomhaire/lightauthuserapi/entities"
 )
 
+// UpdateUser replaces a user. If user.Version is set the update is refused with
+// VersionChanged unless the stored user is still at that version - otherwise it
+// applies to the version read here.
 func (usecases *Usecases) UpdateUser(user entities.User) (entities.User, LightAuthError) {
 	// Do some validation here before we save - IE User should not exist
 	lerror := NewError(NoError, nil)
-	_, err := usecases.Registry.StorageInteractor.LookupUserByName(user.Username)
+	existing, err := usecases.Registry.StorageInteractor.LookupUserByName(user.Username)
 
 	if err == nil {
+		if lerror = usecases.checkRoles(user.Roles); lerror.Code != NoError {
+			return user, lerror
+		}
+		if lerror = usecases.applyPassword(&user, existing); lerror.Code != NoError {
+			return user, lerror
+		}
+		keepServerState(&user, existing)
+		user.UpdatedAt = usecases.now().UTC().Truncate(time.Second)
+		if user.Version == 0 {
+			user.Version = existing.Version
+		}
 		err = usecases.Registry.StorageInteractor.UpdateUser(user)
-		if err != nil {
+		if err == ErrVersionConflict {
+			lerror = NewError(VersionChanged, err)
+		} else if err != nil {
 			lerror = NewError(InternalError, err)
+		} else {
+			user.Version++
 		}
 	} else {
 		lerror = NewError(Unknown, errors.New("No Such User"))
 	}
 
-	return user, lerror
+	return usecases.redact(user), lerror
+
+}
 
+// Copies the state which only the server changes (timestamps, logins, locks, resets, mfa) from existing,
+// so it cannot be set through create or update
+func keepServerState(user *entities.User, existing entities.User) {
+	user.CreatedAt = existing.CreatedAt
+	user.UpdatedAt = existing.UpdatedAt
+	user.LastLoginAt = existing.LastLoginAt
+	user.FailedLogins = existing.FailedLogins
+	user.FirstFailedAt = existing.FirstFailedAt
+	user.LockedUntil = existing.LockedUntil
+	user.Lockouts = existing.Lockouts
+	user.ResetTokenHash = existing.ResetTokenHash
+	user.ResetExpiresAt = existing.ResetExpiresAt
+	user.TOTPSecret = existing.TOTPSecret
+	user.TOTPEnabled = existing.TOTPEnabled
+	user.TOTPLastStep = existing.TOTPLastStep
+	user.RecoveryCodes = existing.RecoveryCodes
 }
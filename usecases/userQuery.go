@@ -0,0 +1,214 @@
+package usecases
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/riomhaire/lightauthuserapi/entities"
+)
+
+// Orders a UserQuery can give users in - a leading '-' is descending
+const (
+	SortByUsername  = "username"
+	SortByCreated   = "createdAt"
+	SortByLastLogin = "lastLoginAt"
+)
+
+// UserQuery selects users - each field given must match
+type UserQuery struct {
+	Search        string            // Username contains
+	Prefix        string            // Username starts with
+	Roles         []string          // Holds every one, directly or through a role which includes it
+	Enabled       *bool             // nil for either
+	Claims        map[string]string // Holds each claim key with the value
+	InactiveSince time.Time         // Not logged in since (or never)
+	Sort          string            // One of the SortBy values, '-' prefixed for descending. Empty is by username
+}
+
+// Only a username search in username order - which every store can page itself
+func (query UserQuery) simple() bool {
+	return len(query.Prefix) == 0 && len(query.Roles) == 0 && query.Enabled == nil && len(query.Claims) == 0 &&
+		query.InactiveSince.IsZero() && (len(query.Sort) == 0 || query.Sort == SortByUsername)
+}
+
+// Matches checks a user against every part of the query. effective are the roles the user
+// holds directly and through includes - a user must hold each of the query's roles.
+func (query UserQuery) Matches(user entities.User, effective []string) bool {
+	if !strings.Contains(user.Username, query.Search) || !strings.HasPrefix(user.Username, query.Prefix) {
+		return false
+	}
+	if query.Enabled != nil && user.Enabled != *query.Enabled {
+		return false
+	}
+	for key, value := range query.Claims {
+		if claim, ok := user.Claims[key]; !ok || claim != value {
+			return false
+		}
+	}
+	if !query.InactiveSince.IsZero() && !user.LastLoginAt.Before(query.InactiveSince) {
+		return false
+	}
+	for _, role := range query.Roles {
+		found := false
+		for _, held := range effective {
+			if held == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// FindUsers lists the users matching the query in its order. Paging is as for ListUsersPage.
+// Stores which can run the query do so, otherwise every candidate user is read and checked.
+func (usecases *Usecases) FindUsers(query UserQuery, page int, pageSize int, cursor string) (UserPage, LightAuthError) {
+	sortKey, descending, lerror := userSortKey(query.Sort)
+	if lerror.Code != NoError {
+		return UserPage{}, lerror
+	}
+	if query.simple() {
+		return usecases.ListUsersPage(query.Search, page, pageSize, cursor)
+	}
+
+	var users []entities.User
+	var err error
+	if runner, ok := usecases.Registry.StorageInteractor.(UserQueryRunner); ok {
+		users, err = runner.QueryUsers(query)
+	} else {
+		users, err = usecases.scanUsers(query)
+	}
+	if err != nil {
+		return UserPage{}, NewError(InternalError, err)
+	}
+
+	rows := make([]sortRow, len(users))
+	for i, user := range users {
+		rows[i] = sortRow{sortKey(user), user.Username}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].before(rows[j], descending) })
+	return pageOfRows(rows, page, pageSize, cursor, descending)
+}
+
+// Reads and checks every user who might match. Claims narrow who is read first.
+func (usecases *Usecases) scanUsers(query UserQuery) ([]entities.User, error) {
+	storage := usecases.Registry.StorageInteractor
+	var names []string
+	var err error
+	if len(query.Claims) > 0 {
+		first := true
+		for key, value := range query.Claims {
+			matches, err := storage.LookupUserNamesByClaim(key, value)
+			if err != nil {
+				return nil, err
+			}
+			if first {
+				names = matches
+				first = false
+			} else {
+				names = intersect(names, matches)
+			}
+		}
+	} else if names, err = storage.LookupUserNames(query.Search, -1, -1); err != nil {
+		return nil, err
+	}
+
+	var hierarchy map[string][]string
+	if len(query.Roles) > 0 {
+		if hierarchy, err = usecases.roleHierarchy(); err != nil {
+			return nil, err
+		}
+	}
+	candidates, err := storage.LookupUsersByName(names)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]entities.User, 0)
+	for _, user := range candidates {
+		if query.Matches(user, expandRoles(hierarchy, user.Roles)) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// A user's place in a sorted listing
+type sortRow struct {
+	Key  string
+	Name string
+}
+
+// Ties on the key go by name so the order is always the same
+func (row sortRow) before(other sortRow, descending bool) bool {
+	if row.Key != other.Key {
+		return (row.Key < other.Key) != descending
+	}
+	return row.Name != other.Name && (row.Name < other.Name) != descending
+}
+
+// What users are sorted by - times as fixed width strings so they order as text
+func userSortKey(order string) (func(entities.User) string, bool, LightAuthError) {
+	descending := strings.HasPrefix(order, "-")
+	switch strings.TrimPrefix(order, "-") {
+	case "", SortByUsername:
+		return func(user entities.User) string { return user.Username }, descending, NewError(NoError, nil)
+	case SortByCreated:
+		return func(user entities.User) string { return sortableTime(user.CreatedAt) }, descending, NewError(NoError, nil)
+	case SortByLastLogin:
+		return func(user entities.User) string { return sortableTime(user.LastLoginAt) }, descending, NewError(NoError, nil)
+	}
+	return nil, false, NewValidationError([]Violation{{Field: "sort", Message: fmt.Sprintf("Sort should be one of %v, %v or %v, with - for descending", SortByUsername, SortByCreated, SortByLastLogin)}})
+}
+
+func sortableTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// Cuts a page from sorted rows. Cursors name the last row of a page by key and name so
+// paging carries on from the right place even as users come and go.
+func pageOfRows(rows []sortRow, page int, pageSize int, cursor string, descending bool) (UserPage, LightAuthError) {
+	result := UserPage{Total: len(rows)}
+	start, end := 0, len(rows)
+	if pageSize >= 1 {
+		if page >= 1 {
+			start = min((page-1)*pageSize, len(rows))
+		} else if len(cursor) > 0 {
+			decoded, lerror := decodeCursor(cursor)
+			if lerror.Code != NoError {
+				return UserPage{}, lerror
+			}
+			last := sortRow{}
+			last.Key, last.Name, _ = strings.Cut(decoded, "\x00")
+			start = sort.Search(len(rows), func(i int) bool { return last.before(rows[i], descending) })
+		}
+		end = min(start+pageSize, len(rows))
+		if end < len(rows) && end > start {
+			result.Next = encodeCursor(rows[end-1].Key + "\x00" + rows[end-1].Name)
+		}
+	}
+	result.Names = make([]string, 0, end-start)
+	for _, row := range rows[start:end] {
+		result.Names = append(result.Names, row.Name)
+	}
+	return result, NewError(NoError, nil)
+}
+
+// Values within both a and b - in the order of a
+func intersect(a, b []string) []string {
+	inB := make(map[string]bool, len(b))
+	for _, v := range b {
+		inB[v] = true
+	}
+	both := make([]string, 0)
+	for _, v := range a {
+		if inB[v] {
+			both = append(both, v)
+		}
+	}
+	return both
+}
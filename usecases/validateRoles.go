@@ -0,0 +1,43 @@
+package usecases
+
+import "fmt"
+
+// checkRoles makes sure every role given to a user exists. Unknown roles are refused
+// with an Invalid error naming each of them - unless the configuration says to
+// create them, which is useful when migrating users in from elsewhere.
+func (usecases *Usecases) checkRoles(roles []string) LightAuthError {
+	known, err := usecases.Registry.StorageInteractor.LookupRoleNames()
+	if err != nil {
+		return NewError(InternalError, err)
+	}
+	exists := make(map[string]bool)
+	for _, role := range known {
+		exists[role] = true
+	}
+
+	unknown := make([]string, 0)
+	for _, role := range roles {
+		if len(role) > 0 && !exists[role] {
+			unknown = append(unknown, role)
+			exists[role] = true // Only report once
+		}
+	}
+	if len(unknown) == 0 {
+		return NewError(NoError, nil)
+	}
+
+	if !usecases.Registry.Configuration.AutoCreateRoles {
+		violations := make([]Violation, 0, len(unknown))
+		for _, role := range unknown {
+			violations = append(violations, Violation{Field: "roles", Message: fmt.Sprintf("Unknown role '%v'", role)})
+		}
+		return NewValidationError(violations)
+	}
+	for _, role := range unknown {
+		if _, lerror := usecases.CreateRole(newRole(role)); lerror.Code != NoError && lerror.Code != AlreadyExists {
+			return lerror
+		}
+		usecases.Registry.Logger.Log("INFO", fmt.Sprintf("Created role %v on first use", role))
+	}
+	return NewError(NoError, nil)
+}